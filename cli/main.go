@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime/debug"
 	"syscall"
 	"time"
@@ -40,8 +41,14 @@ func main() {
 
 func run(ctx context.Context) error {
 	var (
-		showVersion = false
-		logLevel    = slog.LevelDebug
+		showVersion    = false
+		configFile     = ""
+		logLevel       = slog.LevelDebug
+		logLevelRevert time.Duration
+		logFormat      = "text"
+		logOutput      = "stderr"
+		logSource      = false
+		logRedact      = regexp.MustCompile(defaultRedactPattern)
 
 		// app settings
 		wait      time.Duration
@@ -50,13 +57,24 @@ func run(ctx context.Context) error {
 	)
 
 	flag.TextVar(&logLevel, "log-level", logLevel, "log level (DEBUG, INFO, WARN, ERROR)")
+	flag.DurationVar(&logLevelRevert, "log-level-revert", logLevelRevert, "revert log level changes at runtime (SIGUSR1) after this duration. 0 disables the revert")
+	flag.StringVar(&logFormat, "log-format", logFormat, "log format (text, logfmt, json, pretty)")
+	flag.StringVar(&logOutput, "log-output", logOutput, "log output (stderr, stdout or a file path)")
+	flag.BoolVar(&logSource, "log-source", logSource, "add source code position to log records")
+	flag.TextVar(logRedact, "log-redact", logRedact, "regular expression for attribute keys whose values get redacted in the logs")
 	flag.BoolVar(&showVersion, "version", showVersion, "print version and exit")
+	flag.StringVar(&configFile, "config", configFile, "config file (JSON, YAML or TOML) with flag values. environment variables and flags take precedence")
 
 	flag.DurationVar(&wait, "wait", wait, "wait setting")
 	flag.StringVar(&serverURL, "url", serverURL, "server url")
 	flag.BoolVar(&runClient, "client", runClient, "run the client")
 
-	err := readFlagsFromEnv(flag.CommandLine, envPrefix)
+	err := readFlagsFromConfigFile(flag.CommandLine, "config", os.Args[1:], envPrefix)
+	if err != nil {
+		return err
+	}
+
+	err = readFlagsFromEnv(flag.CommandLine, envPrefix)
 	if err != nil {
 		return err
 	}
@@ -77,7 +95,16 @@ func run(ctx context.Context) error {
 	}
 
 	// we explicitly set the default logger that it is set for the old log package as well
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	levelController := newLogLevelController(logLevel)
+	baseLogHandler, closeLog, err := newLogHandler(logFormat, logOutput, logSource, levelController.Leveler())
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	slog.SetDefault(slog.New(newRedactHandler(baseLogHandler, logRedact)))
+
+	// send SIGUSR1 to cycle through the log levels
+	go levelController.handleSignals(ctx, logLevelRevert)
 
 	if runClient {
 		// will log with slog
@@ -50,6 +50,9 @@ func run() error {
 			"one",
 			"two",
 		}
+
+		// config file with the lowest precedence
+		configFile = ""
 	)
 
 	// built-in flag types
@@ -78,8 +81,14 @@ func run() error {
 	// flags with custom type which implement the flag.Value interface
 	flag.Var(newMapValue(myMapping, "=", ","), "map", "my mapping")
 	flag.Var(newSliceValue(&myItems, ","), "item", "my items")
+	flag.StringVar(&configFile, "config", configFile, "config file (JSON, YAML or TOML)")
+
+	err := readFlagsFromConfigFile(flag.CommandLine, "config", os.Args[1:], "MY_APP_")
+	if err != nil {
+		return err
+	}
 
-	err := readFlagsFromEnv(flag.CommandLine, "MY_APP_")
+	err = readFlagsFromEnv(flag.CommandLine, "MY_APP_")
 	if err != nil {
 		return err
 	}
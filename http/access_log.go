@@ -1,50 +1,146 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
+	"slices"
+	"sync"
 	"time"
 )
 
-func logHandler(next http.Handler, logger *slog.Logger) http.Handler {
+// statusClientClosedRequest is logged if the client canceled the request
+// before the response was sent (nginx convention).
+const statusClientClosedRequest = 499
+
+// logHandler writes an access log record for each request. If tailLog is set
+// DEBUG records of a request are buffered and only written if the request
+// failed (5xx, panic) or took longer than tailLog.LatencyThreshold.
+func logHandler(next http.Handler, logger *slog.Logger, tailLog *tailLogOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var logBuffer *tailLogBuffer
+		if tailLog != nil && tailLog.BufferSize > 0 {
+			var ctx context.Context
+			ctx, logBuffer = withTailLogBuffer(r.Context(), tailLog.BufferSize)
+			r = r.WithContext(ctx)
+			defer func() {
+				if err := recover(); err != nil {
+					logBuffer.flush(r.Context())
+					panic(err)
+				}
+			}()
+		}
+
+		updateInFlightRequest(r.Context(), func(req *inFlightRequest) {
+			req.client = getClientIP(r)
+		})
+
+		extraAttrs := &accessLogAttrs{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogAttrsKey, extraAttrs))
 
 		sw := newStatusResponseWriter(w)
 		start := time.Now()
 		next.ServeHTTP(sw, r)
+		duration := time.Since(start)
 
+		if logBuffer != nil {
+			if sw.statusCode >= 500 || (tailLog.LatencyThreshold > 0 && duration > tailLog.LatencyThreshold) {
+				logBuffer.flush(r.Context())
+			} else {
+				logBuffer.discard()
+			}
+		}
+
+		code := sw.statusCode
 		if r.Context().Err() != nil {
-			logger.LogAttrs(r.Context(), slog.LevelInfo, "access_log",
-				slog.String("client", r.RemoteAddr),
-				slog.String("method", r.Method),
-				slog.String("uri", r.RequestURI),
-				slog.Int64("content_length", r.ContentLength),
-				slog.String("host", r.Host),
-				slog.String("proto", r.Proto),
-
-				slog.Int("code", 499),
-				slog.Duration("duration", time.Since(start)),
-				slog.Int("bytes", sw.bytesWritten),
-
-				slog.String("err", r.Context().Err().Error()),
-			)
-		} else {
-			logger.LogAttrs(r.Context(), slog.LevelInfo, "access_log",
-				slog.String("client", r.RemoteAddr),
-				slog.String("method", r.Method),
-				slog.String("uri", r.RequestURI),
-				slog.Int64("content_length", r.ContentLength),
-				slog.String("host", r.Host),
-				slog.String("proto", r.Proto),
-
-				slog.Int("code", sw.statusCode),
-				slog.Duration("duration", time.Since(start)),
-				slog.Int("bytes", sw.bytesWritten),
-			)
+			code = statusClientClosedRequest
+		}
+
+		// the matched route pattern (see withRoute) identifies the request,
+		// the path is only logged if no route matched. the query is never
+		// logged, it can contain secrets (e.g. tokens)
+		extra := extraAttrs.get()
+		attrs := []slog.Attr{
+			slog.String("client", getClientIP(r)),
+			slog.String("method", r.Method),
 		}
+		if !slices.ContainsFunc(extra, func(attr slog.Attr) bool { return attr.Key == "route" }) {
+			attrs = append(attrs, slog.String("path", r.URL.Path))
+		}
+		attrs = append(attrs,
+			slog.Int64("content_length", r.ContentLength),
+			slog.String("host", r.Host),
+			slog.String("proto", r.Proto),
+
+			slog.Int("code", code),
+			slog.Duration("duration", duration),
+			slog.Int("bytes", sw.bytesWritten),
+		)
+		if r.Context().Err() != nil {
+			attrs = append(attrs, slog.String("err", context.Cause(r.Context()).Error()))
+		}
+		attrs = append(attrs, grpcStatusAttrs(w.Header())...)
+		attrs = append(attrs, extra...)
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "access_log", attrs...)
 	})
 }
 
+// accessLogAttrs collects attributes which handlers further down the chain
+// add to the access log record of a request.
+type accessLogAttrs struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+func (a *accessLogAttrs) add(attrs ...slog.Attr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.attrs = append(a.attrs, attrs...)
+}
+
+// set adds the attributes and replaces existing attributes with the same
+// key.
+func (a *accessLogAttrs) set(attrs ...slog.Attr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, attr := range attrs {
+		i := slices.IndexFunc(a.attrs, func(existing slog.Attr) bool {
+			return existing.Key == attr.Key
+		})
+		if i < 0 {
+			a.attrs = append(a.attrs, attr)
+			continue
+		}
+		a.attrs[i] = attr
+	}
+}
+
+func (a *accessLogAttrs) get() []slog.Attr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.attrs
+}
+
+type ctxKeyAccessLogAttrs int
+
+const accessLogAttrsKey ctxKeyAccessLogAttrs = 0
+
+// addAccessLogAttrs adds attributes to the access log record of the request.
+// It does nothing if the request is not handled by logHandler.
+func addAccessLogAttrs(ctx context.Context, attrs ...slog.Attr) {
+	if a, ok := ctx.Value(accessLogAttrsKey).(*accessLogAttrs); ok {
+		a.add(attrs...)
+	}
+}
+
+// setAccessLogAttrs is like addAccessLogAttrs but replaces attributes with
+// the same key, e.g. to log only the last of multiple attempts.
+func setAccessLogAttrs(ctx context.Context, attrs ...slog.Attr) {
+	if a, ok := ctx.Value(accessLogAttrsKey).(*accessLogAttrs); ok {
+		a.set(attrs...)
+	}
+}
+
 type requestLogValue struct {
 	*http.Request
 }
@@ -55,7 +151,7 @@ func (r requestLogValue) LogValue() slog.Value {
 		slog.String("proto", r.Proto),
 		slog.String("method", r.Method),
 		slog.String("host", r.Host),
-		slog.String("uri", r.RequestURI),
+		slog.String("path", r.URL.Path),
 	)
 }
 
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// newAdminServer returns the server for administrative endpoints. It should
+// only listen on a local or otherwise protected address.
+func newAdminServer(addr string, mux *http.ServeMux) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		slog.LogAttrs(r.Context(), slog.LevelError, "failed to format response", slog.Any("err", err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(out)
+	w.Write([]byte("\n"))
+}
+
+type logLevelRequest struct {
+	Level       slog.Level `json:"level"`
+	RevertAfter string     `json:"revert_after,omitempty"`
+}
+
+// logLevelHandler shows the current log level on GET and changes it on PUT.
+// The body of a PUT request has the format {"level": "DEBUG",
+// "revert_after": "5m"}. If revert_after is not set defaultRevertAfter is
+// used.
+func logLevelHandler(c *logLevelController, defaultRevertAfter time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			// the level is a pointer to distinguish a missing level
+			// from INFO (0)
+			req := struct {
+				Level       *slog.Level `json:"level"`
+				RevertAfter string      `json:"revert_after"`
+			}{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				errorHandler(w, r, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+				return
+			}
+			if req.Level == nil {
+				errorHandler(w, r, http.StatusBadRequest, "missing level")
+				return
+			}
+			revertAfter := defaultRevertAfter
+			if req.RevertAfter != "" {
+				revertAfter, err = time.ParseDuration(req.RevertAfter)
+				if err != nil {
+					errorHandler(w, r, http.StatusBadRequest, fmt.Errorf("invalid revert_after: %w", err))
+					return
+				}
+			}
+			c.Set(*req.Level, revertAfter)
+			slog.WarnContext(r.Context(), "changed log level", "level", *req.Level, "revert_after", revertAfter)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			errorHandler(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, logLevelRequest{Level: c.Level()})
+	})
+}
+
+// upstreamsHandler shows the routes and the state of their upstream pools.
+func upstreamsHandler(router *proxyRouter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, router.status())
+	})
+}
+
+// inFlightRequestsHandler lists the requests which are currently served.
+func inFlightRequestsHandler(inFlight *inFlightRequests) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			errorHandler(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, inFlight.status())
+	})
+}
+
+// cancelRequestHandler cancels the context of the in-flight request with the
+// ID of the path on DELETE, e.g. to stop a runaway request.
+func cancelRequestHandler(inFlight *inFlightRequests) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			errorHandler(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		id, err := parseRequestID(r.PathValue("id"))
+		if err != nil {
+			errorHandler(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !inFlight.cancel(id) {
+			errorHandler(w, r, http.StatusNotFound, "request not in flight")
+			return
+		}
+		slog.WarnContext(r.Context(), "canceled request", "canceled_request_id", id.String())
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// concurrencyLimitsHandler shows the current concurrency limits and their
+// in-flight and queued requests.
+func concurrencyLimitsHandler(limiter *concurrencyLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, limiter.status())
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// errNoCredentials is returned by an authVerifier if the request contains no
+// credentials for its scheme.
+var errNoCredentials = errors.New("no credentials")
+
+// authVerifier verifies the credentials of a request.
+type authVerifier interface {
+	// Verify returns the principal of the request. It returns
+	// errNoCredentials if the request has no credentials for the
+	// verifier, so that the next verifier is tried.
+	Verify(r *http.Request) (*principal, error)
+	// Challenge returns the value for the WWW-Authenticate header.
+	Challenge(err error) string
+}
+
+type authOptions struct {
+	// Realm is sent in the challenges of the verifiers.
+	Realm string
+	// HtpasswdFile enables basic authentication with the users of the
+	// file.
+	HtpasswdFile string
+	// JWKS is a file or URL with the keys to verify JWT bearer tokens.
+	JWKS        string
+	JWTIssuer   string
+	JWTAudience string
+	// Allow restricts the access to these principals. All authenticated
+	// principals are allowed if empty.
+	Allow []string
+}
+
+func defaultAuthOptions() authOptions {
+	return authOptions{
+		Realm: "http-server",
+	}
+}
+
+// newAuthVerifiers returns the verifiers configured in opts.
+func newAuthVerifiers(opts authOptions) ([]authVerifier, error) {
+	verifiers := []authVerifier{}
+	if opts.HtpasswdFile != "" {
+		v, err := newHtpasswdVerifier(opts.HtpasswdFile, opts.Realm)
+		if err != nil {
+			return nil, err
+		}
+		verifiers = append(verifiers, v)
+	}
+	if opts.JWKS != "" {
+		v, err := newJWTVerifier(opts.JWKS, opts.JWTIssuer, opts.JWTAudience, opts.Realm)
+		if err != nil {
+			return nil, err
+		}
+		verifiers = append(verifiers, v)
+	}
+	return verifiers, nil
+}
+
+// authMiddleware authenticates each request with the first verifier for
+// which the request has credentials. Requests without valid credentials are
+// rejected with 401 and requests of principals which are not in allow with
+// 403. The principal is stored in the request context (see getPrincipal) and
+// added to the access log.
+func authMiddleware(next http.Handler, verifiers []authVerifier, allow []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			p   *principal
+			err = errNoCredentials
+			v   authVerifier
+		)
+		for _, v = range verifiers {
+			p, err = v.Verify(r)
+			if !errors.Is(err, errNoCredentials) {
+				break
+			}
+		}
+		if err != nil {
+			if errors.Is(err, errNoCredentials) {
+				// offer all schemes
+				for _, v := range verifiers {
+					w.Header().Add("WWW-Authenticate", v.Challenge(nil))
+				}
+			} else {
+				slog.DebugContext(r.Context(), "authentication failed", "err", err)
+				addAccessLogAttrs(r.Context(), slog.String("auth_err", err.Error()))
+				w.Header().Set("WWW-Authenticate", v.Challenge(err))
+			}
+			errorHandler(w, r, http.StatusUnauthorized, nil)
+			return
+		}
+
+		addAccessLogAttrs(r.Context(), slog.String("principal", p.Name))
+		if len(allow) > 0 && !slices.Contains(allow, p.Name) {
+			errorHandler(w, r, http.StatusForbidden, nil)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// quoteAuthParam quotes a parameter value of a WWW-Authenticate header.
+func quoteAuthParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ authVerifier = (*htpasswdVerifier)(nil)
+
+// htpasswdVerifier verifies basic auth credentials against the users of an
+// htpasswd file with bcrypt ($2y$) or SHA-1 ({SHA}) hashes. The file is
+// reloaded if it changes.
+type htpasswdVerifier struct {
+	realm string
+	users *reloadingFile[map[string]string]
+	// dummyHash is compared for unknown users, so that the response
+	// time does not reveal if a user exists.
+	dummyHash []byte
+}
+
+func newHtpasswdVerifier(file string, realm string) (*htpasswdVerifier, error) {
+	v := &htpasswdVerifier{
+		realm: realm,
+		users: &reloadingFile[map[string]string]{
+			files: []string{file},
+			load: func() (map[string]string, error) {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					return nil, err
+				}
+				return parseHtpasswd(data)
+			},
+		},
+	}
+	_, err := v.users.get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load htpasswd file: %w", err)
+	}
+	v.dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parseHtpasswd parses the lines in the format user:hash. Empty lines and
+// lines starting with # are ignored.
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("line %d: invalid format", lineNr)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("line %d: unsupported hash for user '%s', use bcrypt or SHA", lineNr, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func (v *htpasswdVerifier) Verify(r *http.Request) (*principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errNoCredentials
+	}
+	users, err := v.users.get()
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(v.dummyHash, []byte(password))
+		return nil, fmt.Errorf("unknown user '%s'", user)
+	}
+	if !checkHtpasswdHash(hash, password) {
+		return nil, fmt.Errorf("invalid password for user '%s'", user)
+	}
+	return &principal{
+		Name:   user,
+		Scheme: "basic",
+	}, nil
+}
+
+func checkHtpasswdHash(hash string, password string) bool {
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (v *htpasswdVerifier) Challenge(error) string {
+	return "Basic realm=" + quoteAuthParam(v.realm) + `, charset="UTF-8"`
+}
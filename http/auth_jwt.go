@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// supported JWT signature algorithms
+const (
+	jwtRS256 = "RS256"
+	jwtES256 = "ES256"
+	jwtEdDSA = "EdDSA"
+)
+
+// jwtLeeway is the tolerated clock skew for the exp and nbf claims.
+const jwtLeeway = time.Minute
+
+var _ authVerifier = (*jwtVerifier)(nil)
+
+// jwtVerifier verifies JWT bearer tokens (RFC 7519) which are signed with
+// RS256, ES256 or EdDSA against the keys of a JWKS (RFC 7517). The subject
+// of the token is the principal.
+type jwtVerifier struct {
+	keys     *jwks
+	issuer   string
+	audience string
+	realm    string
+}
+
+func newJWTVerifier(source string, issuer string, audience string, realm string) (*jwtVerifier, error) {
+	keys, err := newJWKS(source)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtVerifier{
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+		realm:    realm,
+	}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+}
+
+// jwtAudience is a single audience or a list of audiences.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte("[")) {
+		return json.Unmarshal(data, (*[]string)(a))
+	}
+	var audience string
+	err := json.Unmarshal(data, &audience)
+	*a = jwtAudience{audience}
+	return err
+}
+
+func (v *jwtVerifier) Verify(r *http.Request) (*principal, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errNoCredentials
+	}
+	claims, err := v.verifyToken(r.Context(), strings.TrimSpace(token), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &principal{
+		Name:   claims.Subject,
+		Scheme: "jwt",
+	}, nil
+}
+
+func (v *jwtVerifier) verifyToken(ctx context.Context, token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	header := &jwtHeader{}
+	err := decodeJWTPart(parts[0], header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+
+	keys, err := v.keys.find(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !slices.ContainsFunc(keys, func(key crypto.PublicKey) bool {
+		return verifyJWTSignature(header.Alg, key, signed, signature)
+	}) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := &jwtClaims{}
+	err = decodeJWTPart(parts[1], claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if claims.ExpiresAt != nil && now.After(time.Unix(*claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-jwtLeeway)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("invalid token issuer '%s'", claims.Issuer)
+	}
+	if v.audience != "" && !slices.Contains(claims.Audience, v.audience) {
+		return nil, errors.New("invalid token audience")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token without subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) bool {
+	switch alg {
+	case jwtRS256:
+		key, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		hash := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case jwtES256:
+		key, ok := key.(*ecdsa.PublicKey)
+		if !ok || key.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		hash := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, hash[:], r, s)
+	case jwtEdDSA:
+		key, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(key, signed, signature)
+	default:
+		return false
+	}
+}
+
+func (v *jwtVerifier) Challenge(err error) string {
+	challenge := "Bearer realm=" + quoteAuthParam(v.realm)
+	if err != nil {
+		challenge += `, error="invalid_token", error_description=` + quoteAuthParam(err.Error())
+	}
+	return challenge
+}
+
+// jwks are the keys to verify tokens. Keys from a file are reloaded if the
+// file changes. Keys from a URL are refreshed after jwksRefreshInterval and
+// if a token references an unknown key, at most every jwksMinRefreshInterval.
+type jwks struct {
+	file *reloadingFile[[]jwk]
+
+	url         string
+	client      *http.Client
+	mu          sync.Mutex
+	keys        []jwk
+	refreshedAt time.Time
+}
+
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = 30 * time.Second
+)
+
+type jwk struct {
+	Kid string
+	Alg string
+	Key crypto.PublicKey
+}
+
+func newJWKS(source string) (*jwks, error) {
+	k := &jwks{}
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		k.url = source
+		k.client = &http.Client{Timeout: 10 * time.Second}
+		keys, err := k.fetch(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		k.keys = keys
+		k.refreshedAt = time.Now()
+		return k, nil
+	}
+
+	k.file = &reloadingFile[[]jwk]{
+		files: []string{source},
+		load: func() ([]jwk, error) {
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return nil, err
+			}
+			return parseJWKS(data)
+		},
+	}
+	_, err := k.file.get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+	return k, nil
+}
+
+// find returns the keys which can verify a token with kid and alg.
+func (k *jwks) find(ctx context.Context, kid string, alg string) ([]crypto.PublicKey, error) {
+	switch alg {
+	case jwtRS256, jwtES256, jwtEdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported token algorithm '%s'", alg)
+	}
+
+	keys, err := k.current(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	found := matchJWKs(keys, kid, alg)
+	if len(found) == 0 && k.url != "" {
+		// the keys could have been rotated
+		keys, err = k.current(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		found = matchJWKs(keys, kid, alg)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("unknown key '%s'", kid)
+	}
+	return found, nil
+}
+
+func matchJWKs(keys []jwk, kid string, alg string) []crypto.PublicKey {
+	found := []crypto.PublicKey{}
+	for _, key := range keys {
+		if (kid != "" && key.Kid != kid) || (key.Alg != "" && key.Alg != alg) {
+			continue
+		}
+		found = append(found, key.Key)
+	}
+	return found
+}
+
+func (k *jwks) current(ctx context.Context, unknownKey bool) ([]jwk, error) {
+	if k.file != nil {
+		return k.file.get()
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	age := time.Since(k.refreshedAt)
+	if age > jwksRefreshInterval || (unknownKey && age > jwksMinRefreshInterval) {
+		// concurrent requests wait for the refresh and failed
+		// refreshes are not retried immediately
+		k.refreshedAt = time.Now()
+		keys, err := k.fetch(ctx)
+		if err != nil {
+			// keep using the previous keys
+			slog.ErrorContext(ctx, "failed to refresh JWKS", "url", k.url, "err", err)
+		} else {
+			k.keys = keys
+		}
+	}
+	return k.keys, nil
+}
+
+func (k *jwks) fetch(ctx context.Context) ([]jwk, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: unexpected status code %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	return parseJWKS(data)
+}
+
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the RSA, P-256 and Ed25519 keys of a JWKS. Other keys
+// are ignored.
+func parseJWKS(data []byte) ([]jwk, error) {
+	set := struct {
+		Keys []rawJWK `json:"keys"`
+	}{}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := []jwk{}
+	for _, raw := range set.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		key, err := raw.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK '%s': %w", raw.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+		keys = append(keys, jwk{
+			Kid: raw.Kid,
+			Alg: raw.Alg,
+			Key: key,
+		})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no supported keys")
+	}
+	return keys, nil
+}
+
+// publicKey returns the key or nil if the key type is not supported.
+func (j rawJWK) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case j.Kty == "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(j.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case j.Kty == "EC" && j.Crv == "P-256":
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) > 32 || len(y) > 32 {
+			return nil, errors.New("invalid EC point")
+		}
+		// check that the point is on the curve
+		point := make([]byte, 65)
+		point[0] = 4
+		copy(point[33-len(x):33], x)
+		copy(point[65-len(y):], y)
+		_, err = ecdh.P256().NewPublicKey(point)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case j.Kty == "OKP" && j.Crv == "Ed25519":
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newAuthTestHandler(verifiers []authVerifier, allow []string) http.Handler {
+	return authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := getPrincipal(r.Context())
+		fmt.Fprintf(w, "%s:%s", p.Scheme, p.Name)
+	}), verifiers, allow)
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaHash := sha1.Sum([]byte("secret2"))
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	writeTestFile(t, file, []byte(fmt.Sprintf("# users\nalice:%s\nbob:{SHA}%s\n", bcryptHash, base64.StdEncoding.EncodeToString(shaHash[:]))))
+
+	verifier, err := newHtpasswdVerifier(file, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newAuthTestHandler([]authVerifier{verifier}, []string{"alice", "bob"})
+
+	for _, test := range []struct {
+		name      string
+		user      string
+		password  string
+		expected  string
+		challenge string
+	}{
+		{
+			name:      "no_credentials",
+			expected:  "401",
+			challenge: `Basic realm="test", charset="UTF-8"`,
+		},
+		{
+			name:     "bcrypt",
+			user:     "alice",
+			password: "secret1",
+			expected: "200 basic:alice",
+		},
+		{
+			name:     "sha",
+			user:     "bob",
+			password: "secret2",
+			expected: "200 basic:bob",
+		},
+		{
+			name:      "wrong_password",
+			user:      "alice",
+			password:  "secret2",
+			expected:  "401",
+			challenge: `Basic realm="test", charset="UTF-8"`,
+		},
+		{
+			name:     "unknown_user",
+			user:     "carol",
+			password: "secret1",
+			expected: "401",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.password)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			result := fmt.Sprint(rec.Code)
+			if rec.Code == http.StatusOK {
+				result += " " + rec.Body.String()
+			}
+			if result != test.expected {
+				t.Errorf("expected: %s, got: %s", test.expected, result)
+			}
+			if test.challenge != "" && rec.Header().Get("WWW-Authenticate") != test.challenge {
+				t.Errorf("expected challenge: %s, got: %s", test.challenge, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	t.Run("forbidden", func(t *testing.T) {
+		handler := newAuthTestHandler([]authVerifier{verifier}, []string{"bob"})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("alice", "secret1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("expected code %d, got: %d", http.StatusForbidden, rec.Code)
+		}
+	})
+}
+
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signJWT returns a token with the claims signed by key.
+func signJWT(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64URL(header) + "." + base64URL(payload)
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, hash[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64URL(signature)
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksRequests := 0
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksRequests++
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": base64URL(rsaKey.N.Bytes()), "e": base64URL(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": base64URL(ecKey.X.FillBytes(make([]byte, 32))), "y": base64URL(ecKey.Y.FillBytes(make([]byte, 32)))},
+				{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": base64URL(edPublicKey)},
+				{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+			},
+		})
+	}))
+	defer jwksServer.Close()
+
+	verifier, err := newJWTVerifier(jwksServer.URL, "issuer", "audience", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newAuthTestHandler([]authVerifier{verifier}, nil)
+
+	now := time.Now().Unix()
+	validClaims := map[string]any{"sub": "user", "iss": "issuer", "aud": []string{"other", "audience"}, "exp": now + 60}
+	for _, test := range []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{
+			name:     "rs256",
+			token:    signJWT(t, jwtRS256, "rsa", rsaKey, validClaims),
+			expected: "200 jwt:user",
+		},
+		{
+			name:     "es256",
+			token:    signJWT(t, jwtES256, "ec", ecKey, validClaims),
+			expected: "200 jwt:user",
+		},
+		{
+			name:     "eddsa",
+			token:    signJWT(t, jwtEdDSA, "ed", edKey, validClaims),
+			expected: "200 jwt:user",
+		},
+		{
+			name:     "without_kid",
+			token:    signJWT(t, jwtES256, "", ecKey, validClaims),
+			expected: "200 jwt:user",
+		},
+		{
+			name:     "single_audience",
+			token:    signJWT(t, jwtES256, "ec", ecKey, map[string]any{"sub": "user", "iss": "issuer", "aud": "audience"}),
+			expected: "200 jwt:user",
+		},
+		{
+			name:     "wrong_key",
+			token:    signJWT(t, jwtES256, "ec", otherKey, validClaims),
+			expected: "401 invalid token signature",
+		},
+		{
+			name:     "unknown_kid",
+			token:    signJWT(t, jwtES256, "unknown", ecKey, validClaims),
+			expected: "401 unknown key 'unknown'",
+		},
+		{
+			name:     "alg_key_mismatch",
+			token:    signJWT(t, jwtES256, "rsa", ecKey, validClaims),
+			expected: "401 unknown key 'rsa'",
+		},
+		{
+			name:     "alg_none",
+			token:    base64URL([]byte(`{"alg":"none"}`)) + "." + base64URL([]byte(`{"sub":"user"}`)) + ".",
+			expected: "401 unsupported token algorithm 'none'",
+		},
+		{
+			name:     "expired",
+			token:    signJWT(t, jwtES256, "ec", ecKey, map[string]any{"sub": "user", "iss": "issuer", "aud": "audience", "exp": now - 120}),
+			expected: "401 token expired",
+		},
+		{
+			name:     "not_yet_valid",
+			token:    signJWT(t, jwtES256, "ec", ecKey, map[string]any{"sub": "user", "iss": "issuer", "aud": "audience", "nbf": now + 120}),
+			expected: "401 token not yet valid",
+		},
+		{
+			name:     "wrong_issuer",
+			token:    signJWT(t, jwtES256, "ec", ecKey, map[string]any{"sub": "user", "iss": "other", "aud": "audience"}),
+			expected: "401 invalid token issuer 'other'",
+		},
+		{
+			name:     "wrong_audience",
+			token:    signJWT(t, jwtES256, "ec", ecKey, map[string]any{"sub": "user", "iss": "issuer", "aud": "other"}),
+			expected: "401 invalid token audience",
+		},
+		{
+			name:     "malformed",
+			token:    "token",
+			expected: "401 malformed token",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			result := fmt.Sprint(rec.Code)
+			if rec.Code == http.StatusOK {
+				result += " " + rec.Body.String()
+			} else if _, description, ok := strings.Cut(rec.Header().Get("WWW-Authenticate"), "error_description="); ok {
+				result += " " + strings.Trim(description, `"`)
+			}
+			if result != test.expected {
+				t.Errorf("expected: %s, got: %s", test.expected, result)
+			}
+		})
+	}
+
+	// unknown keys trigger at most one refresh per jwksMinRefreshInterval
+	if jwksRequests != 1 {
+		t.Errorf("expected 1 JWKS request, got: %d", jwksRequests)
+	}
+	verifier.keys.refreshedAt = time.Now().Add(-jwksMinRefreshInterval)
+	for i := 0; i < 2; i++ {
+		verifier.verifyToken(context.Background(), signJWT(t, jwtES256, "unknown", ecKey, validClaims), time.Now())
+	}
+	if jwksRequests != 2 {
+		t.Errorf("expected JWKS to be refreshed once for unknown keys, got %d requests", jwksRequests)
+	}
+}
+
+func TestJWKSFile(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS := func(key ed25519.PrivateKey) {
+		data, _ := json.Marshal(map[string]any{
+			"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "x": base64URL(key.Public().(ed25519.PublicKey))}},
+		})
+		writeTestFile(t, file, data)
+	}
+	writeJWKS(edKey)
+
+	verifier, err := newJWTVerifier(file, "", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, jwtEdDSA, "", edKey, map[string]any{"sub": "user"})
+	_, err = verifier.verifyToken(context.Background(), token, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate the key
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(newKey)
+	_, err = verifier.verifyToken(context.Background(), token, time.Now())
+	if err == nil {
+		t.Fatal("expected token signed with the old key to be rejected")
+	}
+	_, err = verifier.verifyToken(context.Background(), signJWT(t, jwtEdDSA, "", newKey, map[string]any{"sub": "user"}), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
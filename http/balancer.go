@@ -0,0 +1,522 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// load balancing strategies
+const (
+	strategyRoundRobin = "round-robin"
+	strategyWeighted   = "weighted"
+	strategyLeastConn  = "least-conn"
+	strategyHash       = "hash"
+)
+
+// hashReplicas is the number of points per weight unit of an upstream on the
+// consistent hash ring.
+const hashReplicas = 100
+
+var errNoUpstream = errors.New("no healthy upstream available")
+
+// upstream is a single backend of an upstreamPool.
+type upstream struct {
+	URL    *url.URL
+	Weight int
+
+	// healthy is the result of the active health check
+	healthy atomic.Bool
+	// ejectedUntil is set by the passive outlier detection (unix nano)
+	ejectedUntil        atomic.Int64
+	consecutiveFailures atomic.Int64
+	activeRequests      atomic.Int64
+	totalRequests       atomic.Uint64
+	totalFailures       atomic.Uint64
+
+	breaker *circuitBreaker
+}
+
+func (u *upstream) available(now time.Time) bool {
+	if !u.healthy.Load() || now.UnixNano() < u.ejectedUntil.Load() {
+		return false
+	}
+	available, _ := u.breaker.available(now)
+	return available
+}
+
+// parseUpstream parses an upstream in the format URL[;weight=N].
+func parseUpstream(rawUpstream string) (*upstream, error) {
+	rawURL, params, _ := strings.Cut(rawUpstream, ";")
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid upstream url '%s': scheme and host required", rawURL)
+	}
+	u := &upstream{
+		URL:     target,
+		Weight:  1,
+		breaker: newCircuitBreaker(0, 0),
+	}
+	u.healthy.Store(true)
+	if params == "" {
+		return u, nil
+	}
+	key, value, _ := strings.Cut(params, "=")
+	if key != "weight" {
+		return nil, fmt.Errorf("unknown upstream parameter '%s' in '%s'", key, rawUpstream)
+	}
+	u.Weight, err = strconv.Atoi(value)
+	if err != nil || u.Weight < 1 {
+		return nil, fmt.Errorf("invalid weight '%s' in '%s': positive number required", value, rawUpstream)
+	}
+	return u, nil
+}
+
+type upstreamPoolOptions struct {
+	// Strategy is one of round-robin, weighted, least-conn or hash.
+	Strategy string
+	// HashHeader is the request header used for the hash strategy.
+	// Requests without the header are balanced round-robin.
+	HashHeader string
+	// Protocol is the protocol used for upstream requests (auto, http1,
+	// h2c).
+	Protocol string
+	// ResponseTimeout limits the time to wait for the response headers
+	// of an upstream. 0 means no limit.
+	ResponseTimeout time.Duration
+	TLS             upstreamTLSOptions
+
+	// HealthCheckPath enables active health checks if set.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// MaxFailures is the number of consecutive 5xx responses or
+	// connection errors after which an upstream is ejected for
+	// EjectionTime. 0 disables the passive outlier detection.
+	MaxFailures  int
+	EjectionTime time.Duration
+
+	// BreakerFailures is the number of consecutive failures which open
+	// the circuit breaker of an upstream for BreakerTimeout. 0 disables
+	// the circuit breaker.
+	BreakerFailures int
+	BreakerTimeout  time.Duration
+
+	Retry retryOptions
+}
+
+func defaultUpstreamPoolOptions() upstreamPoolOptions {
+	return upstreamPoolOptions{
+		Strategy:            strategyRoundRobin,
+		HashHeader:          "X-Session-Id",
+		Protocol:            protocolAuto,
+		HealthCheckInterval: 10 * time.Second,
+		HealthCheckTimeout:  2 * time.Second,
+		MaxFailures:         5,
+		EjectionTime:        30 * time.Second,
+		BreakerFailures:     5,
+		BreakerTimeout:      10 * time.Second,
+		Retry:               defaultRetryOptions(),
+	}
+}
+
+type hashRingPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// upstreamPool balances requests over multiple upstreams.
+type upstreamPool struct {
+	opts      upstreamPoolOptions
+	upstreams []*upstream
+	counter   atomic.Uint64
+	ring      []hashRingPoint
+	client    *http.Client
+	budget    *retryBudget
+	tlsConfig *tls.Config
+	// tlsRoots are the CAs of the upstreams if they are loaded from a
+	// file
+	tlsRoots *reloadingFile[*x509.CertPool]
+
+	mu sync.Mutex
+	// transports are the transports returned by newTransport
+	transports []http.RoundTripper
+}
+
+// newUpstreamPool returns a pool for the upstreams in the format
+// URL[;weight=N].
+func newUpstreamPool(rawUpstreams []string, opts upstreamPoolOptions) (*upstreamPool, error) {
+	if len(rawUpstreams) == 0 {
+		return nil, errors.New("at least one upstream required")
+	}
+	switch opts.Strategy {
+	case strategyRoundRobin, strategyWeighted, strategyLeastConn, strategyHash:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy '%s'", opts.Strategy)
+	}
+
+	p := &upstreamPool{
+		opts:   opts,
+		budget: newRetryBudget(opts.Retry.BudgetRatio),
+	}
+	tlsConfig, tlsRoots, err := newUpstreamTLSConfig(opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+	p.tlsConfig = tlsConfig
+	p.tlsRoots = tlsRoots
+	transport, err := p.newTransport(opts.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	p.client = &http.Client{
+		Transport: transport,
+		Timeout:   opts.HealthCheckTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, rawUpstream := range rawUpstreams {
+		u, err := parseUpstream(rawUpstream)
+		if err != nil {
+			return nil, err
+		}
+		u.breaker = newCircuitBreaker(opts.BreakerFailures, opts.BreakerTimeout)
+		p.upstreams = append(p.upstreams, u)
+		for i := 0; i < u.Weight*hashReplicas; i++ {
+			p.ring = append(p.ring, hashRingPoint{
+				hash:     crc32.ChecksumIEEE([]byte(u.URL.String() + "#" + strconv.Itoa(i))),
+				upstream: u,
+			})
+		}
+	}
+	slices.SortFunc(p.ring, func(a, b hashRingPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return p, nil
+}
+
+// next selects the upstream for the request. Upstreams in exclude are only
+// selected if no other upstream is available.
+func (p *upstreamPool) next(r *http.Request, exclude ...*upstream) (*upstream, error) {
+	now := time.Now()
+	available := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.available(now) && !slices.Contains(exclude, u) {
+			available = append(available, u)
+		}
+	}
+	if len(available) == 0 && len(exclude) > 0 {
+		return p.next(r)
+	}
+	if len(available) == 0 {
+		return nil, errNoUpstream
+	}
+
+	switch p.opts.Strategy {
+	case strategyWeighted:
+		totalWeight := 0
+		for _, u := range available {
+			totalWeight += u.Weight
+		}
+		n := int(p.counter.Add(1) % uint64(totalWeight))
+		for _, u := range available {
+			n -= u.Weight
+			if n < 0 {
+				return u, nil
+			}
+		}
+	case strategyLeastConn:
+		// start at a rotating offset so that upstreams with the same
+		// number of connections are used evenly
+		offset := int(p.counter.Add(1) % uint64(len(available)))
+		selected := available[offset]
+		for i := range available {
+			u := available[(offset+i)%len(available)]
+			if u.activeRequests.Load() < selected.activeRequests.Load() {
+				selected = u
+			}
+		}
+		return selected, nil
+	case strategyHash:
+		key := r.Header.Get(p.opts.HashHeader)
+		if key == "" {
+			break
+		}
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start, _ := slices.BinarySearchFunc(p.ring, hash, func(point hashRingPoint, hash uint32) int {
+			return cmp.Compare(point.hash, hash)
+		})
+		for i := range p.ring {
+			point := p.ring[(start+i)%len(p.ring)]
+			if slices.Contains(available, point.upstream) {
+				return point.upstream, nil
+			}
+		}
+	}
+	return available[int(p.counter.Add(1)%uint64(len(available)))], nil
+}
+
+// acquire selects an upstream for the request and counts the request. The
+// returned function has to be called when the request is done.
+func (p *upstreamPool) acquire(r *http.Request, exclude ...*upstream) (*upstream, func(), error) {
+	for range len(p.upstreams) {
+		u, err := p.next(r, exclude...)
+		if err != nil {
+			return nil, nil, err
+		}
+		ok, probe := u.breaker.acquire(time.Now())
+		if !ok {
+			// a concurrent request took the probe of the half-open
+			// breaker, which makes the upstream unavailable
+			continue
+		}
+		u.activeRequests.Add(1)
+		u.totalRequests.Add(1)
+		return u, func() {
+			u.activeRequests.Add(-1)
+			u.breaker.release(probe)
+		}, nil
+	}
+	return nil, nil, errNoUpstream
+}
+
+// retryAfter returns the duration until the first circuit breaker allows
+// requests again.
+func (p *upstreamPool) retryAfter() time.Duration {
+	now := time.Now()
+	retryAfter := time.Duration(0)
+	for _, u := range p.upstreams {
+		if ok, d := u.breaker.available(now); !ok && (retryAfter == 0 || d < retryAfter) {
+			retryAfter = d
+		}
+	}
+	return retryAfter
+}
+
+// reportResult is used for the passive outlier detection and the circuit
+// breaker.
+func (p *upstreamPool) reportResult(u *upstream, failed bool) {
+	before := u.breaker.currentState()
+	if after := u.breaker.record(failed); after != before {
+		slog.Warn("circuit breaker state changed", "upstream", u.URL.String(), "state", after)
+	}
+	if !failed {
+		u.consecutiveFailures.Store(0)
+		return
+	}
+	u.totalFailures.Add(1)
+	failures := u.consecutiveFailures.Add(1)
+	if p.opts.MaxFailures <= 0 || failures < int64(p.opts.MaxFailures) {
+		return
+	}
+	u.consecutiveFailures.Store(0)
+	u.ejectedUntil.Store(time.Now().Add(p.opts.EjectionTime).UnixNano())
+	slog.Warn("eject upstream", "upstream", u.URL.String(), "failures", failures, "duration", p.opts.EjectionTime)
+}
+
+// start runs the active health checks until ctx is done.
+func (p *upstreamPool) start(ctx context.Context) {
+	if p.opts.HealthCheckPath == "" {
+		return
+	}
+	for _, u := range p.upstreams {
+		go p.runHealthCheck(ctx, u)
+	}
+}
+
+func (p *upstreamPool) runHealthCheck(ctx context.Context, u *upstream) {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		err := p.checkHealth(ctx, u)
+		if ctx.Err() != nil {
+			return
+		}
+		healthy := err == nil
+		if u.healthy.Swap(healthy) != healthy {
+			if healthy {
+				slog.Info("upstream healthy", "upstream", u.URL.String())
+			} else {
+				slog.Warn("upstream unhealthy", "upstream", u.URL.String(), "err", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *upstreamPool) checkHealth(ctx context.Context, u *upstream) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL.JoinPath(p.opts.HealthCheckPath).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handler selects an upstream for each request and passes the request with
+// the upstream in its context to next.
+func (p *upstreamPool) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, release, err := p.acquire(r)
+		if err != nil {
+			if retryAfter := p.retryAfter(); retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+			}
+			errorHandler(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
+		defer release()
+		ctx := context.WithValue(r.Context(), upstreamKey, u)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newTransport returns a transport for the upstreams of the pool with the
+// protocol.
+func (p *upstreamPool) newTransport(protocol string) (http.RoundTripper, error) {
+	transport, err := newUpstreamTransport(protocol)
+	if err != nil {
+		return nil, err
+	}
+	transport.ResponseHeaderTimeout = p.opts.ResponseTimeout
+	if p.tlsConfig != nil {
+		transport.TLSClientConfig = p.tlsConfig.Clone()
+	}
+	var rt http.RoundTripper = transport
+	if p.tlsRoots != nil {
+		rt = newCAReloadingTransport(p.tlsRoots, func(roots *x509.CertPool) *http.Transport {
+			t := transport.Clone()
+			t.TLSClientConfig.RootCAs = roots
+			return t
+		})
+	}
+	p.mu.Lock()
+	p.transports = append(p.transports, rt)
+	p.mu.Unlock()
+	return rt, nil
+}
+
+// closeIdleConnections closes the idle connections of the transports of the
+// pool, e.g. if the pool is no longer used after a reload.
+func (p *upstreamPool) closeIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rt := range p.transports {
+		if t, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// transport wraps rt to retry failed requests and to report the results of
+// upstream requests to the passive outlier detection and the circuit
+// breaker.
+func (p *upstreamPool) transport(rt http.RoundTripper) http.RoundTripper {
+	rt = upstreamTimingTransport(rt)
+	reportingTransport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(r)
+		if u := getUpstream(r.Context()); u != nil {
+			if err != nil && r.Context().Err() != nil {
+				// client aborts are not failures of the upstream, the
+				// release of the request frees a probe of the breaker
+				return resp, err
+			}
+			p.reportResult(u, err != nil || resp.StatusCode >= 500)
+		}
+		return resp, err
+	})
+	return &retryTransport{
+		next:   reportingTransport,
+		pool:   p,
+		opts:   p.opts.Retry,
+		budget: p.budget,
+	}
+}
+
+type upstreamStatus struct {
+	URL            string     `json:"url"`
+	Weight         int        `json:"weight"`
+	Healthy        bool       `json:"healthy"`
+	Circuit        string     `json:"circuit"`
+	EjectedUntil   *time.Time `json:"ejected_until,omitempty"`
+	ActiveRequests int64      `json:"active_requests"`
+	TotalRequests  uint64     `json:"total_requests"`
+	TotalFailures  uint64     `json:"total_failures"`
+}
+
+type upstreamPoolStatus struct {
+	Strategy  string           `json:"strategy"`
+	Protocol  string           `json:"protocol"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+func (p *upstreamPool) status() upstreamPoolStatus {
+	status := upstreamPoolStatus{
+		Strategy: p.opts.Strategy,
+		Protocol: p.opts.Protocol,
+	}
+	now := time.Now()
+	for _, u := range p.upstreams {
+		s := upstreamStatus{
+			URL:            u.URL.String(),
+			Weight:         u.Weight,
+			Healthy:        u.healthy.Load(),
+			Circuit:        u.breaker.currentState(),
+			ActiveRequests: u.activeRequests.Load(),
+			TotalRequests:  u.totalRequests.Load(),
+			TotalFailures:  u.totalFailures.Load(),
+		}
+		if ejectedUntil := time.Unix(0, u.ejectedUntil.Load()); ejectedUntil.After(now) {
+			s.EjectedUntil = &ejectedUntil
+		}
+		status.Upstreams = append(status.Upstreams, s)
+	}
+	return status
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+type ctxKeyUpstream int
+
+const upstreamKey ctxKeyUpstream = 0
+
+func getUpstream(ctx context.Context) *upstream {
+	if ctx == nil {
+		return nil
+	}
+	u, _ := ctx.Value(upstreamKey).(*upstream)
+	return u
+}
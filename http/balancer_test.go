@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestUpstreams starts n upstream servers which respond with their index.
+func newTestUpstreams(t *testing.T, n int, handler func(i int, w http.ResponseWriter, r *http.Request)) []string {
+	urls := []string{}
+	for i := 0; i < n; i++ {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handler != nil {
+				handler(i, w, r)
+				return
+			}
+			fmt.Fprint(w, i)
+		}))
+		t.Cleanup(server.Close)
+		urls = append(urls, server.URL)
+	}
+	return urls
+}
+
+func doRequests(t *testing.T, handler http.Handler, n int, header http.Header) map[string]int {
+	results := map[string]int{}
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		body, _ := io.ReadAll(rec.Result().Body)
+		results[fmt.Sprintf("%d:%s", rec.Code, strings.TrimSpace(string(body)))]++
+	}
+	return results
+}
+
+func TestUpstreamPoolStrategies(t *testing.T) {
+	upstreams := newTestUpstreams(t, 3, nil)
+	for _, test := range []struct {
+		name      string
+		upstreams []string
+		strategy  string
+		header    http.Header
+		expected  map[string]int
+	}{
+		{
+			name:      "round_robin",
+			upstreams: upstreams,
+			strategy:  strategyRoundRobin,
+			expected:  map[string]int{"200:0": 4, "200:1": 4, "200:2": 4},
+		},
+		{
+			name:      "weighted",
+			upstreams: []string{upstreams[0] + ";weight=2", upstreams[1]},
+			strategy:  strategyWeighted,
+			expected:  map[string]int{"200:0": 8, "200:1": 4},
+		},
+		{
+			name:      "least_conn",
+			upstreams: upstreams,
+			strategy:  strategyLeastConn,
+			expected:  map[string]int{"200:0": 4, "200:1": 4, "200:2": 4},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaultUpstreamPoolOptions()
+			opts.Strategy = test.strategy
+			pool, err := newUpstreamPool(test.upstreams, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := doRequests(t, forwardHandler(pool, headerRules{}), 12, test.header)
+			if fmt.Sprint(results) != fmt.Sprint(test.expected) {
+				t.Fatalf("expected: %v, got: %v", test.expected, results)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolHash(t *testing.T) {
+	upstreams := newTestUpstreams(t, 3, nil)
+	opts := defaultUpstreamPoolOptions()
+	opts.Strategy = strategyHash
+	pool, err := newUpstreamPool(upstreams, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := forwardHandler(pool, headerRules{})
+	used := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		results := doRequests(t, handler, 5, http.Header{"X-Session-Id": {fmt.Sprint("session", i)}})
+		if len(results) != 1 {
+			t.Fatalf("expected all requests of a session on the same upstream, got: %v", results)
+		}
+		for key := range results {
+			used[key] = true
+		}
+	}
+	if len(used) != 3 {
+		t.Fatalf("expected sessions on all upstreams, got: %v", used)
+	}
+}
+
+func TestUpstreamPoolOutlierDetection(t *testing.T) {
+	upstreams := newTestUpstreams(t, 2, func(i int, w http.ResponseWriter, r *http.Request) {
+		if i == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, i)
+	})
+	// an upstream which is not listening
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	upstreams = append(upstreams, closed.URL)
+
+	opts := defaultUpstreamPoolOptions()
+	opts.MaxFailures = 2
+	opts.EjectionTime = time.Minute
+	pool, err := newUpstreamPool(upstreams, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := forwardHandler(pool, headerRules{})
+	doRequests(t, handler, 6, nil)
+
+	results := doRequests(t, handler, 4, nil)
+	if results["200:1"] != 4 {
+		t.Fatalf("expected failing upstreams to be ejected, got: %v", results)
+	}
+	status := pool.status()
+	if status.Upstreams[0].EjectedUntil == nil || status.Upstreams[2].EjectedUntil == nil || status.Upstreams[1].EjectedUntil != nil {
+		t.Fatalf("unexpected pool status: %+v", status)
+	}
+}
+
+func TestUpstreamPoolHealthCheck(t *testing.T) {
+	upstreams := newTestUpstreams(t, 2, func(i int, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && i == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, i)
+	})
+	opts := defaultUpstreamPoolOptions()
+	opts.HealthCheckPath = "/healthz"
+	opts.HealthCheckInterval = 10 * time.Millisecond
+	pool, err := newUpstreamPool(upstreams, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.start(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for pool.upstreams[0].healthy.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream did not get unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	results := doRequests(t, forwardHandler(pool, headerRules{}), 4, nil)
+	if results["200:1"] != 4 {
+		t.Fatalf("expected requests only on healthy upstream, got: %v", results)
+	}
+}
+
+func TestUpstreamPoolNoUpstream(t *testing.T) {
+	pool, err := newUpstreamPool([]string{"http://127.0.0.1:1"}, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.upstreams[0].healthy.Store(false)
+	results := doRequests(t, forwardHandler(pool, headerRules{}), 1, nil)
+	if results["503:"+errNoUpstream.Error()] != 1 {
+		t.Fatalf("expected 503, got: %v", results)
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shared HTTP cache following RFC 9111. Simplifications:
+//   - only GET requests are cached
+//   - only one variant per URL is stored (Vary)
+//   - responses with Set-Cookie are not stored
+
+type responseCacheOptions struct {
+	// Store is memory or disk.
+	Store string
+	// Dir is the directory of the disk store.
+	Dir string
+	// MaxSize is the maximum size of the store.
+	MaxSize int64
+
+	// Name is used in the Cache-Status header (RFC 9211).
+	Name string
+	// MaxObjectSize is the maximum body size of a stored response.
+	MaxObjectSize int64
+	// RevalidateTimeout is the timeout of background revalidations
+	// (stale-while-revalidate).
+	RevalidateTimeout time.Duration
+}
+
+func defaultResponseCacheOptions() responseCacheOptions {
+	return responseCacheOptions{
+		Store:             "memory",
+		MaxSize:           64 * 1024 * 1024,
+		Name:              "http-server",
+		MaxObjectSize:     1024 * 1024,
+		RevalidateTimeout: 30 * time.Second,
+	}
+}
+
+// newCacheStore returns the store configured in opts.
+func newCacheStore(opts responseCacheOptions) (cacheStore, error) {
+	switch opts.Store {
+	case "memory":
+		return newMemoryCacheStore(opts.MaxSize), nil
+	case "disk":
+		if opts.Dir == "" {
+			return nil, fmt.Errorf("cache directory required for disk store")
+		}
+		return newDiskCacheStore(opts.Dir, opts.MaxSize)
+	default:
+		return nil, fmt.Errorf("unknown cache store '%s': use memory or disk", opts.Store)
+	}
+}
+
+// heuristicallyCacheableStatusCodes can be cached without explicit freshness
+// information (RFC 9110 section 15.1).
+var heuristicallyCacheableStatusCodes = []int{200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// cacheableStatusCodes can be stored by responseCache.
+var cacheableStatusCodes = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// responseCache is a shared HTTP cache in front of next.
+type responseCache struct {
+	next  http.Handler
+	store cacheStore
+	opts  responseCacheOptions
+
+	// revalidating contains the keys of running background
+	// revalidations
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+func newResponseCache(next http.Handler, store cacheStore, opts responseCacheOptions) *responseCache {
+	return &responseCache{
+		next:         next,
+		store:        store,
+		opts:         opts,
+		revalidating: map[string]bool{},
+	}
+}
+
+func cacheKey(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+func (c *responseCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := cacheKey(r)
+	if r.Method != http.MethodGet {
+		if !slices.Contains([]string{http.MethodHead, http.MethodOptions, http.MethodTrace}, r.Method) {
+			// unsafe methods invalidate the stored response
+			// (RFC 9111 section 4.4)
+			c.store.Delete(key)
+		}
+		c.forward(w, r, key, "method", false)
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header)
+	if reqCC.has("no-store") {
+		c.forward(w, r, key, "request", false)
+		return
+	}
+
+	entry, ok := c.store.Get(key)
+	if ok && !entry.matchesVary(r) {
+		if reqCC.has("only-if-cached") {
+			c.gatewayTimeout(w, r)
+			return
+		}
+		c.forward(w, r, key, "vary-miss", true)
+		return
+	}
+	if !ok {
+		if reqCC.has("only-if-cached") {
+			c.gatewayTimeout(w, r)
+			return
+		}
+		c.forward(w, r, key, "uri-miss", true)
+		return
+	}
+
+	now := time.Now()
+	respCC := parseCacheControl(entry.Header)
+	age := entry.age(now)
+	lifetime := entry.freshnessLifetime(respCC)
+	if maxAge, ok := reqCC.seconds("max-age"); ok {
+		lifetime = min(lifetime, maxAge)
+	}
+	minFresh, _ := reqCC.seconds("min-fresh")
+	fresh := age+minFresh < lifetime
+	mustRevalidate := respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage")
+	noCache := reqCC.has("no-cache") || respCC.has("no-cache")
+
+	if fresh && !noCache {
+		c.serveCached(w, r, entry, age, lifetime, "hit", "hit")
+		return
+	}
+
+	if !noCache && !mustRevalidate {
+		staleness := age - lifetime
+		if maxStale, ok := reqCC.seconds("max-stale"); ok && (reqCC["max-stale"] == "" || staleness <= maxStale) {
+			c.serveCached(w, r, entry, age, lifetime, "hit", "stale")
+			return
+		}
+		if swr, ok := respCC.seconds("stale-while-revalidate"); ok && staleness <= swr {
+			c.serveCached(w, r, entry, age, lifetime, "hit", "stale")
+			c.revalidateInBackground(r, key, entry)
+			return
+		}
+	}
+
+	if reqCC.has("only-if-cached") {
+		c.gatewayTimeout(w, r)
+		return
+	}
+
+	reason := "stale"
+	if noCache {
+		reason = "request"
+	}
+	c.revalidate(w, r, key, entry, reason)
+}
+
+// forward forwards the request to next and stores the response if possible.
+func (c *responseCache) forward(w http.ResponseWriter, r *http.Request, key string, reason string, storeResponse bool) {
+	requestTime := time.Now()
+	cw := &cacheResponseWriter{
+		ResponseWriter: w,
+		maxSize:        c.opts.MaxObjectSize,
+	}
+	cw.onHeader = func(code int, header http.Header) bool {
+		status := fmt.Sprintf("%s; fwd=%s; fwd-status=%d", c.opts.Name, reason, code)
+		cw.store = storeResponse && isStorable(r, code, header, c.opts.MaxObjectSize)
+		if cw.store {
+			status += "; stored"
+		}
+		header.Add("Cache-Status", status)
+		return true
+	}
+	c.next.ServeHTTP(cw, r)
+	addAccessLogAttrs(r.Context(), slog.String("cache", cacheResult(reason)))
+
+	if !cw.store || r.Context().Err() != nil {
+		return
+	}
+	c.store.Set(key, cw.cachedResponse(r, requestTime))
+}
+
+// revalidate sends a conditional request to next. If the stored response is
+// still valid (304) it is served from the cache. Otherwise the new response is
+// forwarded like in forward.
+func (c *responseCache) revalidate(w http.ResponseWriter, r *http.Request, key string, entry *cachedResponse, reason string) {
+	if entry.Header.Get("ETag") == "" && entry.Header.Get("Last-Modified") == "" {
+		c.forward(w, r, key, reason, true)
+		return
+	}
+
+	requestTime := time.Now()
+	cw := &cacheResponseWriter{
+		ResponseWriter: w,
+		// the header of a 304 response is not sent to the client
+		header:  http.Header{},
+		maxSize: c.opts.MaxObjectSize,
+	}
+	cw.onHeader = func(code int, header http.Header) bool {
+		if code == http.StatusNotModified {
+			return false
+		}
+		status := fmt.Sprintf("%s; fwd=%s; fwd-status=%d", c.opts.Name, reason, code)
+		cw.store = code < 500 && isStorable(r, code, header, c.opts.MaxObjectSize)
+		if cw.store {
+			status += "; stored"
+		}
+		header.Add("Cache-Status", status)
+		return true
+	}
+	c.next.ServeHTTP(cw, c.conditionalRequest(r, entry))
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.code != http.StatusNotModified {
+		addAccessLogAttrs(r.Context(), slog.String("cache", cacheResult(reason)))
+		switch {
+		case r.Context().Err() != nil:
+		case cw.store:
+			c.store.Set(key, cw.cachedResponse(r, requestTime))
+		case cw.code < 500:
+			c.store.Delete(key)
+		}
+		return
+	}
+
+	updated := entry.update(cw.Header(), requestTime)
+	c.store.Set(key, updated)
+	now := time.Now()
+	age := updated.age(now)
+	lifetime := updated.freshnessLifetime(parseCacheControl(updated.Header))
+	c.serveCached(w, r, updated, age, lifetime, fmt.Sprintf("fwd=%s; fwd-status=304", reason), "revalidated")
+}
+
+// revalidateInBackground revalidates a stale response which was already
+// served (stale-while-revalidate).
+func (c *responseCache) revalidateInBackground(r *http.Request, key string, entry *cachedResponse) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(backgroundContext(r.Context()), c.opts.RevalidateTimeout)
+	r = c.conditionalRequest(r.WithContext(ctx), entry)
+	go func() {
+		defer func() {
+			cancel()
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+		defer func() {
+			// there is no server which recovers panics of the
+			// handlers, e.g. a ReverseProxy aborting a response
+			err := recover()
+			if err != nil && err != http.ErrAbortHandler {
+				slog.ErrorContext(ctx, "background revalidation panicked", "err", err, "stack", string(debug.Stack()))
+			}
+		}()
+		requestTime := time.Now()
+		resp := newBufferedResponseWriter(c.opts.MaxObjectSize)
+		c.next.ServeHTTP(resp, r)
+		switch {
+		case resp.code == http.StatusNotModified:
+			c.store.Set(key, entry.update(resp.header, requestTime))
+		case resp.code < 500 && !resp.tooLarge && isStorable(r, resp.code, resp.header, c.opts.MaxObjectSize):
+			c.store.Set(key, &cachedResponse{
+				StatusCode:   resp.code,
+				Header:       resp.header,
+				Body:         resp.body.Bytes(),
+				RequestTime:  requestTime,
+				ResponseTime: time.Now(),
+				VaryHeader:   varyHeader(r, resp.header),
+			})
+		default:
+			slog.DebugContext(ctx, "background revalidation failed", "code", resp.code)
+		}
+	}()
+}
+
+// backgroundContext returns a context for work which outlives the request.
+// It keeps only the values which identify the request for logging and
+// forwarding. Values of the server (http.ServerContextKey) would make next
+// treat the request like a server request, e.g. ReverseProxy panics with
+// http.ErrAbortHandler if copying the response fails.
+func backgroundContext(ctx context.Context) context.Context {
+	background := context.Background()
+	for _, key := range []any{requestIDKey, clientInfoKey, principalKey} {
+		if value := ctx.Value(key); value != nil {
+			background = context.WithValue(background, key, value)
+		}
+	}
+	return background
+}
+
+// conditionalRequest returns a copy of r which asks next whether the stored
+// response is still valid.
+func (c *responseCache) conditionalRequest(r *http.Request, entry *cachedResponse) *http.Request {
+	conditional := r.Clone(r.Context())
+	conditional.Header.Del("If-None-Match")
+	conditional.Header.Del("If-Modified-Since")
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
+
+func (c *responseCache) serveCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse, age time.Duration, lifetime time.Duration, status string, result string) {
+	header := w.Header()
+	for key, values := range entry.Header {
+		header[key] = slices.Clone(values)
+	}
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	header.Add("Cache-Status", fmt.Sprintf("%s; %s; ttl=%d", c.opts.Name, status, int((lifetime-age).Seconds())))
+	addAccessLogAttrs(r.Context(), slog.String("cache", result))
+
+	if entry.StatusCode == http.StatusOK && notModified(r, entry.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.StatusCode)
+	w.Write(entry.Body)
+}
+
+func (c *responseCache) gatewayTimeout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Status", c.opts.Name+"; fwd=miss")
+	addAccessLogAttrs(r.Context(), slog.String("cache", "miss"))
+	errorHandler(w, r, http.StatusGatewayTimeout, "response not in cache (only-if-cached)")
+}
+
+func cacheResult(reason string) string {
+	switch reason {
+	case "uri-miss", "vary-miss":
+		return "miss"
+	case "method", "request":
+		return "bypass"
+	case "stale":
+		return "expired"
+	default:
+		return reason
+	}
+}
+
+// isStorable reports whether a response can be stored (RFC 9111 section 3).
+func isStorable(r *http.Request, code int, header http.Header, maxSize int64) bool {
+	if !slices.Contains(cacheableStatusCodes, code) {
+		return false
+	}
+	reqCC := parseCacheControl(r.Header)
+	respCC := parseCacheControl(header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if header.Get("Vary") == "*" || header.Get("Set-Cookie") != "" {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	if contentLength, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && contentLength > maxSize {
+		return false
+	}
+	// explicit freshness information, validators or heuristic freshness
+	return respCC.has("max-age") || respCC.has("s-maxage") || respCC.has("public") ||
+		header.Get("Expires") != "" || header.Get("ETag") != "" ||
+		(header.Get("Last-Modified") != "" && slices.Contains(heuristicallyCacheableStatusCodes, code))
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since of the request
+// against the stored response.
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+func varyHeader(r *http.Request, header http.Header) http.Header {
+	vary := http.Header{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				vary[name] = r.Header.Values(name)
+			}
+		}
+	}
+	return vary
+}
+
+func (c *cachedResponse) matchesVary(r *http.Request) bool {
+	for name, values := range c.VaryHeader {
+		if strings.Join(values, ",") != strings.Join(r.Header.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// age returns the current age of the response (RFC 9111 section 4.2.3).
+func (c *cachedResponse) age(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(c.Header.Get("Date")); err == nil {
+		apparentAge = max(0, c.ResponseTime.Sub(date))
+	}
+	ageValue := time.Duration(0)
+	if age, err := strconv.Atoi(c.Header.Get("Age")); err == nil {
+		ageValue = time.Duration(age) * time.Second
+	}
+	responseDelay := c.ResponseTime.Sub(c.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(c.ResponseTime)
+}
+
+// freshnessLifetime returns the freshness lifetime of the response (RFC 9111
+// section 4.2.1).
+func (c *cachedResponse) freshnessLifetime(cc cacheControl) time.Duration {
+	if sMaxAge, ok := cc.seconds("s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	date, err := http.ParseTime(c.Header.Get("Date"))
+	if err != nil {
+		date = c.ResponseTime
+	}
+	if expiresHeader := c.Header.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			// invalid dates represent a time in the past
+			return 0
+		}
+		return max(0, expires.Sub(date))
+	}
+	// heuristic freshness: 10% of the time since the last modification
+	if lastModified, err := http.ParseTime(c.Header.Get("Last-Modified")); err == nil && slices.Contains(heuristicallyCacheableStatusCodes, c.StatusCode) {
+		return min(max(0, date.Sub(lastModified)/10), 24*time.Hour)
+	}
+	return 0
+}
+
+// update returns a copy of the response with the header fields of a 304
+// response (RFC 9111 section 4.3.4).
+func (c *cachedResponse) update(header http.Header, requestTime time.Time) *cachedResponse {
+	updated := *c
+	updated.Header = c.Header.Clone()
+	for key, values := range header {
+		if key == "Content-Length" || key == "Cache-Status" {
+			continue
+		}
+		updated.Header[key] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = time.Now()
+	return &updated
+}
+
+// cacheControl contains the directives of Cache-Control headers.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	if _, ok := cc["no-cache"]; !ok && header.Get("Pragma") == "no-cache" && len(header.Values("Cache-Control")) == 0 {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	if value == "" {
+		// e.g. max-stale without value
+		return 0, true
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheResponseWriter forwards the response and keeps a copy of the body if
+// it should be stored.
+type cacheResponseWriter struct {
+	http.ResponseWriter
+	// onHeader is called before the final response is written. If it
+	// returns false the response is discarded.
+	onHeader func(code int, header http.Header) bool
+	// header is used instead of the header of ResponseWriter until the
+	// final response is written if it is set
+	header      http.Header
+	wroteHeader bool
+	discard     bool
+	code        int
+	store       bool
+	maxSize     int64
+	buf         bytes.Buffer
+}
+
+func (c *cacheResponseWriter) Header() http.Header {
+	if c.header != nil {
+		return c.header
+	}
+	return c.ResponseWriter.Header()
+}
+
+func (c *cacheResponseWriter) WriteHeader(code int) {
+	if c.wroteHeader {
+		if !c.discard {
+			c.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	// informational responses are no final response
+	if code >= 100 && code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.wroteHeader = true
+	c.code = code
+	if !c.onHeader(code, c.Header()) {
+		c.discard = true
+		return
+	}
+	if c.header != nil {
+		for key, values := range c.header {
+			c.ResponseWriter.Header()[key] = values
+		}
+		c.header = nil
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheResponseWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.discard {
+		return len(p), nil
+	}
+	if c.store {
+		if int64(c.buf.Len()+len(p)) > c.maxSize {
+			c.store = false
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *cacheResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// cachedResponse returns the forwarded response to store it.
+func (c *cacheResponseWriter) cachedResponse(r *http.Request, requestTime time.Time) *cachedResponse {
+	header := c.Header().Clone()
+	header.Del("Cache-Status")
+	return &cachedResponse{
+		StatusCode:   c.code,
+		Header:       header,
+		Body:         c.buf.Bytes(),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+		VaryHeader:   varyHeader(r, header),
+	}
+}
+
+// bufferedResponseWriter keeps the complete response in memory. Bodies
+// larger than maxSize are dropped.
+type bufferedResponseWriter struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	maxSize     int64
+	tooLarge    bool
+	body        bytes.Buffer
+}
+
+func newBufferedResponseWriter(maxSize int64) *bufferedResponseWriter {
+	return &bufferedResponseWriter{
+		header:  http.Header{},
+		code:    http.StatusOK,
+		maxSize: maxSize,
+	}
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.wroteHeader || (code >= 100 && code < 200) {
+		return
+	}
+	b.wroteHeader = true
+	b.code = code
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	if b.tooLarge || int64(b.body.Len()+len(p)) > b.maxSize {
+		b.tooLarge = true
+		b.body = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.body.Write(p)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedResponse is a response stored by responseCache.
+type cachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// RequestTime and ResponseTime are used to calculate the age of the
+	// response (RFC 9111 section 4.2.3).
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// VaryHeader contains the values of the request headers nominated
+	// by the Vary response header.
+	VaryHeader http.Header
+}
+
+func (c *cachedResponse) size() int64 {
+	size := int64(len(c.Body))
+	for key, values := range c.Header {
+		size += int64(len(key))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// cacheStore stores responses with a size limit.
+type cacheStore interface {
+	Get(key string) (*cachedResponse, bool)
+	Set(key string, resp *cachedResponse)
+	Delete(key string)
+}
+
+// lru keeps track of the size and the order of usage of cache entries. If
+// the total size exceeds maxSize the least recently used entries are
+// evicted. lru is not safe for concurrent use.
+type lru struct {
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	onEvict func(key string)
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	value any
+}
+
+func newLRU(maxSize int64, onEvict func(key string)) *lru {
+	return &lru{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+		onEvict: onEvict,
+	}
+}
+
+func (l *lru) get(key string) (any, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+func (l *lru) add(key string, size int64, value any) {
+	l.remove(key)
+	l.items[key] = l.ll.PushFront(&lruItem{
+		key:   key,
+		size:  size,
+		value: value,
+	})
+	l.size += size
+	for l.size > l.maxSize && l.ll.Len() > 0 {
+		oldest := l.ll.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		if l.onEvict != nil {
+			l.onEvict(oldest.key)
+		}
+	}
+}
+
+func (l *lru) remove(key string) {
+	e, ok := l.items[key]
+	if !ok {
+		return
+	}
+	l.ll.Remove(e)
+	delete(l.items, key)
+	l.size -= e.Value.(*lruItem).size
+}
+
+var _ cacheStore = (*memoryCacheStore)(nil)
+
+// memoryCacheStore stores responses in memory.
+type memoryCacheStore struct {
+	mu  sync.Mutex
+	lru *lru
+}
+
+func newMemoryCacheStore(maxSize int64) *memoryCacheStore {
+	return &memoryCacheStore{
+		lru: newLRU(maxSize, nil),
+	}
+}
+
+func (m *memoryCacheStore) Get(key string) (*cachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*cachedResponse), true
+}
+
+func (m *memoryCacheStore) Set(key string, resp *cachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.add(key, resp.size(), resp)
+}
+
+func (m *memoryCacheStore) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.remove(key)
+}
+
+var _ cacheStore = (*diskCacheStore)(nil)
+
+const cacheFileSuffix = ".cache"
+
+// diskCacheStore stores responses in a directory. Each response is stored
+// in a gob encoded file named after the hash of its key. Existing files are
+// used after a restart.
+type diskCacheStore struct {
+	dir string
+	mu  sync.Mutex
+	lru *lru
+}
+
+func newDiskCacheStore(dir string, maxSize int64) (*diskCacheStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	d := &diskCacheStore{
+		dir: dir,
+	}
+	d.lru = newLRU(maxSize, func(key string) {
+		d.removeFile(key)
+	})
+
+	// load existing files, the oldest first
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []fs.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), cacheFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	slices.SortFunc(files, func(a, b fs.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, file := range files {
+		d.lru.add(strings.TrimSuffix(file.Name(), cacheFileSuffix), file.Size(), nil)
+	}
+	return d, nil
+}
+
+func (d *diskCacheStore) fileName(hashedKey string) string {
+	return filepath.Join(d.dir, hashedKey+cacheFileSuffix)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *diskCacheStore) Get(key string) (*cachedResponse, bool) {
+	hashedKey := hashKey(key)
+	d.mu.Lock()
+	_, ok := d.lru.get(hashedKey)
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(d.fileName(hashedKey))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("failed to read cache file", "err", err)
+		}
+		d.Delete(key)
+		return nil, false
+	}
+	resp := &cachedResponse{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(resp)
+	if err != nil {
+		slog.Error("failed to decode cache file", "err", err)
+		d.Delete(key)
+		return nil, false
+	}
+	return resp, true
+}
+
+func (d *diskCacheStore) Set(key string, resp *cachedResponse) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(resp)
+	if err != nil {
+		slog.Error("failed to encode cache file", "err", err)
+		return
+	}
+
+	hashedKey := hashKey(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// write to a temporary file first that readers never see partial
+	// files
+	tmpFile, err := os.CreateTemp(d.dir, "tmp-")
+	if err != nil {
+		slog.Error("failed to write cache file", "err", err)
+		return
+	}
+	_, err = tmpFile.Write(buf.Bytes())
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), d.fileName(hashedKey))
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		slog.Error("failed to write cache file", "err", err)
+		return
+	}
+	d.lru.add(hashedKey, int64(buf.Len()), nil)
+}
+
+func (d *diskCacheStore) Delete(key string) {
+	hashedKey := hashKey(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lru.remove(hashedKey)
+	d.removeFile(hashedKey)
+}
+
+func (d *diskCacheStore) removeFile(hashedKey string) {
+	err := os.Remove(d.fileName(hashedKey))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("failed to remove cache file", "err", err)
+	}
+}
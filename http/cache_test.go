@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type cacheTestResponse struct {
+	header http.Header
+	code   int
+}
+
+func TestResponseCache(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		response cacheTestResponse
+		// requests are sent in order, each with the given header
+		requests         []http.Header
+		wait             time.Duration
+		expectedStatuses []string
+		expectedUpstream int64
+	}{
+		{
+			name: "max_age",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			requests:         []http.Header{{}, {}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200; stored", "test; hit; ttl=59"},
+			expectedUpstream: 1,
+		},
+		{
+			name: "no_store",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"no-store"}},
+			},
+			requests:         []http.Header{{}, {}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200", "test; fwd=uri-miss; fwd-status=200"},
+			expectedUpstream: 2,
+		},
+		{
+			name: "private",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"private, max-age=60"}},
+			},
+			requests:         []http.Header{{}, {}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200", "test; fwd=uri-miss; fwd-status=200"},
+			expectedUpstream: 2,
+		},
+		{
+			name: "request_no_cache",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"max-age=60"}},
+			},
+			requests:         []http.Header{{}, {"Cache-Control": {"no-cache"}}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200; stored", "test; fwd=request; fwd-status=200; stored"},
+			expectedUpstream: 2,
+		},
+		{
+			name: "vary",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}},
+			},
+			requests:         []http.Header{{"Accept-Language": {"de"}}, {"Accept-Language": {"de"}}, {"Accept-Language": {"en"}}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200; stored", "test; hit; ttl=59", "test; fwd=vary-miss; fwd-status=200; stored"},
+			expectedUpstream: 2,
+		},
+		{
+			name: "revalidate_etag",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}},
+			},
+			requests:         []http.Header{{}, {}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200; stored", "test; fwd=stale; fwd-status=304; ttl=0"},
+			expectedUpstream: 2,
+		},
+		{
+			name: "stale_while_revalidate",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"max-age=0, stale-while-revalidate=60"}, "Etag": {`"v1"`}},
+			},
+			requests:         []http.Header{{}, {}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200; stored", "test; hit; ttl=0"},
+			expectedUpstream: 2,
+		},
+		{
+			name: "client_conditional",
+			response: cacheTestResponse{
+				header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}},
+			},
+			requests:         []http.Header{{}, {"If-None-Match": {`"v1"`}}},
+			expectedStatuses: []string{"test; fwd=uri-miss; fwd-status=200; stored", "test; hit; ttl=59"},
+			expectedUpstream: 1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamRequests := atomic.Int64{}
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamRequests.Add(1)
+				for key, values := range test.response.header {
+					w.Header()[key] = values
+				}
+				w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+				if etag := w.Header().Get("Etag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fmt.Fprint(w, "body")
+			})
+			opts := defaultResponseCacheOptions()
+			opts.Name = "test"
+			cache := newResponseCache(next, newMemoryCacheStore(opts.MaxSize), opts)
+
+			statuses := []string{}
+			for _, header := range test.requests {
+				req := httptest.NewRequest("GET", "/resource", nil)
+				req.Header = header
+				rec := httptest.NewRecorder()
+				cache.ServeHTTP(rec, req)
+				statuses = append(statuses, rec.Header().Get("Cache-Status"))
+			}
+			// wait for background revalidations
+			time.Sleep(20 * time.Millisecond)
+
+			if strings.Join(statuses, "\n") != strings.Join(test.expectedStatuses, "\n") {
+				t.Errorf("expected statuses:\n%s\ngot:\n%s", strings.Join(test.expectedStatuses, "\n"), strings.Join(statuses, "\n"))
+			}
+			if upstreamRequests.Load() != test.expectedUpstream {
+				t.Errorf("expected %d upstream requests, got: %d", test.expectedUpstream, upstreamRequests.Load())
+			}
+		})
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{
+			name:     "s_maxage",
+			header:   http.Header{"Cache-Control": {"max-age=10, s-maxage=20"}},
+			expected: 20 * time.Second,
+		},
+		{
+			name: "expires",
+			header: http.Header{
+				"Date":    {date.Format(http.TimeFormat)},
+				"Expires": {date.Add(time.Hour).Format(http.TimeFormat)},
+			},
+			expected: time.Hour,
+		},
+		{
+			name: "invalid_expires",
+			header: http.Header{
+				"Expires": {"0"},
+			},
+			expected: 0,
+		},
+		{
+			name: "heuristic",
+			header: http.Header{
+				"Date":          {date.Format(http.TimeFormat)},
+				"Last-Modified": {date.Add(-10 * time.Hour).Format(http.TimeFormat)},
+			},
+			expected: time.Hour,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &cachedResponse{
+				StatusCode:   http.StatusOK,
+				Header:       test.header,
+				ResponseTime: date,
+			}
+			lifetime := resp.freshnessLifetime(parseCacheControl(test.header))
+			if lifetime != test.expected {
+				t.Errorf("expected: %s, got: %s", test.expected, lifetime)
+			}
+		})
+	}
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskCacheStore(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("one", &cachedResponse{StatusCode: 200, Body: []byte(strings.Repeat("1", 400))})
+	store.Set("two", &cachedResponse{StatusCode: 200, Body: []byte(strings.Repeat("2", 400))})
+	store.Set("three", &cachedResponse{StatusCode: 200, Body: []byte(strings.Repeat("3", 400))})
+
+	if _, ok := store.Get("one"); ok {
+		t.Fatal("expected oldest entry to be evicted")
+	}
+
+	// reopen the store
+	store, err = newDiskCacheStore(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := store.Get("three")
+	if !ok || string(resp.Body) != strings.Repeat("3", 400) {
+		t.Fatalf("expected entry after reopen, got: %v %v", ok, resp)
+	}
+}
+
+func TestResponseCacheRevalidateLargeResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	version := "v1"
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Etag", version)
+		if r.Header.Get("If-None-Match") == version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		for i := range 4 {
+			fmt.Fprintf(w, "%s-%d;", version, i)
+			http.NewResponseController(w).Flush()
+			if version != "v1" && rec.Body.Len() == 0 {
+				t.Error("expected the response to be streamed to the client")
+			}
+		}
+	})
+	opts := defaultResponseCacheOptions()
+	opts.Name = "test"
+	opts.MaxObjectSize = 20
+	store := newMemoryCacheStore(opts.MaxSize)
+	cache := newResponseCache(next, store, opts)
+
+	cache.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/resource", nil))
+	if _, ok := store.Get(cacheKey(httptest.NewRequest("GET", "/resource", nil))); !ok {
+		t.Fatal("expected stored response")
+	}
+
+	version = "v2-large"
+	cache.ServeHTTP(rec, httptest.NewRequest("GET", "/resource", nil))
+	if body := rec.Body.String(); body != "v2-large-0;v2-large-1;v2-large-2;v2-large-3;" {
+		t.Errorf("unexpected body '%s'", body)
+	}
+	if status := rec.Header().Get("Cache-Status"); status != "test; fwd=stale; fwd-status=200; stored" {
+		t.Errorf("unexpected Cache-Status '%s'", status)
+	}
+	if _, ok := store.Get(cacheKey(httptest.NewRequest("GET", "/resource", nil))); ok {
+		t.Error("expected response larger than the maximum object size to be removed")
+	}
+}
+
+func TestResponseCacheBackgroundRevalidationAbort(t *testing.T) {
+	requests := atomic.Int64{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Header().Set("Etag", fmt.Sprintf(`"v%d"`, requests.Add(1)))
+		if requests.Load() == 1 {
+			fmt.Fprint(w, "body")
+			return
+		}
+		// abort in the middle of the body
+		w.Header().Set("Content-Length", "100")
+		fmt.Fprint(w, "partial")
+		http.NewResponseController(w).Flush()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer upstream.Close()
+	pool, err := newUpstreamPool([]string{upstream.URL}, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultResponseCacheOptions()
+	cache := newResponseCache(forwardHandler(pool, headerRules{}), newMemoryCacheStore(opts.MaxSize), opts)
+	server := httptest.NewServer(cache)
+	defer server.Close()
+
+	for range 2 {
+		resp, err := http.Get(server.URL + "/resource")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+	revalidating := func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return len(cache.revalidating) > 0
+	}
+	for i := 0; i < 100 && (requests.Load() < 2 || revalidating()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if requests.Load() != 2 || revalidating() {
+		t.Fatal("expected finished background revalidation")
+	}
+}
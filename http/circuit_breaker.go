@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker opens after MaxFailures consecutive failures. While it is
+// open no requests are sent to the upstream. After OpenTimeout it lets a
+// single probe request through (half-open) which either closes it again or
+// opens it for another OpenTimeout.
+type circuitBreaker struct {
+	maxFailures int
+	openTimeout time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	// probe identifies the current probe request
+	probe uint64
+}
+
+func newCircuitBreaker(maxFailures int, openTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		maxFailures: maxFailures,
+		openTimeout: openTimeout,
+		state:       circuitClosed,
+	}
+}
+
+// available reports whether a request could be sent. If not it returns the
+// duration until the breaker allows requests again.
+func (b *circuitBreaker) available(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if retryAfter := b.openedAt.Add(b.openTimeout).Sub(now); retryAfter > 0 {
+			return false, retryAfter
+		}
+		return true, 0
+	case circuitHalfOpen:
+		// wait for the result of the probe
+		return !b.probing, b.openTimeout
+	default:
+		return true, 0
+	}
+}
+
+// acquire reports whether a request may be sent and has to be called before
+// it is sent. It switches an open breaker to half-open after the timeout and
+// lets only a single probe request through. For the probe request it returns
+// an id which is passed to release.
+func (b *circuitBreaker) acquire(now time.Time) (bool, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if now.Before(b.openedAt.Add(b.openTimeout)) {
+			return false, 0
+		}
+		b.state = circuitHalfOpen
+	case circuitHalfOpen:
+		if b.probing {
+			return false, 0
+		}
+	default:
+		return true, 0
+	}
+	b.probing = true
+	b.probe++
+	return true, b.probe
+}
+
+// record records the result of a request and returns the new state.
+func (b *circuitBreaker) record(failed bool) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxFailures <= 0 {
+		return b.state
+	}
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.state = circuitClosed
+		return b.state
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.maxFailures {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		b.failures = 0
+	}
+	return b.state
+}
+
+// release has to be called when a request is done. If the request was the
+// probe and no result was recorded (e.g. the client canceled the request or
+// its body could not be read) the next request may probe the upstream.
+func (b *circuitBreaker) release(probe uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe != 0 && b.probing && b.probe == probe {
+		b.probing = false
+	}
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
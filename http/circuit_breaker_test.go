@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute)
+	b.record(true)
+	now := time.Now()
+	if ok, _ := b.acquire(now); ok {
+		t.Fatal("expected open circuit breaker to reject requests")
+	}
+
+	now = now.Add(time.Minute)
+	probes := atomic.Int64{}
+	wg := sync.WaitGroup{}
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := b.acquire(now); ok {
+				probes.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if probes.Load() != 1 {
+		t.Fatalf("expected one probe, got %d", probes.Load())
+	}
+	if state := b.currentState(); state != circuitHalfOpen {
+		t.Errorf("expected state %s, got %s", circuitHalfOpen, state)
+	}
+
+	// the result of the probe closes the breaker again
+	b.record(false)
+	if ok, _ := b.acquire(now); !ok {
+		t.Error("expected closed circuit breaker to allow requests")
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute)
+	b.record(true)
+	now := time.Now().Add(time.Minute)
+	_, first := b.acquire(now)
+	b.release(first)
+
+	// a released probe lets the next request probe, a late release of the
+	// first probe does not free the second one
+	ok, second := b.acquire(now)
+	if !ok {
+		t.Fatal("expected released probe to allow the next probe")
+	}
+	b.release(first)
+	if ok, _ := b.acquire(now); ok {
+		t.Fatal("expected only one probe")
+	}
+	b.release(second)
+	if ok, _ := b.acquire(now); !ok {
+		t.Fatal("expected released probe to allow the next probe")
+	}
+}
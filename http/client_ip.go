@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientInfo holds the real client IP of a request.
+type clientInfo struct {
+	IP netip.Addr
+
+	// ForwardedFor is the part of the inbound forwarding chain which can
+	// be trusted. It starts with the client IP and is followed by the
+	// trusted proxies, without the address of the direct peer.
+	ForwardedFor []string
+}
+
+// headers with the forwarding chain of trusted proxies
+const (
+	clientIPHeaderXForwardedFor = "x-forwarded-for"
+	clientIPHeaderForwarded     = "forwarded"
+)
+
+// clientIPMiddleware determines the real client IP and stores it in the
+// request context. If the direct peer is a trusted proxy the header
+// (X-Forwarded-For or Forwarded) is read right-to-left and the first address
+// which is not a trusted proxy is the client IP. The other header is ignored,
+// trusted proxies usually only append to one of them and a client could set
+// the other one.
+func clientIPMiddleware(next http.Handler, trustedProxies []netip.Prefix, header string) (http.Handler, error) {
+	switch header {
+	case clientIPHeaderXForwardedFor, clientIPHeaderForwarded:
+	default:
+		return nil, fmt.Errorf("unknown client IP header '%s'", header)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := realClientIP(r, trustedProxies, header)
+		ctx := context.WithValue(r.Context(), clientInfoKey, info)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}), nil
+}
+
+func realClientIP(r *http.Request, trustedProxies []netip.Prefix, header string) clientInfo {
+	info := clientInfo{
+		IP: parseAddr(r.RemoteAddr),
+	}
+	if !info.IP.IsValid() || !isTrusted(info.IP, trustedProxies) {
+		return info
+	}
+
+	var chain []string
+	if header == clientIPHeaderForwarded {
+		chain = parseForwardedFor(r.Header.Values("Forwarded"))
+	} else {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseAddr(chain[i])
+		if !ip.IsValid() {
+			// we can't trust anything left of an invalid entry
+			break
+		}
+		info.IP = ip
+		info.ForwardedFor = append([]string{ip.String()}, info.ForwardedFor...)
+		if !isTrusted(ip, trustedProxies) {
+			break
+		}
+	}
+	return info
+}
+
+// parseForwardedFor returns the for parameters of Forwarded headers (RFC 7239).
+func parseForwardedFor(values []string) []string {
+	chain := []string{}
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			forValue := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					forValue = strings.Trim(value, `"`)
+				}
+			}
+			// keep elements without a valid for parameter in the
+			// chain (e.g. unknown) to stop the evaluation there
+			chain = append(chain, forValue)
+		}
+	}
+	return chain
+}
+
+// parseAddr parses an IP address with or without port. IPv6 addresses can be
+// enclosed in brackets. It returns the zero netip.Addr on error.
+func parseAddr(addr string) netip.Addr {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap()
+}
+
+func isTrusted(ip netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a comma separated list of CIDR prefixes. Plain
+// addresses are treated as single host prefixes.
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "/") {
+			ip, err := netip.ParseAddr(raw)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type ctxKeyClientInfo int
+
+const clientInfoKey ctxKeyClientInfo = 0
+
+// getClientInfo returns the client info from the context. It returns false
+// if clientIPMiddleware was not used.
+func getClientInfo(ctx context.Context) (clientInfo, bool) {
+	if ctx == nil {
+		return clientInfo{}, false
+	}
+	info, ok := ctx.Value(clientInfoKey).(clientInfo)
+	return info, ok
+}
+
+// getClientIP returns the real client IP of the request. It falls back to
+// the remote address if clientIPMiddleware was not used.
+func getClientIP(r *http.Request) string {
+	if info, ok := getClientInfo(r.Context()); ok && info.IP.IsValid() {
+		return info.IP.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestRealClientIP(t *testing.T) {
+	trustedProxies, err := parsePrefixes("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name                 string
+		remoteAddr           string
+		clientIPHeader       string
+		header               map[string]string
+		expectedIP           string
+		expectedForwardedFor []string
+	}{
+		{
+			name:       "untrusted_peer",
+			remoteAddr: "203.0.113.1:1234",
+			header: map[string]string{
+				"X-Forwarded-For": "1.2.3.4",
+			},
+			expectedIP: "203.0.113.1",
+		},
+		{
+			name:                 "trusted_peer",
+			remoteAddr:           "10.0.0.1:1234",
+			header:               map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			expectedIP:           "1.2.3.4",
+			expectedForwardedFor: []string{"1.2.3.4"},
+		},
+		{
+			name:                 "spoofed_chain",
+			remoteAddr:           "10.0.0.1:1234",
+			header:               map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 192.168.1.1"},
+			expectedIP:           "1.2.3.4",
+			expectedForwardedFor: []string{"1.2.3.4", "192.168.1.1"},
+		},
+		{
+			name:                 "only_trusted",
+			remoteAddr:           "10.0.0.1:1234",
+			header:               map[string]string{"X-Forwarded-For": "10.1.1.1"},
+			expectedIP:           "10.1.1.1",
+			expectedForwardedFor: []string{"10.1.1.1"},
+		},
+		{
+			name:                 "invalid_entry",
+			remoteAddr:           "10.0.0.1:1234",
+			header:               map[string]string{"X-Forwarded-For": "1.2.3.4, garbage, 10.2.2.2"},
+			expectedIP:           "10.2.2.2",
+			expectedForwardedFor: []string{"10.2.2.2"},
+		},
+		{
+			name:                 "forwarded",
+			remoteAddr:           "10.0.0.1:1234",
+			clientIPHeader:       clientIPHeaderForwarded,
+			header:               map[string]string{"Forwarded": `for=1.2.3.4;proto=https, for="[2001:db8::1]:4711", for=10.3.3.3`},
+			expectedIP:           "2001:db8::1",
+			expectedForwardedFor: []string{"2001:db8::1", "10.3.3.3"},
+		},
+		{
+			name:                 "forwarded_unknown",
+			remoteAddr:           "10.0.0.1:1234",
+			clientIPHeader:       clientIPHeaderForwarded,
+			header:               map[string]string{"Forwarded": `for=1.2.3.4, for=unknown`},
+			expectedIP:           "10.0.0.1",
+			expectedForwardedFor: nil,
+		},
+		{
+			// the trusted proxy appends to X-Forwarded-For only
+			name:                 "spoofed_forwarded",
+			remoteAddr:           "10.0.0.1:1234",
+			header:               map[string]string{"Forwarded": "for=6.6.6.6", "X-Forwarded-For": "1.2.3.4"},
+			expectedIP:           "1.2.3.4",
+			expectedForwardedFor: []string{"1.2.3.4"},
+		},
+		{
+			name:           "spoofed_x_forwarded_for",
+			remoteAddr:     "10.0.0.1:1234",
+			clientIPHeader: clientIPHeaderForwarded,
+			header:         map[string]string{"X-Forwarded-For": "6.6.6.6"},
+			expectedIP:     "10.0.0.1",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.clientIPHeader == "" {
+				test.clientIPHeader = clientIPHeaderXForwardedFor
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			for key, value := range test.header {
+				req.Header.Set(key, value)
+			}
+			info := realClientIP(req, trustedProxies, test.clientIPHeader)
+			if info.IP != netip.MustParseAddr(test.expectedIP) {
+				t.Errorf("expected ip: %s, got: %s", test.expectedIP, info.IP)
+			}
+			if !reflect.DeepEqual(info.ForwardedFor, test.expectedForwardedFor) {
+				t.Errorf("expected forwarded for: %v, got: %v", test.expectedForwardedFor, info.ForwardedFor)
+			}
+		})
+	}
+}
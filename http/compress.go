@@ -0,0 +1,307 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type compressOptions struct {
+	// MinSize is the minimum size of a response body which is
+	// compressed. Smaller responses are sent uncompressed.
+	MinSize int
+	// SkipContentTypes are content type prefixes of responses which are
+	// already compressed, e.g. image/.
+	SkipContentTypes []string
+}
+
+func defaultCompressOptions() compressOptions {
+	return compressOptions{
+		MinSize: 1024,
+		SkipContentTypes: []string{
+			"image/",
+			"video/",
+			"audio/",
+			"font/woff",
+			"application/gzip",
+			"application/zip",
+			"application/x-7z-compressed",
+			"application/x-bzip2",
+			"application/zstd",
+			"application/octet-stream",
+			"application/grpc",
+		},
+	}
+}
+
+// supported content encodings in the order of preference
+var compressEncodings = []string{"gzip", "deflate"}
+
+var (
+	gzipWriterPool = sync.Pool{New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}}
+	zlibWriterPool = sync.Pool{New: func() any {
+		return zlib.NewWriter(io.Discard)
+	}}
+)
+
+// compressWriter is implemented by gzip.Writer and zlib.Writer.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// parseAcceptEncoding returns the q-values of the content codings in the
+// Accept-Encoding header. x-gzip is treated as gzip.
+func parseAcceptEncoding(acceptEncoding string) map[string]float64 {
+	qValues := map[string]float64{}
+	for _, element := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(element, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		if coding != "" {
+			qValues[coding] = q
+		}
+	}
+	return qValues
+}
+
+// acceptsEncoding reports whether the encoding is acceptable according to the
+// Accept-Encoding header.
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	qValues := parseAcceptEncoding(acceptEncoding)
+	q, ok := qValues[encoding]
+	if !ok {
+		q, ok = qValues["*"]
+	}
+	return ok && q > 0
+}
+
+// negotiateEncoding returns the preferred encoding of compressEncodings
+// which is acceptable according to the Accept-Encoding header or an empty
+// string if none is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	qValues := parseAcceptEncoding(acceptEncoding)
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range compressEncodings {
+		q, ok := qValues[encoding]
+		if !ok {
+			q, ok = qValues["*"]
+		}
+		if ok && q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// compressMiddleware compresses responses with gzip or deflate according to
+// the Accept-Encoding header of the request. Responses smaller than MinSize,
+// with a SkipContentTypes content type or an existing Content-Encoding are
+// sent uncompressed. Flushes are passed through, so streaming responses keep
+// working. The uncompressed size is added to the access log.
+func compressMiddleware(next http.Handler, opts compressOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		// ranges refer to the uncompressed representation and
+		// upgraded connections are not HTTP anymore
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			opts:           &opts,
+			encoding:       encoding,
+			statusCode:     http.StatusOK,
+		}
+		defer func() {
+			cw.close()
+			if cw.encoder != nil {
+				addAccessLogAttrs(r.Context(),
+					slog.String("encoding", encoding),
+					slog.Int("bytes_uncompressed", cw.bytesUncompressed),
+				)
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter buffers the first MinSize bytes of the body to
+// decide if the response is compressed.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	opts     *compressOptions
+	encoding string
+
+	statusCode        int
+	headerWritten     bool
+	decided           bool
+	buf               []byte
+	encoder           compressWriter
+	bytesUncompressed int
+}
+
+func (c *compressResponseWriter) WriteHeader(code int) {
+	if c.headerWritten {
+		return
+	}
+	if code >= 100 && code < 200 {
+		// informational responses are sent immediately
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.statusCode = code
+	c.headerWritten = true
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		c.decide(false)
+		return
+	}
+	if contentLength, err := strconv.Atoi(c.Header().Get("Content-Length")); err == nil && contentLength >= c.opts.MinSize {
+		c.decide(true)
+	}
+}
+
+func (c *compressResponseWriter) Write(p []byte) (int, error) {
+	if !c.headerWritten {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.bytesUncompressed += len(p)
+	if c.decided {
+		if c.encoder != nil {
+			return c.encoder.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+	c.buf = append(c.buf, p...)
+	if len(c.buf) >= c.opts.MinSize {
+		err := c.decide(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide writes the header and the buffered body. The response is compressed
+// if compress is set and the response is compressible.
+func (c *compressResponseWriter) decide(compress bool) error {
+	c.decided = true
+	header := c.Header()
+	if header.Get("Content-Type") == "" && len(c.buf) > 0 {
+		// net/http would sniff the content type of the compressed
+		// body otherwise
+		header.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	if compress && header.Get("Content-Encoding") == "" && !c.skipContentType(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+		if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// the compressed representation is not byte-identical
+			header.Set("Etag", "W/"+etag)
+		}
+		c.encoder = c.newEncoder()
+	}
+	c.ResponseWriter.WriteHeader(c.statusCode)
+
+	if len(c.buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.encoder != nil {
+		_, err = c.encoder.Write(c.buf)
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf)
+	}
+	c.buf = nil
+	return err
+}
+
+func (c *compressResponseWriter) skipContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range c.opts.SkipContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compressResponseWriter) newEncoder() compressWriter {
+	var encoder compressWriter
+	if c.encoding == "gzip" {
+		encoder = gzipWriterPool.Get().(*gzip.Writer)
+	} else {
+		encoder = zlibWriterPool.Get().(*zlib.Writer)
+	}
+	encoder.Reset(c.ResponseWriter)
+	return encoder
+}
+
+// Flush sends the buffered data to the client. A streaming response is
+// compressed even if it is smaller than MinSize.
+func (c *compressResponseWriter) Flush() {
+	if !c.decided {
+		if !c.headerWritten {
+			c.WriteHeader(http.StatusOK)
+		}
+		c.decide(true)
+	}
+	if c.encoder != nil {
+		c.encoder.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// close writes the remaining data after the handler returned.
+func (c *compressResponseWriter) close() {
+	if !c.decided {
+		if !c.headerWritten {
+			// nothing was written, let net/http send the default
+			// response
+			return
+		}
+		c.decide(false)
+	}
+	if c.encoder == nil {
+		return
+	}
+	c.encoder.Close()
+	c.encoder.Reset(io.Discard)
+	switch encoder := c.encoder.(type) {
+	case *gzip.Writer:
+		gzipWriterPool.Put(encoder)
+	case *zlib.Writer:
+		zlibWriterPool.Put(encoder)
+	}
+}
+
+func (c *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{acceptEncoding: "", expected: ""},
+		{acceptEncoding: "gzip", expected: "gzip"},
+		{acceptEncoding: "deflate", expected: "deflate"},
+		{acceptEncoding: "gzip, deflate, br", expected: "gzip"},
+		{acceptEncoding: "br", expected: ""},
+		{acceptEncoding: "x-gzip", expected: "gzip"},
+		{acceptEncoding: "GZIP;Q=0.5, deflate", expected: "deflate"},
+		{acceptEncoding: "gzip;q=0.5, deflate;q=0.8", expected: "deflate"},
+		{acceptEncoding: "gzip;q=0, deflate;q=0", expected: ""},
+		{acceptEncoding: "*", expected: "gzip"},
+		{acceptEncoding: "gzip;q=0, *", expected: "deflate"},
+		{acceptEncoding: "identity", expected: ""},
+		{acceptEncoding: "gzip;q=invalid", expected: ""},
+	} {
+		t.Run(test.acceptEncoding, func(t *testing.T) {
+			encoding := negotiateEncoding(test.acceptEncoding)
+			if encoding != test.expected {
+				t.Errorf("expected encoding '%s', got '%s'", test.expected, encoding)
+			}
+		})
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	large := strings.Repeat("hello world ", 200)
+
+	for _, test := range []struct {
+		name             string
+		method           string
+		header           http.Header
+		handler          http.HandlerFunc
+		expectedCode     int
+		expectedEncoding string
+		expectedHeader   http.Header
+	}{
+		{
+			name:   "gzip",
+			header: http.Header{"Accept-Encoding": {"gzip, deflate"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Etag", `"abc"`)
+				io.WriteString(w, large)
+			},
+			expectedCode:     http.StatusOK,
+			expectedEncoding: "gzip",
+			expectedHeader:   http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Etag": {`W/"abc"`}},
+		},
+		{
+			name:   "deflate",
+			header: http.Header{"Accept-Encoding": {"deflate"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, large)
+			},
+			expectedCode:     http.StatusCreated,
+			expectedEncoding: "deflate",
+			expectedHeader:   http.Header{"Content-Type": {"application/json"}},
+		},
+		{
+			name:   "content_length",
+			header: http.Header{"Accept-Encoding": {"gzip"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "2400")
+				io.WriteString(w, large)
+			},
+			expectedCode:     http.StatusOK,
+			expectedEncoding: "gzip",
+			expectedHeader:   http.Header{"Content-Length": nil},
+		},
+		{
+			name:   "small",
+			header: http.Header{"Accept-Encoding": {"gzip"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello world")
+			},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		},
+		{
+			name: "not_accepted",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, large)
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:   "skipped_content_type",
+			header: http.Header{"Accept-Encoding": {"gzip"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				io.WriteString(w, large)
+			},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Content-Type": {"image/png"}},
+		},
+		{
+			name:   "already_encoded",
+			header: http.Header{"Accept-Encoding": {"gzip"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "br")
+				io.WriteString(w, large)
+			},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Content-Encoding": {"br"}},
+		},
+		{
+			name:   "range",
+			header: http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-10"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, large)
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:   "not_modified",
+			header: http.Header{"Accept-Encoding": {"gzip"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotModified)
+			},
+			expectedCode: http.StatusNotModified,
+		},
+		{
+			name:   "no_body",
+			header: http.Header{"Accept-Encoding": {"gzip"}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			},
+			expectedCode: http.StatusAccepted,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			logger := slog.New(slog.NewTextHandler(buf, nil))
+			handler := logHandler(compressMiddleware(test.handler, defaultCompressOptions()), logger, nil)
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/", nil)
+			r.Header = test.header
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.expectedCode {
+				t.Errorf("expected status code %d, got %d", test.expectedCode, w.Code)
+			}
+			if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("expected Vary header 'Accept-Encoding', got '%s'", vary)
+			}
+			if encoding := w.Header().Get("Content-Encoding"); test.expectedHeader.Get("Content-Encoding") == "" && encoding != test.expectedEncoding {
+				t.Errorf("expected encoding '%s', got '%s'", test.expectedEncoding, encoding)
+			}
+			for key, values := range test.expectedHeader {
+				if strings.Join(w.Header().Values(key), ",") != strings.Join(values, ",") {
+					t.Errorf("expected header %s %q, got %q", key, values, w.Header().Values(key))
+				}
+			}
+
+			body := w.Body.Bytes()
+			switch test.expectedEncoding {
+			case "gzip":
+				body = decompress(t, gzip.NewReader, body)
+			case "deflate":
+				body = decompress(t, func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) }, body)
+			}
+			if test.expectedCode != http.StatusNotModified && test.expectedCode != http.StatusAccepted && test.name != "small" {
+				if string(body) != large {
+					t.Errorf("expected body of length %d, got %d", len(large), len(body))
+				}
+			}
+
+			logged := buf.String()
+			if test.expectedEncoding != "" {
+				if !strings.Contains(logged, "encoding="+test.expectedEncoding) || !strings.Contains(logged, "bytes_uncompressed=2400") {
+					t.Errorf("expected encoding and uncompressed bytes in access log, got '%s'", logged)
+				}
+			} else if strings.Contains(logged, "bytes_uncompressed") {
+				t.Errorf("expected no uncompressed bytes in access log, got '%s'", logged)
+			}
+		})
+	}
+}
+
+func decompress[R io.ReadCloser](t *testing.T, newReader func(io.Reader) (R, error), data []byte) []byte {
+	t.Helper()
+	r, err := newReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decompressed
+}
+
+func TestCompressMiddlewareFlush(t *testing.T) {
+	next := make(chan struct{})
+	server := httptest.NewServer(compressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, event := range []string{"first", "second"} {
+			io.WriteString(w, "data: "+event+"\n")
+			http.NewResponseController(w).Flush()
+			<-next
+		}
+	}), defaultCompressOptions()))
+	defer server.Close()
+	defer close(next)
+
+	r, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// set explicitly, so that the transport does not decompress
+	r.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("expected encoding 'gzip', got '%s'", encoding)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(gz)
+	for _, expected := range []string{"data: first\n", "data: second\n"} {
+		// the line has to arrive before the handler continues
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("expected line '%s', got '%s'", expected, line)
+		}
+		next <- struct{}{}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("queue full")
+	errQueueTimeout = errors.New("queue timeout")
+)
+
+type concurrencyLimitOptions struct {
+	// MaxConcurrency limits the requests which are served at the same
+	// time. 0 disables the global limit.
+	MaxConcurrency int
+	// Routes adds a limit for requests which match the route in the
+	// format [host]/path-prefix. The requests of a route are limited by
+	// the route and the global limit.
+	Routes map[string]string
+	// QueueSize is the number of requests which wait for a free slot of
+	// a limit. Further requests are rejected.
+	QueueSize int
+	// QueueTimeout is the maximum time a request waits in the queue.
+	QueueTimeout time.Duration
+	// Adaptive lowers the limit down to MinConcurrency if the latency
+	// of requests exceeds LatencyTarget and raises it again up to the
+	// configured limit if the latency recovers (AIMD). The latency is
+	// the time to first byte, hijacked connections are not sampled.
+	Adaptive       bool
+	MinConcurrency int
+	LatencyTarget  time.Duration
+}
+
+func defaultConcurrencyLimitOptions() concurrencyLimitOptions {
+	return concurrencyLimitOptions{
+		Routes:         map[string]string{},
+		QueueSize:      100,
+		QueueTimeout:   time.Second,
+		MinConcurrency: 1,
+		LatencyTarget:  time.Second,
+	}
+}
+
+// concurrencyLimitRule is the limit for a route.
+type concurrencyLimitRule struct {
+	Host       string
+	PathPrefix string
+	limit      *concurrencyLimit
+}
+
+func (r concurrencyLimitRule) String() string {
+	return r.Host + r.PathPrefix
+}
+
+// concurrencyLimiter limits the in-flight requests globally and per route.
+type concurrencyLimiter struct {
+	global *concurrencyLimit
+	// rules are in the order they are matched
+	rules   []concurrencyLimitRule
+	matcher routeMatcher[concurrencyLimitRule]
+}
+
+func newConcurrencyLimiter(opts concurrencyLimitOptions) (*concurrencyLimiter, error) {
+	if opts.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid concurrency limit queue size %d", opts.QueueSize)
+	}
+	if opts.Adaptive && opts.MinConcurrency < 1 {
+		return nil, fmt.Errorf("invalid minimum concurrency %d", opts.MinConcurrency)
+	}
+
+	l := &concurrencyLimiter{}
+	if opts.MaxConcurrency > 0 {
+		l.global = newConcurrencyLimit(opts.MaxConcurrency, opts)
+	}
+	keys := make([]string, 0, len(opts.Routes))
+	for key := range opts.Routes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		host, pathPrefix := parseRouteKey(key)
+		value := opts.Routes[key]
+		max, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || max < 0 {
+			return nil, fmt.Errorf("concurrency limit '%s': invalid limit '%s'", key, value)
+		}
+		rule := concurrencyLimitRule{
+			Host:       strings.ToLower(host),
+			PathPrefix: pathPrefix,
+		}
+		if max > 0 {
+			rule.limit = newConcurrencyLimit(max, opts)
+		}
+		l.matcher.add(rule.Host, rule.PathPrefix, rule)
+	}
+	l.rules = l.matcher.values()
+	return l, nil
+}
+
+// enabled reports whether any limit is configured.
+func (l *concurrencyLimiter) enabled() bool {
+	return l.global != nil || slices.ContainsFunc(l.rules, func(rule concurrencyLimitRule) bool {
+		return rule.limit != nil
+	})
+}
+
+// match returns the rule of the route of the request. It reports false if no
+// route matches.
+func (l *concurrencyLimiter) match(r *http.Request) (concurrencyLimitRule, bool) {
+	return l.matcher.match(r)
+}
+
+// handler limits the in-flight requests to next. The limit of the route is
+// acquired before the global limit, so that requests waiting for a saturated
+// route do not block other routes. Requests which find a full queue or wait
+// longer than the queue timeout are rejected with 503 and Retry-After.
+func (l *concurrencyLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type namedLimit struct {
+			name  string
+			limit *concurrencyLimit
+		}
+		limits := []namedLimit{}
+		if rule, ok := l.match(r); ok && rule.limit != nil {
+			limits = append(limits, namedLimit{rule.String(), rule.limit})
+		}
+		if l.global != nil {
+			limits = append(limits, namedLimit{"global", l.global})
+		}
+
+		// end is the end of the latency sample for adaptive limits
+		var end time.Time
+		releases := []func(end time.Time){}
+		defer func() {
+			for _, release := range slices.Backward(releases) {
+				release(end)
+			}
+		}()
+		for _, limit := range limits {
+			release, err := limit.limit.acquire(r.Context())
+			if err != nil {
+				if r.Context().Err() != nil {
+					// the client is gone
+					return
+				}
+				slog.DebugContext(r.Context(), "concurrency limit exceeded", "limit", limit.name, "err", err)
+				addAccessLogAttrs(r.Context(), slog.String("load_shed", limit.name+" "+err.Error()))
+				w.Header().Set("Retry-After", ceilSeconds(max(limit.limit.queueTimeout, time.Second)))
+				errorHandler(w, r, http.StatusServiceUnavailable, nil)
+				return
+			}
+			releases = append(releases, release)
+		}
+		lw := &latencyResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+		end = lw.end()
+	})
+}
+
+// latencyResponseWriter records the time to first byte. Streaming responses
+// and upgraded connections can last arbitrarily long, so only the time until
+// the response starts is a useful latency sample.
+type latencyResponseWriter struct {
+	http.ResponseWriter
+	firstByte time.Time
+	hijacked  bool
+}
+
+// end returns the end of the latency sample: the time of the first byte, the
+// current time if nothing was written or the zero time if the connection
+// was hijacked.
+func (w *latencyResponseWriter) end() time.Time {
+	switch {
+	case w.hijacked:
+		return time.Time{}
+	case w.firstByte.IsZero():
+		return time.Now()
+	}
+	return w.firstByte
+}
+
+func (w *latencyResponseWriter) started() {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+}
+
+func (w *latencyResponseWriter) WriteHeader(code int) {
+	// informational responses are followed by the actual response
+	if code >= 200 {
+		w.started()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *latencyResponseWriter) Write(b []byte) (int, error) {
+	w.started()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *latencyResponseWriter) Flush() {
+	w.FlushError()
+}
+
+func (w *latencyResponseWriter) FlushError() error {
+	w.started()
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *latencyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *latencyResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// concurrencyLimit is a semaphore with a bounded FIFO queue. If it is
+// adaptive the size of the semaphore follows the latency of the requests.
+type concurrencyLimit struct {
+	max          int
+	queueSize    int
+	queueTimeout time.Duration
+
+	adaptive      bool
+	min           int
+	latencyTarget time.Duration
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	queue    []chan struct{}
+	// lastDecrease is the time of the last decrease of the limit. Slow
+	// requests which started before only lower the limit once.
+	lastDecrease time.Time
+}
+
+func newConcurrencyLimit(max int, opts concurrencyLimitOptions) *concurrencyLimit {
+	return &concurrencyLimit{
+		max:           max,
+		queueSize:     opts.QueueSize,
+		queueTimeout:  opts.QueueTimeout,
+		adaptive:      opts.Adaptive,
+		min:           min(opts.MinConcurrency, max),
+		latencyTarget: opts.LatencyTarget,
+		limit:         float64(max),
+	}
+}
+
+// acquire waits for a free slot. The returned function has to be called when
+// the request is done with the end of its latency sample. A zero end time
+// does not adapt the limit.
+func (c *concurrencyLimit) acquire(ctx context.Context) (func(end time.Time), error) {
+	c.mu.Lock()
+	if c.inFlight < c.currentLimit() && len(c.queue) == 0 {
+		c.inFlight++
+		c.mu.Unlock()
+		return c.releaseFunc(time.Now()), nil
+	}
+	if len(c.queue) >= c.queueSize {
+		c.mu.Unlock()
+		return nil, errQueueFull
+	}
+	ready := make(chan struct{})
+	c.queue = append(c.queue, ready)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(c.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return c.releaseFunc(time.Now()), nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := slices.Index(c.queue, ready); i >= 0 {
+		c.queue = slices.Delete(c.queue, i, i+1)
+		return nil, err
+	}
+	// the slot was granted concurrently, hand it over to the next
+	// request
+	c.inFlight--
+	c.grant()
+	return nil, err
+}
+
+func (c *concurrencyLimit) releaseFunc(start time.Time) func(end time.Time) {
+	return func(end time.Time) {
+		c.release(start, end)
+	}
+}
+
+func (c *concurrencyLimit) release(start time.Time, end time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	if c.adaptive && !end.IsZero() {
+		c.adapt(start, end)
+	}
+	c.grant()
+}
+
+// adapt lowers the limit multiplicatively if the request was slower than the
+// latency target and raises it additively by about one per limit requests
+// otherwise.
+func (c *concurrencyLimit) adapt(start time.Time, now time.Time) {
+	if now.Sub(start) > c.latencyTarget {
+		if start.After(c.lastDecrease) {
+			c.limit = math.Max(float64(c.min), c.limit*0.9)
+			c.lastDecrease = now
+		}
+		return
+	}
+	c.limit = math.Min(float64(c.max), c.limit+1/c.limit)
+}
+
+// grant passes free slots to the queued requests.
+func (c *concurrencyLimit) grant() {
+	for len(c.queue) > 0 && c.inFlight < c.currentLimit() {
+		close(c.queue[0])
+		c.queue = c.queue[1:]
+		c.inFlight++
+	}
+}
+
+func (c *concurrencyLimit) currentLimit() int {
+	return int(c.limit)
+}
+
+type concurrencyLimitStatus struct {
+	Limit    int `json:"limit"`
+	Max      int `json:"max"`
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+func (c *concurrencyLimit) status() concurrencyLimitStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return concurrencyLimitStatus{
+		Limit:    c.currentLimit(),
+		Max:      c.max,
+		InFlight: c.inFlight,
+		Queued:   len(c.queue),
+	}
+}
+
+// status returns the state of the global limit and the route limits.
+func (l *concurrencyLimiter) status() map[string]concurrencyLimitStatus {
+	status := map[string]concurrencyLimitStatus{}
+	if l.global != nil {
+		status["global"] = l.global.status()
+	}
+	for _, rule := range l.rules {
+		if rule.limit != nil {
+			status[rule.String()] = rule.limit.status()
+		}
+	}
+	return status
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimitQueue(t *testing.T) {
+	opts := defaultConcurrencyLimitOptions()
+	opts.QueueSize = 1
+	opts.QueueTimeout = 50 * time.Millisecond
+	limit := newConcurrencyLimit(1, opts)
+
+	release, err := limit.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waits in the queue until the first request is released
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := limit.acquire(context.Background())
+		if err == nil {
+			defer release(time.Now())
+		}
+		acquired <- err
+	}()
+	for limit.status().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := limit.acquire(context.Background()); !errors.Is(err, errQueueFull) {
+		t.Errorf("expected error %v, got %v", errQueueFull, err)
+	}
+	release(time.Now())
+	if err := <-acquired; err != nil {
+		t.Errorf("expected queued request to acquire a slot, got %v", err)
+	}
+
+	release, err = limit.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release(time.Now())
+	if _, err := limit.acquire(context.Background()); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("expected error %v, got %v", errQueueTimeout, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limit.acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+	if status := limit.status(); status.InFlight != 1 || status.Queued != 0 {
+		t.Errorf("expected one in-flight request and an empty queue, got %+v", status)
+	}
+}
+
+func TestConcurrencyLimitAdaptive(t *testing.T) {
+	opts := defaultConcurrencyLimitOptions()
+	opts.Adaptive = true
+	opts.MinConcurrency = 5
+	opts.LatencyTarget = 100 * time.Millisecond
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name string
+		// latencies of the requests which start one after another
+		latencies []time.Duration
+		// concurrent requests start at the same time
+		concurrent bool
+		expected   int
+	}{
+		{
+			name:      "fast",
+			latencies: []time.Duration{10 * time.Millisecond, 10 * time.Millisecond},
+			expected:  10,
+		},
+		{
+			name:      "slow",
+			latencies: []time.Duration{time.Second},
+			expected:  9,
+		},
+		{
+			name: "slow_concurrent",
+			// the second request started before the first
+			// decrease and does not lower the limit again
+			latencies:  []time.Duration{time.Second, time.Second},
+			concurrent: true,
+			expected:   9,
+		},
+		{
+			name:      "min",
+			latencies: []time.Duration{time.Second, 0, 0, time.Second, 0, 0, time.Second, 0, 0, time.Second, 0, 0, time.Second, 0, 0, time.Second, 0, 0, time.Second, 0, 0, time.Second},
+			expected:  5,
+		},
+		{
+			name:      "recover",
+			latencies: []time.Duration{time.Second, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			expected:  10,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			limit := newConcurrencyLimit(10, opts)
+			for i, latency := range test.latencies {
+				requestStart := start
+				if !test.concurrent {
+					requestStart = start.Add(time.Duration(i) * time.Minute)
+				}
+				limit.inFlight++
+				limit.release(requestStart, requestStart.Add(latency))
+			}
+			if status := limit.status(); status.Limit != test.expected {
+				t.Errorf("expected limit %d, got %d", test.expected, status.Limit)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	opts := defaultConcurrencyLimitOptions()
+	opts.MaxConcurrency = 2
+	opts.Routes = map[string]string{"/slow": "1", "/unlimited": "0"}
+	opts.QueueSize = 0
+	opts.QueueTimeout = 2 * time.Second
+	limiter, err := newConcurrencyLimiter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	block := make(chan struct{})
+	handler := limiter.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-block
+		}
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-started
+	defer func() {
+		close(block)
+		<-done
+	}()
+
+	status := limiter.status()
+	if status["global"].InFlight != 1 || status["/slow"].InFlight != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	for _, test := range []struct {
+		name         string
+		path         string
+		expectedCode int
+	}{
+		{name: "route_limit", path: "/slow/2", expectedCode: http.StatusServiceUnavailable},
+		{name: "global_limit_not_reached", path: "/unlimited", expectedCode: http.StatusOK},
+		{name: "other_segment", path: "/slower", expectedCode: http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != test.expectedCode {
+				t.Errorf("expected status code %d, got %d", test.expectedCode, w.Code)
+			}
+			if test.expectedCode == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "2" {
+				t.Errorf("expected Retry-After 2, got '%s'", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterAdaptiveLatency(t *testing.T) {
+	opts := defaultConcurrencyLimitOptions()
+	opts.MaxConcurrency = 10
+	opts.Adaptive = true
+	opts.LatencyTarget = 20 * time.Millisecond
+	slow := 3 * opts.LatencyTarget
+
+	for _, test := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected int
+	}{
+		{
+			name: "slow",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(slow)
+			},
+			expected: 9,
+		},
+		{
+			name: "streaming",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				http.NewResponseController(w).Flush()
+				time.Sleep(slow)
+			},
+			expected: 10,
+		},
+		{
+			name: "hijacked",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				time.Sleep(slow)
+			},
+			expected: 10,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			limiter, err := newConcurrencyLimiter(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			handler := limiter.handler(test.handler)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+				handler.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			<-done
+			if status := limiter.status()["global"]; status.Limit != test.expected {
+				t.Errorf("expected limit %d, got %d", test.expected, status.Limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configValue is a flag value from a config file.
+type configValue struct {
+	name  string
+	value string
+}
+
+// readFlagsFromConfigFile reads configuration values from the config file
+// which is set with the flag configFlag. The flag is looked up in args, then
+// in the environment (with prefix) and otherwise its default is used. This
+// function should be called before readFlagsFromEnv and flag.Parse, so that
+// the environment and the flags override the settings of the file.
+//
+// The format is selected by the file extension: JSON (.json), YAML (.yaml,
+// .yml) or TOML (.toml). Only a subset of YAML and TOML is supported: maps,
+// lists and scalars. The keys are flag names, underscores are replaced with
+// dashes. The keys of nested maps are joined with dashes, e.g. {"log":
+// {"level": "debug"}} sets the flag log-level. Lists set the flag once per
+// item.
+func readFlagsFromConfigFile(fs *flag.FlagSet, configFlag string, args []string, prefix string) error {
+	file := lookupConfigFile(fs, configFlag, args, prefix)
+	if file == "" {
+		return nil
+	}
+	values, err := loadConfigFile(file)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, v := range values {
+		f := fs.Lookup(v.name)
+		if f == nil || f.Name == configFlag {
+			errs = append(errs, fmt.Errorf("unknown setting '%s' in %s", v.name, file))
+			continue
+		}
+		err := f.Value.Set(v.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value '%s' for %s in %s: %w", v.value, v.name, file, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lookupConfigFile returns the value of the flag configFlag before the flags
+// are parsed.
+func lookupConfigFile(fs *flag.FlagSet, configFlag string, args []string, prefix string) string {
+	value, found := "", false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// the flag package stops at the first non-flag argument
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		name, argValue, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name == configFlag {
+			if hasValue {
+				value, found = argValue, true
+			} else if i+1 < len(args) {
+				value, found = args[i+1], true
+				i++
+			}
+			continue
+		}
+		// skip the value of other flags
+		if f := fs.Lookup(name); f != nil && !hasValue && !isBoolFlag(f) {
+			i++
+		}
+	}
+	if found {
+		return value
+	}
+
+	envVarName := prefix + configFlag
+	envVarName = strings.ReplaceAll(envVarName, "-", "_")
+	envVarName = strings.ToUpper(envVarName)
+	if value, ok := os.LookupEnv(envVarName); ok {
+		return value
+	}
+	if f := fs.Lookup(configFlag); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
+
+// loadConfigFile reads the file and returns its flag values.
+func loadConfigFile(file string) ([]configValue, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var config map[string]any
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&config)
+	case ".yaml", ".yml":
+		config, err = parseYAMLConfig(data)
+	case ".toml":
+		config, err = parseTOMLConfig(data)
+	default:
+		return nil, fmt.Errorf("unsupported config file format '%s'", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file '%s': %w", file, err)
+	}
+	values, err := flattenConfig("", config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %w", file, err)
+	}
+	return values, nil
+}
+
+// flattenConfig returns the values of config sorted by name.
+func flattenConfig(prefix string, config map[string]any) ([]configValue, error) {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := []configValue{}
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		switch v := config[key].(type) {
+		case map[string]any:
+			nested, err := flattenConfig(name, v)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, nested...)
+		case []any:
+			for _, item := range v {
+				value, err := configScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				values = append(values, configValue{name: name, value: value})
+			}
+		default:
+			value, err := configScalar(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			values = append(values, configValue{name: name, value: value})
+		}
+	}
+	return values, nil
+}
+
+func configScalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// parseYAMLConfig parses a subset of YAML: maps nested by indentation, lists
+// with one "- item" per line or in the flow style [a, b], plain and quoted
+// scalars and comments. All scalars are strings.
+func parseYAMLConfig(data []byte) (map[string]any, error) {
+	type level struct {
+		indent int
+		config map[string]any
+	}
+	root := map[string]any{}
+	levels := []level{{indent: -1, config: root}}
+	// the last key without a value gets a map or a list
+	var (
+		openConfig map[string]any
+		openKey    string
+	)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = stripConfigComment(line)
+		content := strings.TrimSpace(line)
+		if content == "" || content == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			list, ok := openConfig[openKey].([]any)
+			if openConfig == nil || (!ok && len(openConfig[openKey].(map[string]any)) > 0) {
+				return nil, fmt.Errorf("line %d: unexpected list item", i+1)
+			}
+			item, err := parseConfigScalar(strings.TrimSpace(content[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			openConfig[openKey] = append(list, item)
+			continue
+		}
+
+		for indent <= levels[len(levels)-1].indent {
+			levels = levels[:len(levels)-1]
+		}
+		key, value, found := strings.Cut(content, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", i+1)
+		}
+		key, err := parseConfigScalar(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		config := levels[len(levels)-1].config
+		value = strings.TrimSpace(value)
+		if value == "" {
+			nested := map[string]any{}
+			config[key] = nested
+			levels = append(levels, level{indent: indent, config: nested})
+			openConfig, openKey = config, key
+			continue
+		}
+		openConfig = nil
+		config[key], err = parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return root, nil
+}
+
+// parseTOMLConfig parses a subset of TOML: tables, dotted keys, strings,
+// single line arrays and comments. Numbers, booleans and dates are returned
+// as strings.
+func parseTOMLConfig(data []byte) (map[string]any, error) {
+	root := map[string]any{}
+	table := root
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripConfigComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if strings.HasPrefix(line, "[[") || !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unsupported table '%s'", i+1, line)
+			}
+			var err error
+			table, err = configTable(root, line[1:len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected 'key = value'", i+1)
+		}
+		key = strings.TrimSpace(key)
+		parent := ""
+		if dot := strings.LastIndex(key, "."); dot >= 0 {
+			parent, key = key[:dot], key[dot+1:]
+		}
+		config := table
+		if parent != "" {
+			var err error
+			config, err = configTable(table, parent)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+		key, err := parseConfigScalar(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		config[key], err = parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return root, nil
+}
+
+// configTable returns the nested map of the dotted key and creates it if
+// necessary.
+func configTable(config map[string]any, dottedKey string) (map[string]any, error) {
+	for _, key := range strings.Split(dottedKey, ".") {
+		key = strings.TrimSpace(key)
+		switch nested := config[key].(type) {
+		case nil:
+			m := map[string]any{}
+			config[key] = m
+			config = m
+		case map[string]any:
+			config = nested
+		default:
+			return nil, fmt.Errorf("key '%s' is not a table", key)
+		}
+	}
+	return config, nil
+}
+
+// parseConfigValue parses a scalar or a flow list [a, b].
+func parseConfigValue(value string) (any, error) {
+	if !strings.HasPrefix(value, "[") {
+		return parseConfigScalar(value)
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("unterminated list '%s'", value)
+	}
+	list := []any{}
+	for _, item := range splitConfigList(value[1 : len(value)-1]) {
+		scalar, err := parseConfigScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, scalar)
+	}
+	return list, nil
+}
+
+// parseConfigScalar unquotes double and single quoted strings. Other values
+// are returned unchanged.
+func parseConfigScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", value)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid string %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	case strings.HasPrefix(value, "{"):
+		return "", fmt.Errorf("inline tables are not supported")
+	}
+	return value, nil
+}
+
+// splitConfigList splits the items of a list at commas outside of quotes.
+func splitConfigList(list string) []string {
+	items := []string{}
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(list[start:i]))
+			start = i + 1
+		}
+	}
+	// a trailing comma is allowed
+	if last := strings.TrimSpace(list[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// stripConfigComment removes a comment which starts with # at the beginning
+// of the line or after a space outside of quotes.
+func stripConfigComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	config   string
+	logLevel string
+	port     int
+	debug    bool
+	timeout  time.Duration
+	items    []string
+	headers  map[string]string
+	tlsCert  string
+	tlsKey   string
+	flagSet  *flag.FlagSet
+}
+
+func newTestConfig() *testConfig {
+	c := &testConfig{
+		logLevel: "info",
+		items:    []string{},
+		headers:  map[string]string{},
+		flagSet:  flag.NewFlagSet("test", flag.ContinueOnError),
+	}
+	c.flagSet.SetOutput(io.Discard)
+	c.flagSet.StringVar(&c.config, "config", c.config, "config file")
+	c.flagSet.StringVar(&c.logLevel, "log-level", c.logLevel, "log level")
+	c.flagSet.IntVar(&c.port, "port", c.port, "port")
+	c.flagSet.BoolVar(&c.debug, "debug", c.debug, "debug")
+	c.flagSet.DurationVar(&c.timeout, "timeout", c.timeout, "timeout")
+	c.flagSet.Var(newSliceValue(&c.items, ","), "item", "items")
+	c.flagSet.Var(newMapValue(c.headers, "=", ","), "header", "headers")
+	c.flagSet.StringVar(&c.tlsCert, "tls-cert", c.tlsCert, "certificate")
+	c.flagSet.StringVar(&c.tlsKey, "tls-key", c.tlsKey, "key")
+	return c
+}
+
+func writeTestConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(file, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadFlagsFromConfigFile(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "json",
+			file: "config.json",
+			content: `{
+	"log-level": "debug",
+	"port": 8080,
+	"debug": true,
+	"timeout": "1.5s",
+	"item": ["one", "two,three"],
+	"header": ["a=1", "b=2"],
+	"tls": {"cert": "cert.pem", "key": "key.pem"}
+}`,
+		},
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `---
+# comment
+log_level: debug
+port: 8080 # comment
+debug: true
+timeout: "1.5s"
+item:
+  - one
+  - 'two,three'
+header: [a=1, "b=2"]
+tls:
+  cert: cert.pem
+  key: key.pem
+`,
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			content: `# comment
+log-level = "debug"
+port = 8080 # comment
+debug = true
+timeout = '1.5s'
+item = ["one", "two,three",]
+header = ["a=1", "b=2"]
+
+[tls]
+cert = "cert.pem"
+key = "key.pem"
+`,
+		},
+		{
+			name: "toml_dotted_keys",
+			file: "config.toml",
+			content: `log.level = "debug"
+port = 8080
+debug = true
+timeout = "1.5s"
+item = ["one", "two,three"]
+header = ["a=1", "b=2"]
+tls.cert = "cert.pem"
+tls.key = "key.pem"
+`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			file := writeTestConfig(t, test.file, test.content)
+			c := newTestConfig()
+			err := readFlagsFromConfigFile(c.flagSet, "config", []string{"-config", file}, "TEST_CONFIG_")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := &testConfig{
+				logLevel: "debug",
+				port:     8080,
+				debug:    true,
+				timeout:  1500 * time.Millisecond,
+				items:    []string{"one", "two", "three"},
+				headers:  map[string]string{"a": "1", "b": "2"},
+				tlsCert:  "cert.pem",
+				tlsKey:   "key.pem",
+			}
+			c.config, c.flagSet = "", nil
+			if !reflect.DeepEqual(c, expected) {
+				t.Errorf("expected %+v, got %+v", expected, c)
+			}
+		})
+	}
+}
+
+func TestReadFlagsFromConfigFileErrors(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		file          string
+		content       string
+		expectedError string
+	}{
+		{
+			name:          "unknown_setting",
+			file:          "config.json",
+			content:       `{"log": {"lvl": "debug"}}`,
+			expectedError: "unknown setting 'log-lvl'",
+		},
+		{
+			name:          "invalid_value",
+			file:          "config.yaml",
+			content:       "port: abc\ntimeout: 1\n",
+			expectedError: "invalid value 'abc' for port",
+		},
+		{
+			name:          "unsupported_format",
+			file:          "config.ini",
+			content:       "port=8080",
+			expectedError: "unsupported config file format '.ini'",
+		},
+		{
+			name:          "invalid_json",
+			file:          "config.json",
+			content:       `{"port": 8080`,
+			expectedError: "failed to parse config file",
+		},
+		{
+			name:          "null",
+			file:          "config.json",
+			content:       `{"port": null}`,
+			expectedError: "port: unsupported value",
+		},
+		{
+			name:          "yaml_list_without_key",
+			file:          "config.yaml",
+			content:       "- one\n",
+			expectedError: "line 1: unexpected list item",
+		},
+		{
+			name:          "toml_array_of_tables",
+			file:          "config.toml",
+			content:       "[[tls]]\n",
+			expectedError: "line 1: unsupported table",
+		},
+		{
+			name:          "toml_inline_table",
+			file:          "config.toml",
+			content:       "tls = {cert = \"cert.pem\"}\n",
+			expectedError: "inline tables are not supported",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			file := writeTestConfig(t, test.file, test.content)
+			c := newTestConfig()
+			err := readFlagsFromConfigFile(c.flagSet, "config", []string{"-config=" + file}, "TEST_CONFIG_")
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("expected error '%s', got %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	file := writeTestConfig(t, "config.json", `{"log-level": "debug", "port": 8080, "timeout": "1s"}`)
+	t.Setenv("TEST_CONFIG_CONFIG", "does-not-exist.json")
+	t.Setenv("TEST_CONFIG_PORT", "9090")
+
+	args := []string{"-debug", "-log-level", "warn", "--config", file}
+	c := newTestConfig()
+	err := readFlagsFromConfigFile(c.flagSet, "config", args, "TEST_CONFIG_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = readFlagsFromEnv(c.flagSet, "TEST_CONFIG_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.flagSet.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.config != file {
+		t.Errorf("expected config file '%s', got '%s'", file, c.config)
+	}
+	if c.logLevel != "warn" || c.port != 9090 || c.timeout != time.Second || !c.debug {
+		t.Errorf("expected flags over env over config file, got %+v", c)
+	}
+}
+
+func TestLookupConfigFile(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		args     []string
+		env      string
+		expected string
+	}{
+		{
+			name:     "flag",
+			args:     []string{"-config", "a.json"},
+			expected: "a.json",
+		},
+		{
+			name:     "flag_with_equal_sign",
+			args:     []string{"--config=a.json"},
+			expected: "a.json",
+		},
+		{
+			name:     "last_flag",
+			args:     []string{"-config", "a.json", "-config", "b.json"},
+			expected: "b.json",
+		},
+		{
+			name:     "value_of_other_flag",
+			args:     []string{"-log-level", "-config", "-config", "a.json"},
+			expected: "a.json",
+		},
+		{
+			name:     "after_bool_flag",
+			args:     []string{"-debug", "-config", "a.json"},
+			expected: "a.json",
+		},
+		{
+			name:     "after_arguments",
+			args:     []string{"arg", "-config", "a.json"},
+			expected: "",
+		},
+		{
+			name:     "env",
+			env:      "b.json",
+			expected: "b.json",
+		},
+		{
+			name:     "flag_over_env",
+			args:     []string{"-config", "a.json"},
+			env:      "b.json",
+			expected: "a.json",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv("TEST_CONFIG_CONFIG", test.env)
+			}
+			c := newTestConfig()
+			file := lookupConfigFile(c.flagSet, "config", test.args, "TEST_CONFIG_")
+			if file != test.expected {
+				t.Errorf("expected '%s', got '%s'", test.expected, file)
+			}
+		})
+	}
+}
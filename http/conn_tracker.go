@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errServerShutdown is the cause of the context of streaming requests which
+// are still running at the end of the shutdown grace period.
+var errServerShutdown = errors.New("server shutdown")
+
+// connTracker tracks hijacked connections (e.g. proxied WebSockets) and
+// streaming responses. server.Shutdown does not wait for hijacked connections
+// and can not end streaming responses. On shutdown the handlers are notified
+// (see getShutdownNotify), so they can end the connection gracefully, e.g.
+// with a WebSocket close frame. The context of requests with a hijacked
+// connection is canceled on shutdown, which ends connections upgraded by the
+// ReverseProxy (it closes both sides). Connections which are still open at
+// the end of the grace period are force-closed.
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[*trackedConn]struct{}
+	shutdown chan struct{}
+}
+
+// trackedConn is a hijacked connection or a streaming response.
+type trackedConn struct {
+	kind  string
+	close func()
+	// shutdown is called on the shutdown if it is not nil
+	shutdown func()
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns:    map[*trackedConn]struct{}{},
+		shutdown: make(chan struct{}),
+	}
+}
+
+func (t *connTracker) add(kind string, close, shutdown func()) *trackedConn {
+	c := &trackedConn{kind: kind, close: close, shutdown: shutdown}
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+	// connections added after notifyShutdown are notified right away
+	select {
+	case <-t.shutdown:
+		if shutdown != nil {
+			shutdown()
+		}
+	default:
+	}
+	return c
+}
+
+func (t *connTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+func (t *connTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// notifyShutdown notifies the handlers of the tracked connections. It has to
+// be registered with server.RegisterOnShutdown.
+func (t *connTracker) notifyShutdown() {
+	t.mu.Lock()
+	select {
+	case <-t.shutdown:
+		t.mu.Unlock()
+		return
+	default:
+		close(t.shutdown)
+	}
+	shutdown := []func(){}
+	for c := range t.conns {
+		if c.shutdown != nil {
+			shutdown = append(shutdown, c.shutdown)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, f := range shutdown {
+		f()
+	}
+}
+
+// wait waits until all tracked connections are closed or ctx is done. It
+// force-closes the remaining connections and returns their number by kind.
+func (t *connTracker) wait(ctx context.Context) map[string]int {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for t.len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.mu.Lock()
+			conns := t.conns
+			t.conns = map[*trackedConn]struct{}{}
+			t.mu.Unlock()
+
+			forceClosed := map[string]int{}
+			for c := range conns {
+				c.close()
+				forceClosed[c.kind]++
+			}
+			return forceClosed
+		}
+	}
+	return nil
+}
+
+// handler tracks the connections which are hijacked and the responses which
+// are flushed by next.
+func (t *connTracker) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(context.WithValue(r.Context(), shutdownNotifyKey, (<-chan struct{})(t.shutdown)))
+		defer cancel(nil)
+		tw := &trackingResponseWriter{
+			ResponseWriter: w,
+			tracker:        t,
+			cancel:         cancel,
+		}
+		defer func() {
+			if tw.stream != nil {
+				t.remove(tw.stream)
+			}
+		}()
+		next.ServeHTTP(tw, r.WithContext(ctx))
+	})
+}
+
+// trackingResponseWriter registers the hijacked connection or, on the first
+// flush, the streaming response.
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	tracker *connTracker
+	cancel  context.CancelCauseFunc
+	stream  *trackedConn
+}
+
+func (w *trackingResponseWriter) Flush() {
+	w.FlushError()
+}
+
+func (w *trackingResponseWriter) FlushError() error {
+	if w.stream == nil {
+		w.stream = w.tracker.add("stream", func() {
+			w.cancel(errServerShutdown)
+		}, nil)
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *trackingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &trackedNetConn{
+		Conn:    conn,
+		tracker: w.tracker,
+	}
+	tc.tracked = w.tracker.add("hijacked", func() {
+		slog.Debug("force close hijacked connection", "remote_addr", conn.RemoteAddr())
+		conn.Close()
+	}, func() {
+		w.cancel(errServerShutdown)
+	})
+	return tc, rw, nil
+}
+
+func (w *trackingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// trackedNetConn removes the connection from the tracker when it is closed.
+type trackedNetConn struct {
+	net.Conn
+	tracker *connTracker
+	tracked *trackedConn
+}
+
+func (c *trackedNetConn) Close() error {
+	c.tracker.remove(c.tracked)
+	return c.Conn.Close()
+}
+
+type ctxKeyShutdownNotify int
+
+const shutdownNotifyKey ctxKeyShutdownNotify = 0
+
+// getShutdownNotify returns a channel which is closed when the server shuts
+// down. Handlers of long-lived connections should end them gracefully, e.g.
+// with a WebSocket close frame. It returns nil if the request is not
+// tracked.
+func getShutdownNotify(ctx context.Context) <-chan struct{} {
+	notify, _ := ctx.Value(shutdownNotifyKey).(<-chan struct{})
+	return notify
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upgradeHandler switches to a line based protocol which echoes the lines.
+// If graceful is set it sends "bye" on shutdown and closes the connection.
+func upgradeHandler(graceful bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				lines <- line
+			}
+		}()
+		shutdown := getShutdownNotify(r.Context())
+		if !graceful {
+			shutdown = nil
+		}
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				conn.Write([]byte(line))
+			case <-shutdown:
+				conn.Write([]byte("bye\n"))
+				return
+			}
+		}
+	}
+}
+
+// dialUpgrade sends an upgrade request and returns the connection after the
+// 101 response.
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status code %d, got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	io.WriteString(conn, "ping\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("expected echo of ping, got '%s' (%v)", line, err)
+	}
+	return conn, reader
+}
+
+func TestConnTracker(t *testing.T) {
+	upstream := httptest.NewServer(upgradeHandler(false))
+	defer upstream.Close()
+	pool, err := newUpstreamPool([]string{upstream.URL}, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := forwardCustomTransportHandler(pool, headerRules{})
+
+	for _, test := range []struct {
+		name     string
+		handler  http.Handler
+		expected map[string]int
+		// expectedLine is read by the client after the shutdown
+		expectedLine string
+	}{
+		{
+			name:         "graceful",
+			handler:      upgradeHandler(true),
+			expectedLine: "bye\n",
+		},
+		{
+			name:     "force_closed",
+			handler:  upgradeHandler(false),
+			expected: map[string]int{"hijacked": 1},
+		},
+		{
+			// the proxy ends the upgraded connection on shutdown
+			name:    "proxied",
+			handler: proxy,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newConnTracker()
+			server := httptest.NewUnstartedServer(tracker.handler(logHandler(test.handler, slog.New(slog.DiscardHandler), nil)))
+			server.Config.RegisterOnShutdown(tracker.notifyShutdown)
+			server.Start()
+			defer server.Close()
+
+			_, reader := dialUpgrade(t, server.Listener.Addr().String())
+			if tracked := tracker.len(); tracked != 1 {
+				t.Fatalf("expected one tracked connection, got %d", tracked)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if err := server.Config.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+			forceClosed := tracker.wait(ctx)
+			if len(forceClosed) != len(test.expected) || forceClosed["hijacked"] != test.expected["hijacked"] {
+				t.Errorf("expected force closed connections %v, got %v", test.expected, forceClosed)
+			}
+
+			line, err := reader.ReadString('\n')
+			if line != test.expectedLine {
+				t.Errorf("expected line '%s', got '%s'", test.expectedLine, line)
+			}
+			if _, err = reader.ReadString('\n'); !errors.Is(err, io.EOF) {
+				t.Errorf("expected closed connection, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConnTrackerStream(t *testing.T) {
+	tracker := newConnTracker()
+	causes := make(chan error, 1)
+	server := httptest.NewServer(tracker.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: first\n")
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+		causes <- context.Cause(r.Context())
+	})))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "data: first") {
+		t.Fatalf("expected first event, got '%s' (%v)", line, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	forceClosed := tracker.wait(ctx)
+	if forceClosed["stream"] != 1 {
+		t.Errorf("expected one force closed stream, got %v", forceClosed)
+	}
+	if cause := <-causes; !errors.Is(cause, errServerShutdown) {
+		t.Errorf("expected cause %v, got %v", errServerShutdown, cause)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type corsOptions struct {
+	// AllowedOrigins are origins like https://example.com. An origin
+	// like https://*.example.com allows all subdomains and * allows
+	// all origins. Origins without scheme (e.g. *.example.com) match
+	// any scheme.
+	AllowedOrigins []string
+	// AllowedOriginPattern allows the origins which match the regular
+	// expression. The whole origin has to match. An empty pattern allows
+	// no origins.
+	AllowedOriginPattern *regexp.Regexp
+	AllowedMethods       []string
+	// AllowedHeaders are the request headers which can be used in
+	// cross-origin requests. * allows all headers.
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is the duration browsers can cache the result of a
+	// preflight request. 0 omits the Access-Control-Max-Age header.
+	MaxAge time.Duration
+}
+
+func defaultCORSOptions() corsOptions {
+	return corsOptions{
+		AllowedOrigins:       []string{},
+		AllowedOriginPattern: regexp.MustCompile(""),
+		AllowedMethods:       []string{http.MethodGet, http.MethodHead, http.MethodPost},
+		AllowedHeaders:       []string{"Content-Type", "Authorization"},
+		ExposedHeaders:       []string{},
+		MaxAge:               10 * time.Minute,
+	}
+}
+
+// enabled reports whether any origin is allowed.
+func (c *corsOptions) enabled() bool {
+	return len(c.AllowedOrigins) > 0 || c.hasPattern()
+}
+
+// validate rejects options which allow any origin to send credentials.
+func (c *corsOptions) validate() error {
+	if c.AllowCredentials && slices.Contains(c.AllowedOrigins, "*") {
+		return errors.New("CORS: credentials can't be allowed for all origins")
+	}
+	return nil
+}
+
+func (c *corsOptions) hasPattern() bool {
+	return c.AllowedOriginPattern != nil && c.AllowedOriginPattern.String() != ""
+}
+
+func (c *corsOptions) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+		// allowed origins without scheme match any scheme
+		origin := origin
+		if !strings.Contains(allowed, "://") {
+			if _, host, ok := strings.Cut(origin, "://"); ok {
+				origin = host
+			}
+		}
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// https://*.example.com matches https://api.example.com but
+		// not https://example.com
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok {
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+				strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) &&
+				!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:") {
+				return true
+			}
+		}
+	}
+	return c.hasPattern() && c.AllowedOriginPattern.MatchString(origin)
+}
+
+// allowHeaders returns the allowed headers of the comma separated list of
+// requested headers. It reports false if a header is not allowed.
+func (c *corsOptions) allowHeaders(requested string) (string, bool) {
+	headers := []string{}
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if !slices.Contains(c.AllowedHeaders, "*") && !slices.ContainsFunc(c.AllowedHeaders, func(allowed string) bool {
+			return strings.EqualFold(allowed, header)
+		}) {
+			return "", false
+		}
+		headers = append(headers, header)
+	}
+	return strings.Join(headers, ", "), true
+}
+
+// corsMiddleware implements cross-origin resource sharing (CORS). Preflight
+// requests of allowed origins are answered directly and rejected with 403
+// otherwise. Other requests are passed to next, the CORS headers are only
+// added for allowed origins.
+func corsMiddleware(next http.Handler, opts corsOptions) http.Handler {
+	allowAll := slices.Contains(opts.AllowedOrigins, "*")
+	if opts.hasPattern() {
+		opts.AllowedOriginPattern = regexp.MustCompile("^(?:" + opts.AllowedOriginPattern.String() + ")$")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the response depends on the Origin header, caches have to
+		// store a response per origin
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := opts.allowOrigin(origin)
+		allowOrigin := origin
+		if allowAll {
+			// the origin is never reflected for *, browsers reject
+			// * with credentials (see validate)
+			allowOrigin = "*"
+		}
+
+		preflightMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && preflightMethod != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !allowed {
+				errorHandler(w, r, http.StatusForbidden, "origin not allowed")
+				return
+			}
+			if !slices.Contains(opts.AllowedMethods, preflightMethod) {
+				errorHandler(w, r, http.StatusForbidden, "method not allowed")
+				return
+			}
+			headers, ok := opts.allowHeaders(r.Header.Get("Access-Control-Request-Headers"))
+			if !ok {
+				errorHandler(w, r, http.StatusForbidden, "header not allowed")
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(opts.AllowedMethods, ", "))
+			if headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			if opts.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if opts.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if opts.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(opts.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	opts := defaultCORSOptions()
+	opts.AllowedOrigins = []string{"https://example.com", "https://*.example.org"}
+	opts.AllowedOriginPattern = regexp.MustCompile(`https://app-\d+\.example\.net`)
+	opts.ExposedHeaders = []string{"X-Request-Id"}
+	opts.AllowCredentials = true
+	opts.MaxAge = time.Minute
+
+	for _, test := range []struct {
+		name           string
+		opts           *corsOptions
+		method         string
+		header         http.Header
+		expectedCode   int
+		expectedHeader http.Header
+	}{
+		{
+			name:           "no_origin",
+			method:         "GET",
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Vary": {"Origin"}},
+		},
+		{
+			name:         "allowed_origin",
+			method:       "GET",
+			header:       http.Header{"Origin": {"https://example.com"}},
+			expectedCode: http.StatusOK,
+			expectedHeader: http.Header{
+				"Vary":                             {"Origin"},
+				"Access-Control-Allow-Origin":      {"https://example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Expose-Headers":    {"X-Request-Id"},
+			},
+		},
+		{
+			name:           "not_allowed_origin",
+			method:         "GET",
+			header:         http.Header{"Origin": {"https://example.net"}},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Vary": {"Origin"}},
+		},
+		{
+			name:         "wildcard_subdomain",
+			method:       "GET",
+			header:       http.Header{"Origin": {"https://api.example.org"}},
+			expectedCode: http.StatusOK,
+			expectedHeader: http.Header{
+				"Vary":                             {"Origin"},
+				"Access-Control-Allow-Origin":      {"https://api.example.org"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Expose-Headers":    {"X-Request-Id"},
+			},
+		},
+		{
+			name:           "wildcard_subdomain_without_subdomain",
+			method:         "GET",
+			header:         http.Header{"Origin": {"https://.example.org"}},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Vary": {"Origin"}},
+		},
+		{
+			name:           "wildcard_subdomain_other_domain",
+			method:         "GET",
+			header:         http.Header{"Origin": {"https://evil.com/.example.org"}},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Vary": {"Origin"}},
+		},
+		{
+			name:         "regex",
+			method:       "GET",
+			header:       http.Header{"Origin": {"https://app-12.example.net"}},
+			expectedCode: http.StatusOK,
+			expectedHeader: http.Header{
+				"Vary":                             {"Origin"},
+				"Access-Control-Allow-Origin":      {"https://app-12.example.net"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Expose-Headers":    {"X-Request-Id"},
+			},
+		},
+		{
+			name:           "regex_partial_match",
+			method:         "GET",
+			header:         http.Header{"Origin": {"https://app-12.example.net.evil.com"}},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Vary": {"Origin"}},
+		},
+		{
+			name:   "preflight",
+			method: "OPTIONS",
+			header: http.Header{
+				"Origin":                         {"https://example.com"},
+				"Access-Control-Request-Method":  {"POST"},
+				"Access-Control-Request-Headers": {"content-type, authorization"},
+			},
+			expectedCode: http.StatusNoContent,
+			expectedHeader: http.Header{
+				"Vary":                             {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+				"Access-Control-Allow-Origin":      {"https://example.com"},
+				"Access-Control-Allow-Methods":     {"GET, HEAD, POST"},
+				"Access-Control-Allow-Headers":     {"content-type, authorization"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Max-Age":           {"60"},
+			},
+		},
+		{
+			name:   "preflight_method_not_allowed",
+			method: "OPTIONS",
+			header: http.Header{
+				"Origin":                        {"https://example.com"},
+				"Access-Control-Request-Method": {"DELETE"},
+			},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:   "preflight_header_not_allowed",
+			method: "OPTIONS",
+			header: http.Header{
+				"Origin":                         {"https://example.com"},
+				"Access-Control-Request-Method":  {"GET"},
+				"Access-Control-Request-Headers": {"X-Custom"},
+			},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:   "preflight_origin_not_allowed",
+			method: "OPTIONS",
+			header: http.Header{
+				"Origin":                        {"https://example.net"},
+				"Access-Control-Request-Method": {"GET"},
+			},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:   "all_origins",
+			opts:   &corsOptions{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}, AllowedHeaders: []string{"*"}},
+			method: "OPTIONS",
+			header: http.Header{
+				"Origin":                         {"https://example.net"},
+				"Access-Control-Request-Method":  {"GET"},
+				"Access-Control-Request-Headers": {"X-Custom"},
+			},
+			expectedCode: http.StatusNoContent,
+			expectedHeader: http.Header{
+				"Vary":                         {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+				"Access-Control-Allow-Origin":  {"*"},
+				"Access-Control-Allow-Methods": {"GET"},
+				"Access-Control-Allow-Headers": {"X-Custom"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			testOpts := opts
+			if test.opts != nil {
+				testOpts = *test.opts
+			}
+			handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), testOpts)
+			req := httptest.NewRequest(test.method, "/", nil)
+			req.Header = test.header
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != test.expectedCode {
+				t.Errorf("expected code %d, got: %d", test.expectedCode, rec.Code)
+			}
+			if test.expectedCode == http.StatusForbidden {
+				return
+			}
+			for key := range rec.Header() {
+				if _, ok := test.expectedHeader[key]; !ok {
+					t.Errorf("unexpected header %s: %s", key, rec.Header()[key])
+				}
+			}
+			for key, values := range test.expectedHeader {
+				if strings.Join(rec.Header()[key], "|") != strings.Join(values, "|") {
+					t.Errorf("expected header %s: %s, got: %s", key, values, rec.Header()[key])
+				}
+			}
+		})
+	}
+}
+
+func TestCORSOptionsValidate(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		opts          corsOptions
+		expectedError string
+	}{
+		{
+			name: "credentials",
+			opts: corsOptions{AllowedOrigins: []string{"https://example.com"}, AllowCredentials: true},
+		},
+		{
+			name: "all_origins",
+			opts: corsOptions{AllowedOrigins: []string{"*"}},
+		},
+		{
+			name:          "all_origins_with_credentials",
+			opts:          corsOptions{AllowedOrigins: []string{"https://example.com", "*"}, AllowCredentials: true},
+			expectedError: "credentials can't be allowed for all origins",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.opts.validate()
+			if test.expectedError == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+				t.Errorf("expected error '%s', got %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestCORSAllowOrigin(t *testing.T) {
+	opts := corsOptions{AllowedOrigins: []string{"https://example.com", "https://*.example.org", "*.example.net", "example.io"}}
+	for _, test := range []struct {
+		origin   string
+		expected bool
+	}{
+		{origin: "https://example.com", expected: true},
+		{origin: "http://example.com", expected: false},
+		{origin: "https://api.example.org", expected: true},
+		{origin: "https://example.org", expected: false},
+		{origin: "http://api.example.org", expected: false},
+		{origin: "https://api.example.net", expected: true},
+		{origin: "http://api.example.net:8080", expected: false},
+		{origin: "http://a.b.example.net", expected: true},
+		{origin: "https://example.net", expected: false},
+		{origin: "https://example.io", expected: true},
+		{origin: "https://api.example.io", expected: false},
+	} {
+		t.Run(test.origin, func(t *testing.T) {
+			if allowed := opts.allowOrigin(test.origin); allowed != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, allowed)
+			}
+		})
+	}
+}
@@ -1,3 +1,5 @@
 module http-server
 
-go 1.21.1
+go 1.24.0
+
+require golang.org/x/crypto v0.45.0
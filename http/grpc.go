@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcStatusNames are the names of the gRPC status codes.
+// see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+var grpcStatusNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// isGRPCRequest reports whether the request is a gRPC call.
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatusAttrs returns the access log attributes for the gRPC status of a
+// response. The status is usually sent as trailer, only responses without
+// messages send it in the header. It returns nil if the response has no
+// gRPC status.
+func grpcStatusAttrs(header http.Header) []slog.Attr {
+	status := header.Get("Grpc-Status")
+	if status == "" {
+		// trailers which were not announced before the body
+		status = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if status == "" {
+		return nil
+	}
+	attrs := []slog.Attr{slog.String("grpc_status", status)}
+	if code, err := strconv.Atoi(status); err == nil && code >= 0 && code < len(grpcStatusNames) {
+		attrs = append(attrs, slog.String("grpc_code", grpcStatusNames[code]))
+	}
+	if message := header.Get("Grpc-Message"); message != "" {
+		attrs = append(attrs, slog.String("grpc_message", message))
+	}
+	return attrs
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newH2CServer(t *testing.T, handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestH2CUpstream(t *testing.T) {
+	upstream := newH2CServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "expected HTTP/2, got "+r.Proto, http.StatusHTTPVersionNotSupported)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "not found")
+	}))
+
+	opts := defaultUpstreamPoolOptions()
+	opts.Protocol = protocolH2C
+	pool, err := newUpstreamPool([]string{upstream.URL}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logOutput := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(logOutput, nil))
+	proxy := newH2CServer(t, logHandler(forwardCustomTransportHandler(pool, headerRules{}), logger, nil))
+
+	transport, err := newUpstreamTransport(protocolH2C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	req, _ := http.NewRequest("POST", proxy.URL+"/package.Service/Method", strings.NewReader("message"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "message" {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "5" {
+		t.Errorf("expected grpc-status trailer, got: %v", resp.Trailer)
+	}
+	for _, expected := range []string{"proto=HTTP/2.0", "grpc_status=5", "grpc_code=NOT_FOUND", `grpc_message="not found"`} {
+		if !strings.Contains(logOutput.String(), expected) {
+			t.Errorf("expected access log to contain %s, got: %s", expected, logOutput)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// header rule actions
+const (
+	headerSet    = "set"
+	headerAppend = "append"
+	headerDelete = "delete"
+	headerRename = "rename"
+)
+
+// headerRule sets, appends, deletes or renames a header. Value is the new
+// header name for rename and a template for set and append. Templates can
+// contain the placeholders of headerTemplateValues, e.g. {client_ip}.
+type headerRule struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+}
+
+func (h headerRule) String() string {
+	if h.Value == "" {
+		return h.Action + " " + h.Name
+	}
+	return h.Action + " " + h.Name + "=" + h.Value
+}
+
+// parseHeaderRule parses a rule in the format "action name[=value]", e.g.
+// "set X-Client-IP={client_ip}" or "rename X-Old=X-New".
+func parseHeaderRule(value string) (headerRule, error) {
+	action, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	name, value, _ := strings.Cut(strings.TrimSpace(rest), "=")
+	rule := headerRule{
+		Action: action,
+		Name:   strings.TrimSpace(name),
+		Value:  value,
+	}
+	return rule, rule.validate()
+}
+
+func (h headerRule) validate() error {
+	if h.Name == "" {
+		return fmt.Errorf("header rule '%s': header name required", h)
+	}
+	switch h.Action {
+	case headerSet, headerAppend:
+		_, err := expandHeaderTemplate(h.Value, nil)
+		if err != nil {
+			return fmt.Errorf("header rule '%s': %w", h, err)
+		}
+	case headerDelete:
+	case headerRename:
+		if h.Value == "" {
+			return fmt.Errorf("header rule '%s': new header name required", h)
+		}
+	default:
+		return fmt.Errorf("header rule '%s': unknown action '%s'", h, h.Action)
+	}
+	return nil
+}
+
+// headerRules are applied to proxied requests before they are sent to the
+// upstream and to the upstream responses.
+type headerRules struct {
+	Request  []headerRule `json:"request,omitempty"`
+	Response []headerRule `json:"response,omitempty"`
+}
+
+func (h headerRules) validate() error {
+	errs := []error{}
+	for _, rule := range append(h.Request, h.Response...) {
+		errs = append(errs, rule.validate())
+	}
+	return errors.Join(errs...)
+}
+
+// merge returns the rules of h followed by the rules of other.
+func (h headerRules) merge(other headerRules) headerRules {
+	return headerRules{
+		Request:  append(append([]headerRule{}, h.Request...), other.Request...),
+		Response: append(append([]headerRule{}, h.Response...), other.Response...),
+	}
+}
+
+// applyHeaderRules applies the rules to header. The template values are
+// taken from r.
+func applyHeaderRules(rules []headerRule, header http.Header, r *http.Request) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case headerSet, headerAppend:
+			// templates are validated when the rules are loaded
+			value, _ := expandHeaderTemplate(rule.Value, r)
+			if rule.Action == headerSet {
+				header.Set(rule.Name, value)
+			} else {
+				header.Add(rule.Name, value)
+			}
+		case headerDelete:
+			header.Del(rule.Name)
+		case headerRename:
+			values := header.Values(rule.Name)
+			if len(values) == 0 {
+				continue
+			}
+			header.Del(rule.Name)
+			header[http.CanonicalHeaderKey(rule.Value)] = values
+		}
+	}
+}
+
+// headerTemplateValues are the placeholders which can be used in header
+// rule templates.
+var headerTemplateValues = map[string]func(r *http.Request) string{
+	"client_ip": getClientIP,
+	"request_id": func(r *http.Request) string {
+		return getRequestID(r.Context()).String()
+	},
+	"route": func(r *http.Request) string {
+		if route := getProxyRoute(r.Context()); route != nil {
+			return route.String()
+		}
+		return ""
+	},
+	"upstream": func(r *http.Request) string {
+		if u := getUpstream(r.Context()); u != nil {
+			return u.URL.Host
+		}
+		return ""
+	},
+	"host": func(r *http.Request) string {
+		return r.Host
+	},
+	"method": func(r *http.Request) string {
+		return r.Method
+	},
+	"path": func(r *http.Request) string {
+		return r.URL.Path
+	},
+}
+
+// expandHeaderTemplate replaces the {name} placeholders in template with the
+// values of r. If r is nil the template is only validated.
+func expandHeaderTemplate(template string, r *http.Request) (string, error) {
+	if !strings.Contains(template, "{") {
+		return template, nil
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unclosed placeholder in '%s'", template)
+		}
+		name := template[start+1 : start+end]
+		value, ok := headerTemplateValues[name]
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder '{%s}'", name)
+		}
+		b.WriteString(template[:start])
+		if r != nil {
+			b.WriteString(value(r))
+		}
+		template = template[start+end+1:]
+	}
+	b.WriteString(template)
+	return b.String(), nil
+}
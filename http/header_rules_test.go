@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		rules    []string
+		header   http.Header
+		expected http.Header
+	}{
+		{
+			name:     "set",
+			rules:    []string{"set X-Client-IP={client_ip}", "set X-Request={method} {host}{path}"},
+			header:   http.Header{"X-Client-Ip": {"spoofed"}},
+			expected: http.Header{"X-Client-Ip": {"192.0.2.1"}, "X-Request": {"GET example.com/path"}},
+		},
+		{
+			name:     "append",
+			rules:    []string{"append Via=proxy"},
+			header:   http.Header{"Via": {"1.1 other"}},
+			expected: http.Header{"Via": {"1.1 other", "proxy"}},
+		},
+		{
+			name:     "delete",
+			rules:    []string{"delete Server", "delete Missing"},
+			header:   http.Header{"Server": {"upstream"}, "Other": {"value"}},
+			expected: http.Header{"Other": {"value"}},
+		},
+		{
+			name:     "rename",
+			rules:    []string{"rename X-Old=x-new", "rename X-Missing=X-Other"},
+			header:   http.Header{"X-Old": {"1", "2"}},
+			expected: http.Header{"X-New": {"1", "2"}},
+		},
+		{
+			name:     "empty_request_id",
+			rules:    []string{"set X-Request-Id={request_id}"},
+			header:   http.Header{},
+			expected: http.Header{"X-Request-Id": {""}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rules := []headerRule{}
+			for _, raw := range test.rules {
+				rule, err := parseHeaderRule(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rules = append(rules, rule)
+			}
+			r := httptest.NewRequest("GET", "http://example.com/path", nil)
+			ctx := context.WithValue(r.Context(), clientInfoKey, clientInfo{IP: netip.MustParseAddr("192.0.2.1")})
+			applyHeaderRules(rules, test.header, r.WithContext(ctx))
+			if !reflect.DeepEqual(test.header, test.expected) {
+				t.Errorf("expected: %v, got: %v", test.expected, test.header)
+			}
+		})
+	}
+}
+
+func TestParseHeaderRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"set",
+		"replace X-Name=value",
+		"rename X-Name",
+		"set X-Name={unknown}",
+		"set X-Name={client_ip",
+	} {
+		_, err := parseHeaderRule(rule)
+		if err == nil {
+			t.Errorf("expected error for rule '%s'", rule)
+		}
+	}
+}
+
+func TestForwardHandlerHeaderRules(t *testing.T) {
+	upstreams := newTestUpstreams(t, 1, func(i int, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Request-Id", r.Header.Get("X-Request-Id"))
+		w.Header().Set("Server", "upstream")
+	})
+	pool, err := newUpstreamPool(upstreams, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := headerRules{
+		Request:  []headerRule{{Action: headerSet, Name: "X-Request-Id", Value: "{request_id}"}},
+		Response: []headerRule{{Action: headerDelete, Name: "Server"}, {Action: headerRename, Name: "X-Seen-Request-Id", Value: "X-Upstream-Request-Id"}},
+	}
+	handler := requestIDMiddleware(forwardHandler(pool, headers), nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("Server") != "" {
+		t.Errorf("expected Server header to be deleted, got: %s", rec.Header().Get("Server"))
+	}
+	if len(rec.Header().Get("X-Upstream-Request-Id")) != 22 {
+		t.Errorf("expected request id to be forwarded, got: %v", rec.Header())
+	}
+}
+
+func TestProxyHandlerResponseHeaderTemplates(t *testing.T) {
+	upstreams := newTestUpstreams(t, 1, nil)
+	pool, err := newUpstreamPool(upstreams, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := headerRules{
+		Response: []headerRule{
+			{Action: headerSet, Name: "X-Host", Value: "{host}"},
+			{Action: headerSet, Name: "X-Path", Value: "{path}"},
+		},
+	}
+	route := &compiledRoute{proxyRoute: proxyRoute{PathPrefix: "/api", StripPrefix: true}}
+	for _, test := range []struct {
+		name    string
+		handler http.Handler
+	}{
+		{
+			name:    "forward",
+			handler: forwardHandler(pool, headers),
+		},
+		{
+			name:    "custom_transport",
+			handler: forwardCustomTransportHandler(pool, headers),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/api/users", nil)
+			req = req.WithContext(context.WithValue(req.Context(), proxyRouteKey, route))
+			rec := httptest.NewRecorder()
+			test.handler.ServeHTTP(rec, req)
+			if host := rec.Header().Get("X-Host"); host != "example.com" {
+				t.Errorf("expected host 'example.com', got '%s'", host)
+			}
+			if path := rec.Header().Get("X-Path"); path != "/api/users" {
+				t.Errorf("expected path '/api/users', got '%s'", path)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// healthCheck is a named check of a component.
+type healthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+	// Timeout is the timeout of a single run of the check.
+	Timeout time.Duration
+	// Interval is the time between the runs of the check.
+	Interval time.Duration
+	// Critical checks have to pass for the server to be ready.
+	Critical bool
+}
+
+type healthCheckResult struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Critical  bool      `json:"critical"`
+	Latency   string    `json:"latency"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// health status values
+const (
+	healthStatusOK       = "ok"
+	healthStatusFailed   = "failed"
+	healthStatusDegraded = "degraded"
+	healthStatusPending  = "pending"
+	healthStatusDraining = "draining"
+)
+
+type healthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks"`
+}
+
+// healthChecker runs the registered checks in the background and serves the
+// cached results at /healthz (liveness) and /readyz (readiness).
+type healthChecker struct {
+	mu      sync.Mutex
+	checks  []healthCheck
+	results map[string]healthCheckResult
+	// draining is set during the shutdown, so that load balancers stop
+	// sending new requests.
+	draining atomic.Bool
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		results: map[string]healthCheckResult{},
+	}
+}
+
+// Register adds a check. Checks have to be registered before start.
+func (h *healthChecker) Register(check healthCheck) {
+	if check.Timeout <= 0 {
+		check.Timeout = 5 * time.Second
+	}
+	if check.Interval <= 0 {
+		check.Interval = 10 * time.Second
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, check)
+	h.results[check.Name] = healthCheckResult{
+		Status:   healthStatusPending,
+		Critical: check.Critical,
+	}
+}
+
+// start runs the checks until ctx is done.
+func (h *healthChecker) start(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, check := range h.checks {
+		go h.runCheck(ctx, check)
+	}
+}
+
+func (h *healthChecker) runCheck(ctx context.Context, check healthCheck) {
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+	for {
+		h.checkOnce(ctx, check)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *healthChecker) checkOnce(ctx context.Context, check healthCheck) {
+	checkCtx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := check.Check(checkCtx)
+	result := healthCheckResult{
+		Status:    healthStatusOK,
+		Critical:  check.Critical,
+		Latency:   time.Since(start).String(),
+		CheckedAt: start,
+	}
+	if err != nil {
+		result.Status = healthStatusFailed
+		result.Error = err.Error()
+	}
+
+	h.mu.Lock()
+	previous := h.results[check.Name]
+	h.results[check.Name] = result
+	h.mu.Unlock()
+	if previous.Status != result.Status {
+		slog.LogAttrs(ctx, slog.LevelInfo, "health check changed", slog.String("check", check.Name), slog.String("status", result.Status), slog.Any("err", err))
+	}
+}
+
+// setDraining marks the server as not ready at the beginning of the
+// shutdown.
+func (h *healthChecker) setDraining() {
+	h.draining.Store(true)
+}
+
+// status returns the results of all checks or of the critical checks only.
+// It reports whether the critical checks passed. Pending checks did not pass
+// yet.
+func (h *healthChecker) status(criticalOnly bool) (healthResponse, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	resp := healthResponse{
+		Status: healthStatusOK,
+		Checks: map[string]healthCheckResult{},
+	}
+	ok := true
+	for name, result := range h.results {
+		if criticalOnly && !result.Critical {
+			continue
+		}
+		resp.Checks[name] = result
+		if result.Status == healthStatusOK {
+			continue
+		}
+		if result.Critical {
+			ok = false
+			resp.Status = healthStatusFailed
+		} else if ok {
+			resp.Status = healthStatusDegraded
+		}
+	}
+	return resp, ok
+}
+
+// handler serves /healthz and /readyz and passes other requests to next.
+// /healthz is 200 while the server is alive and shows all checks. /readyz
+// shows the critical checks and is 503 if one of them did not pass or the
+// server is draining. The paths are answered before next, so requests to
+// /healthz and /readyz never reach next.
+func (h *healthChecker) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			resp, _ := h.status(false)
+			writeJSON(w, r, http.StatusOK, resp)
+		case "/readyz":
+			resp, ok := h.status(true)
+			if h.draining.Load() {
+				resp.Status = healthStatusDraining
+				ok = false
+			}
+			code := http.StatusOK
+			if !ok {
+				code = http.StatusServiceUnavailable
+			}
+			writeJSON(w, r, code, resp)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// diskSpaceCheck fails if the file system of path has less than minFree
+// bytes available.
+func diskSpaceCheck(path string, minFree uint64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		stat := syscall.Statfs_t{}
+		if err := syscall.Statfs(path, &stat); err != nil {
+			return err
+		}
+		free := stat.Bavail * uint64(stat.Bsize)
+		if free < minFree {
+			return fmt.Errorf("%d bytes free, need %d", free, minFree)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failed := func(ctx context.Context) error { return errors.New("unavailable") }
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	for _, test := range []struct {
+		name               string
+		checks             []healthCheck
+		draining           bool
+		path               string
+		expectedCode       int
+		expectedStatus     string
+		expectedChecks     map[string]string
+		expectedCheckError string
+	}{
+		{
+			name:           "healthy",
+			checks:         []healthCheck{{Name: "db", Check: ok, Critical: true}, {Name: "disk", Check: ok}},
+			path:           "/readyz",
+			expectedCode:   http.StatusOK,
+			expectedStatus: healthStatusOK,
+			expectedChecks: map[string]string{"db": healthStatusOK},
+		},
+		{
+			name:           "critical_failed",
+			checks:         []healthCheck{{Name: "db", Check: failed, Critical: true}, {Name: "disk", Check: ok}},
+			path:           "/readyz",
+			expectedCode:   http.StatusServiceUnavailable,
+			expectedStatus: healthStatusFailed,
+			expectedChecks: map[string]string{"db": healthStatusFailed},
+		},
+		{
+			name:           "not_critical_failed",
+			checks:         []healthCheck{{Name: "db", Check: ok, Critical: true}, {Name: "disk", Check: failed}},
+			path:           "/readyz",
+			expectedCode:   http.StatusOK,
+			expectedStatus: healthStatusOK,
+			expectedChecks: map[string]string{"db": healthStatusOK},
+		},
+		{
+			name:           "liveness_degraded",
+			checks:         []healthCheck{{Name: "db", Check: ok, Critical: true}, {Name: "disk", Check: failed}},
+			path:           "/healthz",
+			expectedCode:   http.StatusOK,
+			expectedStatus: healthStatusDegraded,
+			expectedChecks: map[string]string{"db": healthStatusOK, "disk": healthStatusFailed},
+		},
+		{
+			name:           "liveness_critical_failed",
+			checks:         []healthCheck{{Name: "db", Check: failed, Critical: true}},
+			path:           "/healthz",
+			expectedCode:   http.StatusOK,
+			expectedStatus: healthStatusFailed,
+			expectedChecks: map[string]string{"db": healthStatusFailed},
+		},
+		{
+			name:               "timeout",
+			checks:             []healthCheck{{Name: "db", Check: slow, Critical: true, Timeout: 10 * time.Millisecond}},
+			path:               "/readyz",
+			expectedCode:       http.StatusServiceUnavailable,
+			expectedStatus:     healthStatusFailed,
+			expectedChecks:     map[string]string{"db": healthStatusFailed},
+			expectedCheckError: context.DeadlineExceeded.Error(),
+		},
+		{
+			name:           "draining",
+			checks:         []healthCheck{{Name: "db", Check: ok, Critical: true}},
+			draining:       true,
+			path:           "/readyz",
+			expectedCode:   http.StatusServiceUnavailable,
+			expectedStatus: healthStatusDraining,
+			expectedChecks: map[string]string{"db": healthStatusOK},
+		},
+		{
+			name:           "no_checks",
+			path:           "/readyz",
+			expectedCode:   http.StatusOK,
+			expectedStatus: healthStatusOK,
+			expectedChecks: map[string]string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHealthChecker()
+			for _, check := range test.checks {
+				h.Register(check)
+				h.checkOnce(context.Background(), h.checks[len(h.checks)-1])
+			}
+			if test.draining {
+				h.setDraining()
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})
+			w := httptest.NewRecorder()
+			h.handler(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != test.expectedCode {
+				t.Errorf("expected status code %d, got %d", test.expectedCode, w.Code)
+			}
+			resp := healthResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != test.expectedStatus {
+				t.Errorf("expected status '%s', got '%s'", test.expectedStatus, resp.Status)
+			}
+			if len(resp.Checks) != len(test.expectedChecks) {
+				t.Errorf("expected checks %v, got %v", test.expectedChecks, resp.Checks)
+			}
+			for name, status := range test.expectedChecks {
+				result := resp.Checks[name]
+				if result.Status != status {
+					t.Errorf("expected check %s to be '%s', got '%s'", name, status, result.Status)
+				}
+				if result.Latency == "" || result.CheckedAt.IsZero() {
+					t.Errorf("expected latency and time of check %s, got %+v", name, result)
+				}
+				if test.expectedCheckError != "" && result.Error != test.expectedCheckError {
+					t.Errorf("expected error '%s', got '%s'", test.expectedCheckError, result.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCheckerPending(t *testing.T) {
+	h := newHealthChecker()
+	h.Register(healthCheck{Name: "db", Check: func(ctx context.Context) error { return nil }, Critical: true})
+	if _, ok := h.status(true); ok {
+		t.Error("expected pending critical check to fail the readiness")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.start(ctx)
+	for {
+		if _, ok := h.status(true); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	h.handler(nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
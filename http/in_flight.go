@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errCanceledByAdmin is the cause of the context of requests which are
+// canceled on the admin endpoint.
+var errCanceledByAdmin = errors.New("request canceled by admin")
+
+// inFlightRequests tracks the requests which are currently served, so that
+// they can be inspected and canceled on the admin endpoint. Requests are
+// added by requestIDMiddleware, logHandler adds the client.
+type inFlightRequests struct {
+	mutex    sync.Mutex
+	requests map[requestID]*inFlightRequest
+}
+
+func newInFlightRequests() *inFlightRequests {
+	return &inFlightRequests{
+		requests: map[requestID]*inFlightRequest{},
+	}
+}
+
+type inFlightRequest struct {
+	id     requestID
+	method string
+	uri    string
+	start  time.Time
+	cancel context.CancelCauseFunc
+
+	mutex  sync.Mutex
+	client string
+	route  string
+}
+
+// add tracks the request until the returned function is called. The context
+// of the request has to be replaced with the returned context, it is
+// canceled if the request is canceled on the admin endpoint.
+func (f *inFlightRequests) add(r *http.Request, id requestID) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	req := &inFlightRequest{
+		id:     id,
+		method: r.Method,
+		uri:    r.RequestURI,
+		start:  time.Now(),
+		cancel: cancel,
+		client: r.RemoteAddr,
+	}
+	f.mutex.Lock()
+	f.requests[id] = req
+	f.mutex.Unlock()
+
+	return context.WithValue(ctx, inFlightRequestKey, req), func() {
+		f.mutex.Lock()
+		delete(f.requests, id)
+		f.mutex.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancel cancels the context of the request. It reports false if the request
+// is not in flight.
+func (f *inFlightRequests) cancel(id requestID) bool {
+	f.mutex.Lock()
+	req, ok := f.requests[id]
+	f.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	req.cancel(errCanceledByAdmin)
+	return true
+}
+
+type inFlightRequestStatus struct {
+	ID      string    `json:"id"`
+	Method  string    `json:"method"`
+	URI     string    `json:"uri"`
+	Client  string    `json:"client"`
+	Route   string    `json:"route,omitempty"`
+	Start   time.Time `json:"start"`
+	Elapsed string    `json:"elapsed"`
+}
+
+// status returns the in-flight requests, the longest running first.
+func (f *inFlightRequests) status() []inFlightRequestStatus {
+	f.mutex.Lock()
+	requests := make([]*inFlightRequest, 0, len(f.requests))
+	for _, req := range f.requests {
+		requests = append(requests, req)
+	}
+	f.mutex.Unlock()
+
+	slices.SortFunc(requests, func(a, b *inFlightRequest) int {
+		return a.start.Compare(b.start)
+	})
+	now := time.Now()
+	status := make([]inFlightRequestStatus, 0, len(requests))
+	for _, req := range requests {
+		req.mutex.Lock()
+		status = append(status, inFlightRequestStatus{
+			ID:      req.id.String(),
+			Method:  req.method,
+			URI:     req.uri,
+			Client:  req.client,
+			Route:   req.route,
+			Start:   req.start,
+			Elapsed: now.Sub(req.start).String(),
+		})
+		req.mutex.Unlock()
+	}
+	return status
+}
+
+type ctxKeyInFlightRequest int
+
+const inFlightRequestKey ctxKeyInFlightRequest = 0
+
+// updateInFlightRequest calls update with the in-flight request of the
+// context, if it is tracked.
+func updateInFlightRequest(ctx context.Context, update func(req *inFlightRequest)) {
+	if req, ok := ctx.Value(inFlightRequestKey).(*inFlightRequest); ok {
+		req.mutex.Lock()
+		update(req)
+		req.mutex.Unlock()
+	}
+}
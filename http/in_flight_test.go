@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInFlightRequests(t *testing.T) {
+	inFlight := newInFlightRequests()
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/requests", inFlightRequestsHandler(inFlight))
+	adminMux.Handle("/requests/{id}", cancelRequestHandler(inFlight))
+
+	started := make(chan struct{})
+	causes := make(chan error, 1)
+	app := newRouteRegistry()
+	app.HandleFunc("/slow/{n}", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		causes <- context.Cause(r.Context())
+	})
+	buf := &syncBuffer{}
+	handler := requestIDMiddleware(logHandler(app, slog.New(slog.NewTextHandler(buf, nil)), nil), inFlight)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow/1?duration=1h", nil))
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	adminMux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/requests", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	status := []inFlightRequestStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 {
+		t.Fatalf("expected one in-flight request, got %d", len(status))
+	}
+	req := status[0]
+	if req.ID == "" || req.Method != http.MethodGet || req.URI != "/slow/1?duration=1h" || req.Client != "192.0.2.1:1234" || req.Route != "/slow/{n}" || req.Elapsed == "" {
+		t.Errorf("unexpected in-flight request %+v", req)
+	}
+
+	for _, test := range []struct {
+		name         string
+		method       string
+		id           string
+		expectedCode int
+	}{
+		{name: "method_not_allowed", method: http.MethodPost, id: req.ID, expectedCode: http.StatusMethodNotAllowed},
+		{name: "invalid_id", method: http.MethodDelete, id: "invalid", expectedCode: http.StatusBadRequest},
+		{name: "unknown_id", method: http.MethodDelete, id: "AAAAAAAAAAAAAAAAAAAAAA", expectedCode: http.StatusNotFound},
+		{name: "cancel", method: http.MethodDelete, id: req.ID, expectedCode: http.StatusNoContent},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			adminMux.ServeHTTP(w, httptest.NewRequest(test.method, "/requests/"+test.id, nil))
+			if w.Code != test.expectedCode {
+				t.Errorf("expected status code %d, got %d", test.expectedCode, w.Code)
+			}
+		})
+	}
+
+	if cause := <-causes; !errors.Is(cause, errCanceledByAdmin) {
+		t.Errorf("expected cause %v, got %v", errCanceledByAdmin, cause)
+	}
+	<-done
+	if !strings.Contains(buf.String(), `code=499 `) || !strings.Contains(buf.String(), `err="request canceled by admin"`) {
+		t.Errorf("expected canceled request in access log, got %s", buf.String())
+	}
+	if status := inFlight.status(); len(status) != 0 {
+		t.Errorf("expected no in-flight requests, got %+v", status)
+	}
+}
+
+func TestParseRequestID(t *testing.T) {
+	id := requestID{1, 2, 3}
+	parsed, err := parseRequestID(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != id {
+		t.Errorf("expected %s, got %s", id, parsed)
+	}
+	if _, err := parseRequestID("AAAA"); err == nil {
+		t.Error("expected error for short request ID")
+	}
+}
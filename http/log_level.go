@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// logLevels are the levels logLevelController.Cycle walks through.
+var logLevels = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+// logLevelController holds the log level of a logger and allows to change it
+// at runtime. Changes can be reverted automatically to the configured level
+// after a timeout, so a forgotten debug level does not flood the logs.
+type logLevelController struct {
+	level *slog.LevelVar
+
+	mu          sync.Mutex
+	configured  slog.Level
+	revertTimer *time.Timer
+	// generation is incremented on each change, so that a revert timer
+	// which already fired does not undo a newer change
+	generation uint64
+}
+
+func newLogLevelController(level slog.Level) *logLevelController {
+	levelVar := &slog.LevelVar{}
+	levelVar.Set(level)
+	return &logLevelController{
+		level:      levelVar,
+		configured: level,
+	}
+}
+
+// Leveler returns the slog.Leveler to use in slog.HandlerOptions.
+func (c *logLevelController) Leveler() slog.Leveler {
+	return c.level
+}
+
+// Level returns the current log level.
+func (c *logLevelController) Level() slog.Level {
+	return c.level.Level()
+}
+
+// Set sets the log level. If revertAfter is greater than zero the level is
+// set back to the configured level after that duration.
+func (c *logLevelController) Set(level slog.Level, revertAfter time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(level, revertAfter)
+}
+
+// Configure sets the configured level and the current level, e.g. after the
+// config was reloaded. It replaces a pending revert.
+func (c *logLevelController) Configure(level slog.Level) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configured = level
+	c.set(level, 0)
+}
+
+// Cycle sets the next level of logLevels (DEBUG, INFO, WARN, ERROR) and
+// starts over with DEBUG after ERROR. It returns the new level.
+func (c *logLevelController) Cycle(revertAfter time.Duration) slog.Level {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := logLevels[0]
+	current := c.level.Level()
+	for _, level := range logLevels {
+		if level > current {
+			next = level
+			break
+		}
+	}
+	c.set(next, revertAfter)
+	return next
+}
+
+func (c *logLevelController) set(level slog.Level, revertAfter time.Duration) {
+	if c.revertTimer != nil {
+		c.revertTimer.Stop()
+		c.revertTimer = nil
+	}
+	c.generation++
+	c.level.Set(level)
+	if revertAfter <= 0 || level == c.configured {
+		return
+	}
+	generation := c.generation
+	c.revertTimer = time.AfterFunc(revertAfter, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.generation != generation {
+			return
+		}
+		c.revertTimer = nil
+		c.level.Set(c.configured)
+		slog.Info("reverted log level", "level", c.configured)
+	})
+}
+
+// handleSignals cycles the log level on each SIGUSR1 until ctx is done.
+func (c *logLevelController) handleSignals(ctx context.Context, revertAfter time.Duration) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			level := c.Cycle(revertAfter)
+			// log with warn to make sure the change is always visible
+			slog.Warn("changed log level", "level", level, "revert_after", revertAfter)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevelControllerCycle(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		current  slog.Level
+		expected slog.Level
+	}{
+		{
+			name:     "debug",
+			current:  slog.LevelDebug,
+			expected: slog.LevelInfo,
+		},
+		{
+			name:     "error",
+			current:  slog.LevelError,
+			expected: slog.LevelDebug,
+		},
+		{
+			name:     "custom",
+			current:  slog.LevelInfo + 2,
+			expected: slog.LevelWarn,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newLogLevelController(test.current)
+			level := c.Cycle(0)
+			if level != test.expected || c.Level() != test.expected {
+				t.Errorf("expected: %s, got: %s", test.expected, c.Level())
+			}
+		})
+	}
+}
+
+func TestLogLevelControllerRevert(t *testing.T) {
+	c := newLogLevelController(slog.LevelInfo)
+	c.Set(slog.LevelDebug, 10*time.Millisecond)
+	if c.Level() != slog.LevelDebug {
+		t.Fatalf("expected: %s, got: %s", slog.LevelDebug, c.Level())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c.Level() != slog.LevelInfo {
+		t.Fatalf("expected: %s, got: %s", slog.LevelInfo, c.Level())
+	}
+}
+
+func TestLogLevelControllerStaleRevert(t *testing.T) {
+	c := newLogLevelController(slog.LevelInfo)
+	c.Set(slog.LevelDebug, 10*time.Millisecond)
+
+	// the revert timer fires while a newer change holds the lock
+	c.mu.Lock()
+	time.Sleep(50 * time.Millisecond)
+	c.set(slog.LevelWarn, 0)
+	c.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	if c.Level() != slog.LevelWarn {
+		t.Fatalf("expected: %s, got: %s", slog.LevelWarn, c.Level())
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		body          string
+		expectedCode  int
+		expectedLevel slog.Level
+	}{
+		{
+			name:          "set",
+			body:          `{"level": "WARN"}`,
+			expectedCode:  http.StatusOK,
+			expectedLevel: slog.LevelWarn,
+		},
+		{
+			name:          "info",
+			body:          `{"level": "INFO"}`,
+			expectedCode:  http.StatusOK,
+			expectedLevel: slog.LevelInfo,
+		},
+		{
+			name:          "missing_level",
+			body:          `{}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedLevel: slog.LevelDebug,
+		},
+		{
+			name:          "invalid_level",
+			body:          `{"level": "LOUD"}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedLevel: slog.LevelDebug,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newLogLevelController(slog.LevelDebug)
+			w := httptest.NewRecorder()
+			logLevelHandler(c, 0).ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/log-level", strings.NewReader(test.body)))
+			if w.Code != test.expectedCode {
+				t.Errorf("expected status code %d, got %d", test.expectedCode, w.Code)
+			}
+			if c.Level() != test.expectedLevel {
+				t.Errorf("expected: %s, got: %s", test.expectedLevel, c.Level())
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRedactPattern matches attribute keys whose values get masked.
+const defaultRedactPattern = `(?i)authorization|password|passwd|secret|token|cookie|api[-_]?key`
+
+const redactedValue = "REDACTED"
+
+// newLogHandler returns a slog.Handler for the given format and output.
+// Supported formats are text, logfmt (an alias for text), json and pretty.
+// The output is either stderr, stdout or a file path. The returned close
+// function has to be called once the handler is not used anymore.
+func newLogHandler(format string, output string, addSource bool, level slog.Leveler) (slog.Handler, func() error, error) {
+	var (
+		w       io.Writer
+		closeFn = func() error { return nil }
+	)
+	switch output {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open log output: %w", err)
+		}
+		w = f
+		closeFn = f.Close
+	}
+
+	opts := &slog.HandlerOptions{
+		AddSource: addSource,
+		Level:     level,
+	}
+
+	switch format {
+	case "", "text", "logfmt":
+		return slog.NewTextHandler(w, opts), closeFn, nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), closeFn, nil
+	case "pretty":
+		return newPrettyHandler(w, isTerminal(w), opts), closeFn, nil
+	default:
+		closeFn()
+		return nil, nil, fmt.Errorf("unknown log format '%s': use text, logfmt, json or pretty", format)
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+var _ slog.Handler = (*redactHandler)(nil)
+
+// redactHandler masks the values of all attributes with a key matching
+// pattern. This includes attributes in groups and the attributes returned by
+// a slog.LogValuer.
+type redactHandler struct {
+	slog.Handler
+	pattern *regexp.Regexp
+}
+
+func newRedactHandler(h slog.Handler, pattern *regexp.Regexp) slog.Handler {
+	if pattern == nil || pattern.String() == "" {
+		return h
+	}
+	return &redactHandler{
+		Handler: h,
+		pattern: pattern,
+	}
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	newRecord := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		newRecord.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, newRecord)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.redact(a))
+	}
+	return &redactHandler{
+		Handler: h.Handler.WithAttrs(redacted),
+		pattern: h.pattern,
+	}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{
+		Handler: h.Handler.WithGroup(name),
+		pattern: h.pattern,
+	}
+}
+
+func (h *redactHandler) redact(a slog.Attr) slog.Attr {
+	if a.Key != "" && h.pattern.MatchString(a.Key) {
+		return slog.String(a.Key, redactedValue)
+	}
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup {
+		return a
+	}
+	group := a.Value.Group()
+	redacted := make([]slog.Attr, 0, len(group))
+	for _, ga := range group {
+		redacted = append(redacted, h.redact(ga))
+	}
+	a.Value = slog.GroupValue(redacted...)
+	return a
+}
+
+const (
+	colorReset  = "\033[0m"
+	colorGray   = "\033[90m"
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorBlue   = "\033[34m"
+	colorCyan   = "\033[36m"
+)
+
+var _ slog.Handler = (*prettyHandler)(nil)
+
+// prettyHandler writes human readable log lines. If color is set the level
+// and the attribute keys are colored. It is meant for development on a
+// terminal.
+type prettyHandler struct {
+	opts   slog.HandlerOptions
+	color  bool
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	attrs  []byte
+}
+
+func newPrettyHandler(w io.Writer, color bool, opts *slog.HandlerOptions) *prettyHandler {
+	if opts == nil {
+		opts = &slog.HandlerOptions{}
+	}
+	return &prettyHandler{
+		opts:  *opts,
+		color: color,
+		mu:    &sync.Mutex{},
+		w:     w,
+	}
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = slices.Clip(h.attrs)
+	for _, a := range attrs {
+		h2.attrs = h2.appendAttr(h2.attrs, h2.prefix, a)
+	}
+	return &h2
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+func (h *prettyHandler) Handle(_ context.Context, r slog.Record) error {
+	buf := make([]byte, 0, 256)
+	if !r.Time.IsZero() {
+		buf = h.appendColored(buf, colorGray, r.Time.Format(time.TimeOnly+".000"))
+		buf = append(buf, ' ')
+	}
+	buf = h.appendColored(buf, levelColor(r.Level), fmt.Sprintf("%-5s", r.Level.String()))
+	buf = append(buf, ' ')
+	if h.opts.AddSource && r.PC != 0 {
+		frames := runtime.CallersFrames([]uintptr{r.PC})
+		frame, _ := frames.Next()
+		buf = h.appendColored(buf, colorGray, frame.File+":"+strconv.Itoa(frame.Line))
+		buf = append(buf, ' ')
+	}
+	buf = append(buf, r.Message...)
+	buf = append(buf, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		buf = h.appendAttr(buf, h.prefix, a)
+		return true
+	})
+	buf = append(buf, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf)
+	return err
+}
+
+func (h *prettyHandler) appendAttr(buf []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return buf
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			buf = h.appendAttr(buf, prefix, ga)
+		}
+		return buf
+	}
+	buf = append(buf, ' ')
+	buf = h.appendColored(buf, colorCyan, prefix+a.Key+"=")
+	value := a.Value.String()
+	if a.Value.Kind() == slog.KindTime {
+		value = a.Value.Time().Format(time.RFC3339Nano)
+	}
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		value = strconv.Quote(value)
+	}
+	return append(buf, value...)
+}
+
+func (h *prettyHandler) appendColored(buf []byte, color string, s string) []byte {
+	if !h.color {
+		return append(buf, s...)
+	}
+	buf = append(buf, color...)
+	buf = append(buf, s...)
+	return append(buf, colorReset...)
+}
+
+func levelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return colorRed
+	case level >= slog.LevelWarn:
+		return colorYellow
+	case level >= slog.LevelInfo:
+		return colorBlue
+	default:
+		return colorGray
+	}
+}
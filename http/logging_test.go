@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type secretLogValue struct{}
+
+func (secretLogValue) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("user", "alice"),
+		slog.String("password", "secret123"),
+	)
+}
+
+func TestRedactHandler(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		log         func(logger *slog.Logger)
+		expected    []string
+		notExpected []string
+	}{
+		{
+			name: "attr",
+			log: func(logger *slog.Logger) {
+				logger.Info("msg", "Authorization", "Bearer abc", "user", "alice")
+			},
+			expected:    []string{"Authorization=REDACTED", "user=alice"},
+			notExpected: []string{"abc"},
+		},
+		{
+			name: "group",
+			log: func(logger *slog.Logger) {
+				logger.Info("msg", slog.Group("header", slog.String("x-api-key", "abc"), slog.String("accept", "*/*")))
+			},
+			expected:    []string{"header.x-api-key=REDACTED", "header.accept=*/*"},
+			notExpected: []string{"abc"},
+		},
+		{
+			name: "with_attrs",
+			log: func(logger *slog.Logger) {
+				logger.With("token", "abc").WithGroup("g").Info("msg", "access_token", "abc")
+			},
+			expected:    []string{"token=REDACTED", "g.access_token=REDACTED"},
+			notExpected: []string{"abc"},
+		},
+		{
+			name: "log_valuer",
+			log: func(logger *slog.Logger) {
+				logger.Info("msg", "login", secretLogValue{}, "request", requestLogValue{httptest.NewRequest("GET", "/", nil)})
+			},
+			expected:    []string{"login.user=alice", "login.password=REDACTED", "request.method=GET"},
+			notExpected: []string{"secret123"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			h := newRedactHandler(slog.NewTextHandler(buf, nil), regexp.MustCompile(defaultRedactPattern))
+			test.log(slog.New(h))
+
+			out := buf.String()
+			for _, s := range test.expected {
+				if !strings.Contains(out, s) {
+					t.Errorf("expected '%s' in output: %s", s, out)
+				}
+			}
+			for _, s := range test.notExpected {
+				if strings.Contains(out, s) {
+					t.Errorf("unexpected '%s' in output: %s", s, out)
+				}
+			}
+		})
+	}
+}
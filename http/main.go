@@ -6,8 +6,10 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime/debug"
 	"syscall"
 	"time"
@@ -33,36 +35,268 @@ func main() {
 	}
 }
 
+// serverConfig holds the settings of the server. It is read from the config
+// file, the environment and the flags (see loadServerConfig).
+type serverConfig struct {
+	showVersion    bool
+	configFile     string
+	logLevel       slog.Level
+	logLevelRevert time.Duration
+	logFormat      string
+	logOutput      string
+	logSource      bool
+	logRedact      *regexp.Regexp
+	adminAddr      string
+
+	tailLog tailLogOptions
+
+	trustedProxies []netip.Prefix
+	clientIPHeader string
+	rateLimit      rateLimitOptions
+	concurrency    concurrencyLimitOptions
+	auth           authOptions
+	cors           corsOptions
+	compress       bool
+	compressOpts   compressOptions
+	staticOpts     staticOptions
+
+	tlsCert             string
+	tlsKey              string
+	h2c                 bool
+	shutdownGracePeriod time.Duration
+	shutdownDrainDelay  time.Duration
+	server              *http.Server
+
+	// health check settings
+	healthInterval    time.Duration
+	healthTimeout     time.Duration
+	healthMinDiskFree uint64
+	// healthUpstreams makes the upstreams check critical
+	healthUpstreams bool
+
+	// reverse proxy settings
+	upstreams     []string
+	poolOptions   upstreamPoolOptions
+	routesFile    string
+	routes        map[string]string
+	routeRewrites map[string]string
+	headers       headerRules
+	mirrorOpts    mirrorOptions
+	enableCache   bool
+	cacheOptions  responseCacheOptions
+}
+
+func newServerConfig() *serverConfig {
+	return &serverConfig{
+		logLevel:  slog.LevelDebug,
+		logFormat: "text",
+		logOutput: "stderr",
+		logRedact: regexp.MustCompile(defaultRedactPattern),
+		adminAddr: "localhost:8081",
+
+		clientIPHeader: clientIPHeaderXForwardedFor,
+
+		rateLimit:    defaultRateLimitOptions(),
+		concurrency:  defaultConcurrencyLimitOptions(),
+		auth:         defaultAuthOptions(),
+		cors:         defaultCORSOptions(),
+		compress:     true,
+		compressOpts: defaultCompressOptions(),
+		staticOpts:   defaultStaticOptions(),
+
+		shutdownGracePeriod: time.Minute,
+		server:              newDefaultServer(),
+
+		healthInterval:    10 * time.Second,
+		healthTimeout:     2 * time.Second,
+		healthMinDiskFree: uint64(100 << 20),
+
+		poolOptions:   defaultUpstreamPoolOptions(),
+		routes:        map[string]string{},
+		routeRewrites: map[string]string{},
+		mirrorOpts:    defaultMirrorOptions(),
+		cacheOptions:  defaultResponseCacheOptions(),
+	}
+}
+
+// loadServerConfig registers the flags of a new config in fs and sets them
+// from the config file, the environment and args. Later sources take
+// precedence.
+func loadServerConfig(fs *flag.FlagSet, args []string) (*serverConfig, error) {
+	c := newServerConfig()
+	c.registerFlags(fs)
+
+	err := readFlagsFromConfigFile(fs, "config", args, envPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readFlagsFromEnv(fs, envPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadProxyRoutes returns the proxy routes of the flags and the routes file.
+func (c *serverConfig) loadProxyRoutes() ([]proxyRoute, error) {
+	return loadProxyRoutes(c.routesFile, c.routes, c.routeRewrites, c.upstreams, c.headers)
+}
+
+func (c *serverConfig) registerFlags(fs *flag.FlagSet) {
+
+	fs.TextVar(&c.logLevel, "log-level", c.logLevel, "log level (DEBUG, INFO, WARN, ERROR)")
+	fs.DurationVar(&c.logLevelRevert, "log-level-revert", c.logLevelRevert, "revert log level changes at runtime (SIGUSR1 or admin endpoint) after this duration. 0 disables the revert")
+	fs.StringVar(&c.logFormat, "log-format", c.logFormat, "log format (text, logfmt, json, pretty)")
+	fs.StringVar(&c.logOutput, "log-output", c.logOutput, "log output (stderr, stdout or a file path)")
+	fs.BoolVar(&c.logSource, "log-source", c.logSource, "add source code position to log records")
+	fs.TextVar(c.logRedact, "log-redact", c.logRedact, "regular expression for attribute keys whose values get redacted in the logs")
+	fs.IntVar(&c.tailLog.BufferSize, "tail-log-size", c.tailLog.BufferSize, "number of DEBUG records buffered per request if the log level is above DEBUG. the buffer is only written for failed or slow requests. 0 disables the buffer")
+	fs.DurationVar(&c.tailLog.LatencyThreshold, "tail-log-latency", c.tailLog.LatencyThreshold, "write the buffered DEBUG records of requests which take longer than this duration. 0 disables the threshold")
+	fs.BoolVar(&c.showVersion, "version", c.showVersion, "print version and exit")
+	fs.StringVar(&c.configFile, "config", c.configFile, "config file (JSON, YAML or TOML) with flag values. environment variables and flags take precedence")
+	fs.StringVar(&c.adminAddr, "admin-addr", c.adminAddr, "listen address of the admin server. empty disables the admin server")
+
+	fs.StringVar(&c.server.Addr, "addr", c.server.Addr, "server listen address")
+	fs.Var(newFuncValue(func(s string) error {
+		prefixes, err := parsePrefixes(s)
+		if err != nil {
+			return err
+		}
+		c.trustedProxies = append(c.trustedProxies, prefixes...)
+		return nil
+	}, func() string {
+		return joinStrings(c.trustedProxies, ",")
+	}), "trusted-proxies", "comma separated list of CIDR prefixes of trusted proxies. the client IP is read from the -client-ip-header of requests from trusted proxies")
+	fs.StringVar(&c.clientIPHeader, "client-ip-header", c.clientIPHeader, "header of trusted proxies with the client IP: x-forwarded-for or forwarded. the other header is ignored")
+	fs.Float64Var(&c.rateLimit.Rate, "rate-limit", c.rateLimit.Rate, "requests per second per client. 0 disables the rate limit")
+	fs.IntVar(&c.rateLimit.Burst, "rate-limit-burst", c.rateLimit.Burst, "number of requests a client can send at once before the rate limit applies")
+	fs.Var(newMapValue(c.rateLimit.Routes, "=", " "), "rate-limit-route", "rate limit for a route in the format [host]/path-prefix=rate[,burst]. a rate of 0 disables the limit for the route. can be repeated")
+	fs.StringVar(&c.rateLimit.Key, "rate-limit-key", c.rateLimit.Key, "what identifies a client for rate limiting (ip, identity, header:<name>)")
+	fs.IntVar(&c.rateLimit.MaxKeys, "rate-limit-max-keys", c.rateLimit.MaxKeys, "maximum number of tracked clients. the least recently seen clients are forgotten first")
+	fs.IntVar(&c.concurrency.MaxConcurrency, "max-concurrency", c.concurrency.MaxConcurrency, "maximum number of requests which are served at the same time. 0 disables the limit")
+	fs.Var(newMapValue(c.concurrency.Routes, "=", " "), "max-concurrency-route", "additional concurrency limit for a route in the format [host]/path-prefix=limit. can be repeated")
+	fs.IntVar(&c.concurrency.QueueSize, "max-concurrency-queue-size", c.concurrency.QueueSize, "number of requests which wait for a free slot if a concurrency limit is reached. further requests are rejected with 503")
+	fs.DurationVar(&c.concurrency.QueueTimeout, "max-concurrency-queue-timeout", c.concurrency.QueueTimeout, "maximum time a request waits for a free slot")
+	fs.BoolVar(&c.concurrency.Adaptive, "adaptive-concurrency", c.concurrency.Adaptive, "lower the concurrency limits if the latency exceeds -adaptive-concurrency-latency-target and raise them again if it recovers")
+	fs.IntVar(&c.concurrency.MinConcurrency, "adaptive-concurrency-min", c.concurrency.MinConcurrency, "minimum of adaptive concurrency limits")
+	fs.DurationVar(&c.concurrency.LatencyTarget, "adaptive-concurrency-latency-target", c.concurrency.LatencyTarget, "time to first byte of requests above which adaptive concurrency limits are lowered. hijacked connections are ignored")
+	fs.StringVar(&c.auth.HtpasswdFile, "auth-htpasswd", c.auth.HtpasswdFile, "htpasswd file with bcrypt or SHA hashes for basic authentication. reloaded on change")
+	fs.StringVar(&c.auth.JWKS, "auth-jwks", c.auth.JWKS, "file or URL of a JWKS to verify JWT bearer tokens (RS256, ES256, EdDSA)")
+	fs.StringVar(&c.auth.JWTIssuer, "auth-jwt-issuer", c.auth.JWTIssuer, "required issuer (iss) of JWT bearer tokens")
+	fs.StringVar(&c.auth.JWTAudience, "auth-jwt-audience", c.auth.JWTAudience, "required audience (aud) of JWT bearer tokens")
+	fs.Var(newSliceValue(&c.auth.Allow, ","), "auth-allow", "allow only these authenticated users (basic auth user or token subject). can be repeated")
+	fs.StringVar(&c.auth.Realm, "auth-realm", c.auth.Realm, "realm for the authentication challenges")
+	fs.Var(newSliceValue(&c.cors.AllowedOrigins, ","), "cors-allowed-origins", "origins which are allowed to send cross-origin requests, e.g. https://example.com. https://*.example.com allows all subdomains and * all origins. origins without scheme match any scheme. can be repeated")
+	fs.TextVar(c.cors.AllowedOriginPattern, "cors-allowed-origin-regex", c.cors.AllowedOriginPattern, "regular expression for the origins which are allowed to send cross-origin requests. has to match the whole origin")
+	fs.Var(newSliceValue(&c.cors.AllowedMethods, ","), "cors-allowed-methods", "methods allowed in cross-origin requests. use - to remove the defaults. can be repeated")
+	fs.Var(newSliceValue(&c.cors.AllowedHeaders, ","), "cors-allowed-headers", "request headers allowed in cross-origin requests. * allows all headers. use - to remove the defaults. can be repeated")
+	fs.Var(newSliceValue(&c.cors.ExposedHeaders, ","), "cors-exposed-headers", "response headers which are exposed to cross-origin requests. can be repeated")
+	fs.BoolVar(&c.cors.AllowCredentials, "cors-allow-credentials", c.cors.AllowCredentials, "allow credentials (cookies, authorization) in cross-origin requests. not allowed together with the origin *")
+	fs.DurationVar(&c.cors.MaxAge, "cors-max-age", c.cors.MaxAge, "duration browsers can cache the result of preflight requests")
+	fs.BoolVar(&c.compress, "compress", c.compress, "compress responses with gzip or deflate if the client accepts it")
+	fs.IntVar(&c.compressOpts.MinSize, "compress-min-size", c.compressOpts.MinSize, "minimum size of response bodies which are compressed")
+	fs.Var(newSliceValue(&c.compressOpts.SkipContentTypes, ","), "compress-skip-content-types", "content type prefixes of responses which are not compressed. use - to remove the defaults. can be repeated")
+	fs.StringVar(&c.staticOpts.Dir, "static-dir", c.staticOpts.Dir, "serve the static files of this directory instead of the example app. the files are indexed at startup, changes require a restart")
+	fs.StringVar(&c.staticOpts.Prefix, "static-prefix", c.staticOpts.Prefix, "URL path prefix of the static files. other paths are proxied if a proxy is configured")
+	fs.Var(newMapValue(c.staticOpts.CacheControl, "=", ""), "static-cache-control", "Cache-Control header of static files in the format pattern=value, e.g. '*.js=public, max-age=31536000'. patterns without a slash match the file name. can be repeated, one pattern per flag")
+	fs.BoolVar(&c.staticOpts.SPAFallback, "static-spa", c.staticOpts.SPAFallback, "serve /index.html for paths without a file extension which do not exist (single-page app)")
+	fs.BoolVar(&c.staticOpts.DirListing, "static-dir-listing", c.staticOpts.DirListing, "list the files of directories without an index.html")
+	fs.StringVar(&c.tlsCert, "tls-cert", c.tlsCert, "tls certificate file. reloaded on SIGHUP")
+	fs.StringVar(&c.tlsKey, "tls-key", c.tlsKey, "tls key file. reloaded on SIGHUP")
+	fs.BoolVar(&c.h2c, "h2c", c.h2c, "accept cleartext HTTP/2 (h2c) with prior knowledge if TLS is not used, e.g. for gRPC behind a service mesh")
+	fs.DurationVar(&c.shutdownGracePeriod, "shutdown-grace-period", c.shutdownGracePeriod, "shutdown grace period")
+	fs.DurationVar(&c.shutdownDrainDelay, "shutdown-drain-delay", c.shutdownDrainDelay, "duration the server keeps serving with failing readiness checks before the shutdown, so that load balancers can remove it")
+	fs.DurationVar(&c.healthInterval, "healthz-interval", c.healthInterval, "interval of the checks of /healthz and /readyz. these paths are answered by the server itself and never reach the app or the proxy routes")
+	fs.DurationVar(&c.healthTimeout, "healthz-timeout", c.healthTimeout, "timeout of the checks of /healthz and /readyz")
+	fs.Uint64Var(&c.healthMinDiskFree, "healthz-min-disk-free", c.healthMinDiskFree, "minimum free bytes on the file system of the disk cache")
+	fs.BoolVar(&c.healthUpstreams, "readyz-upstreams", c.healthUpstreams, "fail /readyz if a proxy route has no available upstream. by default a failed upstreams check only degrades /healthz")
+	fs.DurationVar(&c.server.WriteTimeout, "write-timeout", c.server.WriteTimeout, "server write timeout")
+	fs.DurationVar(&c.server.ReadTimeout, "read-timeout", c.server.ReadTimeout, "server read timeout")
+	fs.DurationVar(&c.server.IdleTimeout, "idle-timeout", c.server.IdleTimeout, "server idle timeout")
+
+	fs.Var(newSliceValue(&c.upstreams, ","), "upstream", "proxy requests which match no route to upstream in the format URL[;weight=N]. can be repeated to balance over multiple upstreams")
+	fs.StringVar(&c.routesFile, "routes-file", c.routesFile, "JSON file with proxy routes. reloaded on SIGHUP")
+	fs.Var(newMapValue(c.routes, "=", " "), "route", "proxy route in the format [host]/path-prefix=upstream[,upstream...]. can be repeated")
+	fs.Var(newMapValue(c.routeRewrites, "=", " "), "route-rewrite", "replace the path prefix of a route in the format [host]/path-prefix=new-prefix. can be repeated")
+	fs.StringVar(&c.poolOptions.Strategy, "lb-strategy", c.poolOptions.Strategy, "load balancing strategy (round-robin, weighted, least-conn, hash)")
+	fs.Var(newFuncValue(func(s string) error {
+		rule, err := parseHeaderRule(s)
+		if err != nil {
+			return err
+		}
+		c.headers.Request = append(c.headers.Request, rule)
+		return nil
+	}, func() string {
+		return joinStrings(c.headers.Request, "; ")
+	}), "request-header", "rewrite proxied request headers in the format 'set|append|delete|rename name[=value]'. values can contain {client_ip}, {request_id}, {route}, {upstream}, {host}, {method} and {path}. can be repeated")
+	fs.Var(newFuncValue(func(s string) error {
+		rule, err := parseHeaderRule(s)
+		if err != nil {
+			return err
+		}
+		c.headers.Response = append(c.headers.Response, rule)
+		return nil
+	}, func() string {
+		return joinStrings(c.headers.Response, "; ")
+	}), "response-header", "rewrite proxied response headers in the same format as -request-header. can be repeated")
+	fs.StringVar(&c.poolOptions.Protocol, "upstream-protocol", c.poolOptions.Protocol, "protocol for upstream requests (auto, http1, h2c). use h2c for cleartext gRPC upstreams")
+	fs.DurationVar(&c.poolOptions.ResponseTimeout, "upstream-response-timeout", c.poolOptions.ResponseTimeout, "maximum time to wait for the response headers of an upstream (504 on timeout). 0 disables the timeout")
+	fs.StringVar(&c.poolOptions.TLS.CAFile, "upstream-ca", c.poolOptions.TLS.CAFile, "PEM file with the CAs trusted for upstream certificates. system CAs if empty. reloaded on change")
+	fs.StringVar(&c.poolOptions.TLS.CertFile, "upstream-cert", c.poolOptions.TLS.CertFile, "client certificate file for mTLS to upstreams. reloaded on change")
+	fs.StringVar(&c.poolOptions.TLS.KeyFile, "upstream-key", c.poolOptions.TLS.KeyFile, "client key file for mTLS to upstreams. reloaded on change")
+	fs.StringVar(&c.poolOptions.TLS.ServerName, "upstream-server-name", c.poolOptions.TLS.ServerName, "override the server name used for SNI and the verification of upstream certificates")
+	fs.StringVar(&c.poolOptions.TLS.MinVersion, "upstream-tls-min-version", c.poolOptions.TLS.MinVersion, "minimum TLS version for upstream connections (1.0, 1.1, 1.2, 1.3). 1.2 if empty")
+	fs.BoolVar(&c.poolOptions.TLS.InsecureSkipVerify, "upstream-insecure-skip-verify", c.poolOptions.TLS.InsecureSkipVerify, "disable the verification of upstream certificates. only for testing")
+	fs.StringVar(&c.poolOptions.HashHeader, "lb-hash-header", c.poolOptions.HashHeader, "request header used for the hash load balancing strategy")
+	fs.StringVar(&c.poolOptions.HealthCheckPath, "health-check-path", c.poolOptions.HealthCheckPath, "path for active health checks of upstreams. empty disables active health checks")
+	fs.DurationVar(&c.poolOptions.HealthCheckInterval, "health-check-interval", c.poolOptions.HealthCheckInterval, "interval of active health checks")
+	fs.DurationVar(&c.poolOptions.HealthCheckTimeout, "health-check-timeout", c.poolOptions.HealthCheckTimeout, "timeout of active health checks")
+	fs.IntVar(&c.poolOptions.MaxFailures, "outlier-max-failures", c.poolOptions.MaxFailures, "consecutive 5xx responses or connection errors after which an upstream gets ejected. 0 disables the outlier detection")
+	fs.DurationVar(&c.poolOptions.EjectionTime, "outlier-ejection-time", c.poolOptions.EjectionTime, "duration an upstream stays ejected")
+	fs.IntVar(&c.poolOptions.BreakerFailures, "circuit-breaker-failures", c.poolOptions.BreakerFailures, "consecutive failures after which the circuit breaker of an upstream opens. 0 disables the circuit breaker")
+	fs.DurationVar(&c.poolOptions.BreakerTimeout, "circuit-breaker-timeout", c.poolOptions.BreakerTimeout, "duration an open circuit breaker rejects requests before it lets a probe request through")
+	fs.IntVar(&c.poolOptions.Retry.MaxRetries, "retry-max", c.poolOptions.Retry.MaxRetries, "maximum retries of proxied requests. 0 disables retries")
+	fs.Var(newFuncValue(func(s string) error {
+		codes, err := parseInts(s)
+		if err != nil {
+			return err
+		}
+		c.poolOptions.Retry.StatusCodes = codes
+		return nil
+	}, func() string {
+		return joinInts(c.poolOptions.Retry.StatusCodes)
+	}), "retry-status-codes", "comma separated list of upstream status codes which are retried")
+	fs.Int64Var(&c.poolOptions.Retry.MaxBodySize, "retry-max-body-size", c.poolOptions.Retry.MaxBodySize, "maximum size of request bodies which are buffered for retries")
+	fs.DurationVar(&c.poolOptions.Retry.Backoff, "retry-backoff", c.poolOptions.Retry.Backoff, "base of the exponential backoff between retries")
+	fs.DurationVar(&c.poolOptions.Retry.MaxBackoff, "retry-max-backoff", c.poolOptions.Retry.MaxBackoff, "maximum backoff between retries")
+	fs.Float64Var(&c.poolOptions.Retry.BudgetRatio, "retry-budget-ratio", c.poolOptions.Retry.BudgetRatio, "maximum ratio of retries to requests")
+	fs.StringVar(&c.mirrorOpts.Upstream, "mirror-upstream", c.mirrorOpts.Upstream, "copy proxied requests asynchronously to this shadow upstream and discard its responses. empty disables mirroring")
+	fs.Float64Var(&c.mirrorOpts.SampleRate, "mirror-sample-rate", c.mirrorOpts.SampleRate, "ratio of requests which are mirrored (0-1)")
+	fs.Int64Var(&c.mirrorOpts.MaxBodySize, "mirror-max-body-size", c.mirrorOpts.MaxBodySize, "maximum size of request bodies which are buffered for mirroring. requests with larger bodies are not mirrored")
+	fs.IntVar(&c.mirrorOpts.MaxConcurrency, "mirror-max-concurrency", c.mirrorOpts.MaxConcurrency, "maximum concurrent mirror requests. requests are not mirrored while the limit is reached")
+	fs.DurationVar(&c.mirrorOpts.Timeout, "mirror-timeout", c.mirrorOpts.Timeout, "timeout of mirror requests")
+	fs.BoolVar(&c.mirrorOpts.CompareStatus, "mirror-compare-status", c.mirrorOpts.CompareStatus, "log requests for which the shadow upstream responds with another status code")
+	fs.BoolVar(&c.enableCache, "cache", c.enableCache, "cache proxied responses according to their Cache-Control headers")
+	fs.StringVar(&c.cacheOptions.Store, "cache-store", c.cacheOptions.Store, "cache store (memory, disk)")
+	fs.StringVar(&c.cacheOptions.Dir, "cache-dir", c.cacheOptions.Dir, "directory of the disk cache store")
+	fs.Int64Var(&c.cacheOptions.MaxSize, "cache-max-size", c.cacheOptions.MaxSize, "maximum size of the cache in bytes")
+	fs.Int64Var(&c.cacheOptions.MaxObjectSize, "cache-max-object-size", c.cacheOptions.MaxObjectSize, "maximum size of a cached response body in bytes")
+	fs.StringVar(&c.cacheOptions.Name, "cache-name", c.cacheOptions.Name, "name of the cache in the Cache-Status header")
+}
+
 func run(ctx context.Context) error {
-	var (
-		showVersion = false
-		logLevel    = slog.LevelDebug
-
-		tlsCert             string
-		tlsKey              string
-		shutdownGracePeriod = time.Minute
-		server              = newDefaultServer()
-	)
-
-	flag.TextVar(&logLevel, "log-level", logLevel, "log level (DEBUG, INFO, WARN, ERROR)")
-	flag.BoolVar(&showVersion, "version", showVersion, "print version and exit")
-
-	flag.StringVar(&server.Addr, "addr", server.Addr, "server listen address")
-	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "tls certificate file")
-	flag.StringVar(&tlsKey, "tls-key", tlsKey, "tls key file")
-	flag.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", shutdownGracePeriod, "shutdown grace period")
-	flag.DurationVar(&server.WriteTimeout, "write-timeout", server.WriteTimeout, "server write timeout")
-	flag.DurationVar(&server.ReadTimeout, "read-timeout", server.ReadTimeout, "server read timeout")
-	flag.DurationVar(&server.IdleTimeout, "idle-timeout", server.IdleTimeout, "server idle timeout")
-
-	err := readFlagsFromEnv(flag.CommandLine, envPrefix)
+	c, err := loadServerConfig(flag.CommandLine, os.Args[1:])
 	if err != nil {
 		return err
 	}
 
-	flag.Parse()
-
-	if showVersion {
+	if c.showVersion {
 		if version != "" {
 			fmt.Println(version)
 			return nil
@@ -75,42 +309,246 @@ func run(ctx context.Context) error {
 		return nil
 	}
 
-	logger := slog.New(newRequestIDLogger(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	levelController := newLogLevelController(c.logLevel)
+	baseLogHandler, closeLog, err := newLogHandler(c.logFormat, c.logOutput, c.logSource, levelController.Leveler())
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	logger := slog.New(newRequestIDLogger(newRedactHandler(newTailLogHandler(baseLogHandler), c.logRedact)))
 	slog.SetDefault(logger)
 
+	go levelController.handleSignals(ctx, c.logLevelRevert)
+
+	reloader := newConfigReloader(flag.CommandLine, os.Args[1:], levelController)
+
+	// setup admin handlers
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/log-level", logLevelHandler(levelController, c.logLevelRevert))
+	inFlight := newInFlightRequests()
+	adminMux.Handle("/requests", inFlightRequestsHandler(inFlight))
+	adminMux.Handle("/requests/{id}", cancelRequestHandler(inFlight))
+
+	health := newHealthChecker()
+
 	// setup main handler
 	var handler http.Handler
 	handler = http.HandlerFunc(exampleAppHandler)
 
+	proxy := len(c.upstreams) > 0 || len(c.routes) > 0 || c.routesFile != ""
+	if proxy {
+		router, err := newProxyRouter(ctx, c.loadProxyRoutes, c.poolOptions)
+		if err != nil {
+			return err
+		}
+		reloader.router = router
+		adminMux.Handle("/upstreams", upstreamsHandler(router))
+		health.Register(healthCheck{
+			Name:     "upstreams",
+			Check:    router.checkUpstreams,
+			Timeout:  c.healthTimeout,
+			Interval: c.healthInterval,
+			// one dead backend should not take all instances out of
+			// the load balancer
+			Critical: c.healthUpstreams,
+		})
+		handler = router
+
+		if c.mirrorOpts.Upstream != "" {
+			m, err := newMirror(c.mirrorOpts)
+			if err != nil {
+				return err
+			}
+			handler = m.handler(handler)
+		}
+		if c.enableCache {
+			store, err := newCacheStore(c.cacheOptions)
+			if err != nil {
+				return err
+			}
+			handler = newResponseCache(handler, store, c.cacheOptions)
+			if c.cacheOptions.Store == "disk" {
+				health.Register(healthCheck{
+					Name:     "cache_disk_space",
+					Check:    diskSpaceCheck(c.cacheOptions.Dir, c.healthMinDiskFree),
+					Timeout:  c.healthTimeout,
+					Interval: c.healthInterval,
+				})
+			}
+		}
+	}
+
+	// register the routes of the app, the proxy or the example app handle
+	// all paths which are not served by another route
+	app := newRouteRegistry()
+	staticRoot := false
+	if c.staticOpts.Dir != "" {
+		static, err := newStaticHandler(os.DirFS(c.staticOpts.Dir), c.staticOpts)
+		if err != nil {
+			return err
+		}
+		if static.opts.Prefix == "/" && proxy {
+			return fmt.Errorf("static files and the proxy can't both be served under /, set -static-prefix")
+		}
+		app.Handle(static.opts.Prefix, static, http.MethodGet)
+		staticRoot = static.opts.Prefix == "/"
+	}
+	if !staticRoot {
+		app.Handle("/", handler)
+	}
+	handler = app
+
+	handler, err = authRateLimitHandler(reloader, c, handler)
+	if err != nil {
+		return err
+	}
+
+	// preflight requests carry no credentials, answer them before the
+	// authentication
+	if c.cors.enabled() {
+		err = c.cors.validate()
+		if err != nil {
+			return err
+		}
+		handler = corsMiddleware(handler, c.cors)
+	}
+	if c.compress {
+		handler = compressMiddleware(handler, c.compressOpts)
+	}
+
+	// shed load before any other work is done for a request
+	concurrencyLimiter, err := newConcurrencyLimiter(c.concurrency)
+	if err != nil {
+		return err
+	}
+	if concurrencyLimiter.enabled() {
+		handler = concurrencyLimiter.handler(handler)
+		adminMux.Handle("/concurrency", concurrencyLimitsHandler(concurrencyLimiter))
+	}
+
+	// probes bypass the authentication and the limits. /healthz and
+	// /readyz shadow these paths of the app and the proxied upstreams.
+	health.start(ctx)
+	handler = health.handler(handler)
+
 	// wrap main handler to add logging and request id
-	handler = logHandler(handler, logger)
-	handler = requestIDMiddleware(handler)
+	handler, err = reloader.handler(c, handler, []string{"tail-log-size", "tail-log-latency"}, func(c *serverConfig, next http.Handler) (http.Handler, error) {
+		return logHandler(next, logger, &c.tailLog), nil
+	})
+	if err != nil {
+		return err
+	}
+	handler, err = clientIPMiddleware(handler, c.trustedProxies, c.clientIPHeader)
+	if err != nil {
+		return err
+	}
+	handler = requestIDMiddleware(handler, inFlight)
+
+	// track the connections which server.Shutdown does not handle
+	tracker := newConnTracker()
+	handler = tracker.handler(handler)
+	c.server.RegisterOnShutdown(tracker.notifyShutdown)
 
-	server.Handler = handler
+	c.server.Handler = handler
 
-	runServer := server.ListenAndServe
-	if tlsCert != "" && tlsKey != "" {
+	runServer := c.server.ListenAndServe
+	if c.tlsCert != "" && c.tlsKey != "" {
+		certs, err := newCertificateStore(c.tlsCert, c.tlsKey)
+		if err != nil {
+			return err
+		}
+		reloader.certs = certs
+		c.server.TLSConfig.GetCertificate = certs.GetCertificate
 		runServer = func() error {
-			return server.ListenAndServeTLS(tlsCert, tlsKey)
+			return c.server.ListenAndServeTLS("", "")
 		}
+	} else if c.h2c {
+		c.server.Protocols = &http.Protocols{}
+		c.server.Protocols.SetHTTP1(true)
+		c.server.Protocols.SetUnencryptedHTTP2(true)
 	}
 
-	errChan := make(chan error, 1)
+	// the reloader is complete after the handlers and the server are set
+	// up
+	go reloader.handleSignals(ctx)
+
+	errChan := make(chan error, 2)
 	go func() {
-		slog.InfoContext(ctx, "start server", "addr", server.Addr)
+		slog.InfoContext(ctx, "start server", "addr", c.server.Addr)
 		errChan <- runServer()
 	}()
 
+	var adminServer *http.Server
+	if c.adminAddr != "" {
+		adminServer = newAdminServer(c.adminAddr, adminMux)
+		go func() {
+			slog.InfoContext(ctx, "start admin server", "addr", adminServer.Addr)
+			errChan <- adminServer.ListenAndServe()
+		}()
+	}
+
 	select {
 	case err := <-errChan:
 		return err
 	case <-ctx.Done():
 	}
 
-	shutdownCtx, cancelFn := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	health.setDraining()
+	if c.shutdownDrainDelay > 0 {
+		slog.Info("drain server", "delay", c.shutdownDrainDelay)
+		time.Sleep(c.shutdownDrainDelay)
+	}
+
+	shutdownCtx, cancelFn := context.WithTimeout(context.Background(), c.shutdownGracePeriod)
 	defer cancelFn()
-	slog.Info("shutdown server", "grace period", shutdownGracePeriod)
-	return server.Shutdown(shutdownCtx)
+	slog.Info("shutdown server", "grace period", c.shutdownGracePeriod)
+	err = c.server.Shutdown(shutdownCtx)
+	if forceClosed := tracker.wait(shutdownCtx); len(forceClosed) > 0 {
+		slog.Warn("force closed connections after grace period", "hijacked", forceClosed["hijacked"], "streams", forceClosed["stream"])
+	}
+	if adminServer != nil {
+		// the admin server is not drained, it should stay available as
+		// long as possible
+		adminServer.Close()
+	}
+	return err
+}
+
+// authRateLimitHandler wraps next with the authentication and the rate
+// limit. The rate limit per identity needs the principal and is applied after
+// the authentication. All other rate limits are applied before it, so that
+// failed authentications (e.g. password guessing) are limited too.
+func authRateLimitHandler(reloader *configReloader, c *serverConfig, next http.Handler) (http.Handler, error) {
+	settings := []string{"rate-limit", "rate-limit-burst", "rate-limit-route", "rate-limit-key", "rate-limit-max-keys"}
+	rateLimitHandler := func(identity bool) func(c *serverConfig, next http.Handler) (http.Handler, error) {
+		return func(c *serverConfig, next http.Handler) (http.Handler, error) {
+			if (c.rateLimit.Key == rateLimitKeyIdentity) != identity {
+				return next, nil
+			}
+			limiter, err := newRateLimiter(c.rateLimit)
+			if err != nil {
+				return nil, err
+			}
+			if !limiter.enabled() {
+				return next, nil
+			}
+			return limiter.handler(next), nil
+		}
+	}
+	handler, err := reloader.handler(c, next, settings, rateLimitHandler(true))
+	if err != nil {
+		return nil, err
+	}
+
+	verifiers, err := newAuthVerifiers(c.auth)
+	if err != nil {
+		return nil, err
+	}
+	if len(verifiers) > 0 {
+		handler = authMiddleware(handler, verifiers, c.auth.Allow)
+	}
+
+	return reloader.handler(c, handler, settings, rateLimitHandler(false))
 }
 
 func newDefaultServer() *http.Server {
@@ -151,6 +589,8 @@ func newDefaultServer() *http.Server {
 }
 
 func exampleAppHandler(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "handle request", "query", r.URL.Query())
+
 	// duration to simulate a long request
 	if r.URL.Query().Has("duration") {
 		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type mirrorOptions struct {
+	// Upstream is the URL of the shadow upstream. Mirroring is disabled
+	// if empty.
+	Upstream string
+	// SampleRate is the ratio of requests which are mirrored (0-1).
+	SampleRate float64
+	// MaxBodySize is the maximum size of a request body which is buffered
+	// to send it to the shadow. Requests with larger bodies are not
+	// mirrored.
+	MaxBodySize int64
+	// MaxConcurrency limits the concurrent shadow requests. Requests
+	// are not mirrored while the limit is reached.
+	MaxConcurrency int
+	Timeout        time.Duration
+	// CompareStatus logs requests for which the shadow responds with
+	// another status code than the primary upstream.
+	CompareStatus bool
+}
+
+func defaultMirrorOptions() mirrorOptions {
+	return mirrorOptions{
+		SampleRate:     1,
+		MaxBodySize:    64 * 1024,
+		MaxConcurrency: 10,
+		Timeout:        10 * time.Second,
+	}
+}
+
+// mirror copies requests asynchronously to a shadow upstream, e.g. to test a
+// rewritten service with real traffic. The responses of the shadow are
+// discarded. The shadow never slows down the primary requests, they only
+// wait for the request body to be buffered.
+type mirror struct {
+	opts      mirrorOptions
+	upstream  *url.URL
+	client    *http.Client
+	semaphore chan struct{}
+}
+
+func newMirror(opts mirrorOptions) (*mirror, error) {
+	upstream, err := url.Parse(opts.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror upstream: %w", err)
+	}
+	if upstream.Scheme == "" || upstream.Host == "" {
+		return nil, fmt.Errorf("invalid mirror upstream '%s': scheme and host required", opts.Upstream)
+	}
+	if opts.MaxConcurrency <= 0 {
+		return nil, fmt.Errorf("invalid mirror concurrency %d", opts.MaxConcurrency)
+	}
+	return &mirror{
+		opts:     opts,
+		upstream: upstream,
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		semaphore: make(chan struct{}, opts.MaxConcurrency),
+	}, nil
+}
+
+// handler mirrors a sample of the requests and passes all requests to next.
+func (m *mirror) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= m.opts.SampleRate || isGRPCRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case m.semaphore <- struct{}{}:
+		default:
+			slog.DebugContext(r.Context(), "skip mirror, concurrency limit reached")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok, err := m.bufferBody(r)
+		if err != nil {
+			<-m.semaphore
+			errorHandler(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !ok {
+			<-m.semaphore
+			slog.DebugContext(r.Context(), "skip mirror, request body too large")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the primary status is only needed to compare it
+		primaryStatus := make(chan int, 1)
+		// copy the request before next can modify it
+		out, cancel := m.newShadowRequest(r, body)
+		path := r.URL.Path
+		go func() {
+			defer func() { <-m.semaphore }()
+			defer cancel()
+			m.send(out, path, primaryStatus)
+		}()
+		addAccessLogAttrs(r.Context(), slog.Bool("mirrored", true))
+
+		if !m.opts.CompareStatus {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := newStatusResponseWriter(w)
+		defer func() {
+			primaryStatus <- sw.statusCode
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// bufferBody reads the request body if it is not larger than MaxBodySize and
+// replaces it with the buffered copy. It reports whether the request can be
+// mirrored.
+func (m *mirror) bufferBody(r *http.Request) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > m.opts.MaxBodySize {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.opts.MaxBodySize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > m.opts.MaxBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+// newShadowRequest returns a copy of r for the shadow upstream. The cancel
+// function has to be called when the shadow request is done.
+func (m *mirror) newShadowRequest(r *http.Request, body []byte) (*http.Request, context.CancelFunc) {
+	// the shadow request outlives the primary request, keep only the
+	// values of the context (e.g. the request ID for logging)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.opts.Timeout)
+
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	out.URL.Scheme = m.upstream.Scheme
+	out.URL.Host = m.upstream.Host
+	out.URL.Path = singleJoiningSlash(m.upstream.Path, r.URL.Path)
+	out.URL.RawPath = ""
+	out.Host = m.upstream.Host
+	removeHopHeaders(out.Header)
+	out.Close = false
+	out.TransferEncoding = nil
+	out.Body = http.NoBody
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+	return out, cancel
+}
+
+// hopHeaders are the hop-by-hop headers which are removed from shadow
+// requests like httputil.ReverseProxy removes them from proxied requests.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers and the headers listed in
+// the Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// send sends the shadow request out. If CompareStatus is set it waits for
+// the status code of the primary response and logs mismatches with the path
+// of the request.
+func (m *mirror) send(out *http.Request, path string, primaryStatus <-chan int) {
+	ctx := out.Context()
+	shadowStatus := 0
+	resp, err := m.client.Do(out)
+	if err != nil {
+		slog.DebugContext(ctx, "mirror request failed", "err", err)
+	} else {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		shadowStatus = resp.StatusCode
+	}
+
+	if !m.opts.CompareStatus {
+		return
+	}
+	select {
+	case status := <-primaryStatus:
+		if status != shadowStatus {
+			slog.WarnContext(ctx, "mirror status mismatch",
+				"method", out.Method,
+				"path", path,
+				"primary", status,
+				"shadow", shadowStatus,
+			)
+		}
+	case <-ctx.Done():
+	}
+}
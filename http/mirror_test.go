@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func TestMirror(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		sampleRate       float64
+		body             string
+		expectedMirrored []string
+		expectedLog      string
+	}{
+		{
+			name:             "mirror",
+			sampleRate:       1,
+			body:             "body",
+			expectedMirrored: []string{"POST /shadow/path?q=1 body"},
+			expectedLog:      "mirror status mismatch",
+		},
+		{
+			name:             "body_too_large",
+			sampleRate:       1,
+			body:             strings.Repeat("x", 11),
+			expectedMirrored: []string{},
+		},
+		{
+			name:             "not_sampled",
+			sampleRate:       0,
+			body:             "body",
+			expectedMirrored: []string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mu := sync.Mutex{}
+			mirrored := []string{}
+			shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Primary") != "" {
+					t.Error("expected the shadow request to be copied before the primary request is served")
+				}
+				for _, name := range []string{"Upgrade", "Keep-Alive", "X-Hop"} {
+					if r.Header.Get(name) != "" {
+						t.Errorf("expected hop-by-hop header %s to be removed", name)
+					}
+				}
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				mirrored = append(mirrored, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+				mu.Unlock()
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer shadow.Close()
+
+			logOutput := &syncBuffer{}
+			defaultLogger := slog.Default()
+			slog.SetDefault(slog.New(newRequestIDLogger(slog.NewTextHandler(logOutput, nil))))
+			defer slog.SetDefault(defaultLogger)
+
+			opts := defaultMirrorOptions()
+			opts.Upstream = shadow.URL + "/shadow"
+			opts.SampleRate = test.sampleRate
+			opts.MaxBodySize = 10
+			opts.CompareStatus = true
+			m, err := newMirror(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := requestIDMiddleware(m.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Set("X-Primary", "1")
+				body, _ := io.ReadAll(r.Body)
+				w.Write(body)
+			})), nil)
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/path?q=1", strings.NewReader(test.body))
+			r.Header.Set("Connection", "Upgrade, X-Hop")
+			r.Header.Set("Upgrade", "websocket")
+			r.Header.Set("Keep-Alive", "timeout=5")
+			r.Header.Set("X-Hop", "1")
+			handler.ServeHTTP(rec, r)
+			if rec.Body.String() != test.body {
+				t.Errorf("expected primary to receive body %s, got: %s", test.body, rec.Body)
+			}
+
+			// wait for the mirror requests
+			for i := 0; i < 100 && len(m.semaphore) > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(mirrored, "\n") != strings.Join(test.expectedMirrored, "\n") {
+				t.Errorf("expected mirrored requests: %v, got: %v", test.expectedMirrored, mirrored)
+			}
+			if test.expectedLog != "" && (!strings.Contains(logOutput.String(), test.expectedLog) || !strings.Contains(logOutput.String(), "request_id=")) {
+				t.Errorf("expected log to contain %s with request id, got: %s", test.expectedLog, logOutput)
+			}
+		})
+	}
+}
+
+func TestMirrorConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	opts := defaultMirrorOptions()
+	opts.Upstream = shadow.URL
+	opts.MaxConcurrency = 1
+	m, err := newMirror(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := m.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if time.Since(start) > 100*time.Millisecond {
+			t.Fatal("expected mirror not to block the primary request")
+		}
+	}
+	if len(m.semaphore) != 1 {
+		t.Errorf("expected 1 running mirror request, got: %d", len(m.semaphore))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "context"
+
+// principal is the authenticated identity of a request.
+type principal struct {
+	// Name identifies the user or client, e.g. the user name or the
+	// subject of a token.
+	Name string
+	// Scheme is the authentication scheme which verified the identity.
+	Scheme string
+}
+
+type ctxKeyPrincipal int
+
+const principalKey ctxKeyPrincipal = 0
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// getPrincipal returns the authenticated identity of the request or nil if
+// the request is not authenticated.
+func getPrincipal(ctx context.Context) *principal {
+	if ctx == nil {
+		return nil
+	}
+	p, _ := ctx.Value(principalKey).(*principal)
+	return p
+}
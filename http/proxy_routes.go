@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// proxyRoute maps requests for Host (any host if empty) and PathPrefix to
+// Upstreams.
+type proxyRoute struct {
+	Host       string   `json:"host,omitempty"`
+	PathPrefix string   `json:"path_prefix"`
+	Upstreams  []string `json:"upstreams"`
+
+	// StripPrefix removes PathPrefix from the path before the request
+	// is forwarded.
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+	// RewritePrefix replaces PathPrefix in the path before the request is
+	// forwarded.
+	RewritePrefix string `json:"rewrite_prefix,omitempty"`
+	// Protocol overrides the upstream protocol (auto, http1, h2c) of the
+	// route.
+	Protocol string `json:"protocol,omitempty"`
+	// TLS overrides the upstream TLS options of the route.
+	TLS *upstreamTLSOptions `json:"tls,omitempty"`
+	// Headers are rules which rewrite the request and response headers
+	// of the route.
+	Headers headerRules `json:"headers,omitempty"`
+}
+
+func (r proxyRoute) String() string {
+	return r.Host + r.PathPrefix
+}
+
+type proxyRoutesFile struct {
+	// Headers are applied to all routes of the file before the headers
+	// of the route.
+	Headers headerRules  `json:"headers,omitempty"`
+	Routes  []proxyRoute `json:"routes"`
+}
+
+// parseRouteKey parses a route key in the format [host]/path-prefix.
+func parseRouteKey(key string) (host string, pathPrefix string) {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return key, "/"
+	}
+	return key[:i], key[i:]
+}
+
+// loadProxyRoutes returns the routes from flags followed by the routes from
+// file (if set). routes maps a key in the format [host]/path-prefix to a
+// comma separated list of upstreams and rewrites maps the same key to the new
+// path prefix. The defaultUpstreams are used for all requests which match no
+// other route. The header rules are applied to all routes.
+func loadProxyRoutes(file string, routes map[string]string, rewrites map[string]string, defaultUpstreams []string, headers headerRules) ([]proxyRoute, error) {
+	proxyRoutes := []proxyRoute{}
+	keys := make([]string, 0, len(routes))
+	for key := range routes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		host, pathPrefix := parseRouteKey(key)
+		route := proxyRoute{
+			Host:       host,
+			PathPrefix: pathPrefix,
+			Upstreams:  strings.Split(routes[key], ","),
+			Headers:    headers,
+		}
+		if rewritePrefix, ok := rewrites[key]; ok {
+			route.StripPrefix = true
+			route.RewritePrefix = rewritePrefix
+		}
+		proxyRoutes = append(proxyRoutes, route)
+	}
+	for key := range rewrites {
+		if _, ok := routes[key]; !ok {
+			return nil, fmt.Errorf("rewrite for unknown route '%s'", key)
+		}
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routes: %w", err)
+		}
+		routesFile := proxyRoutesFile{}
+		err = json.Unmarshal(data, &routesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse routes file '%s': %w", file, err)
+		}
+		fileHeaders := headers.merge(routesFile.Headers)
+		for _, route := range routesFile.Routes {
+			route.Headers = fileHeaders.merge(route.Headers)
+			proxyRoutes = append(proxyRoutes, route)
+		}
+	}
+
+	if len(defaultUpstreams) > 0 {
+		proxyRoutes = append(proxyRoutes, proxyRoute{
+			PathPrefix: "/",
+			Upstreams:  defaultUpstreams,
+			Headers:    headers,
+		})
+	}
+	return proxyRoutes, nil
+}
+
+type compiledRoute struct {
+	proxyRoute
+	pool    *upstreamPool
+	handler http.Handler
+}
+
+// routingTable is an immutable set of routes. Routes with a host are
+// matched before routes without a host and longer prefixes before shorter
+// ones.
+type routingTable struct {
+	// definitions are the routes the table was built from
+	definitions []proxyRoute
+	// routes are in the order they are matched
+	routes  []*compiledRoute
+	matcher routeMatcher[*compiledRoute]
+	cancel  context.CancelFunc
+}
+
+func newRoutingTable(ctx context.Context, routes []proxyRoute, opts upstreamPoolOptions) (*routingTable, error) {
+	table := &routingTable{
+		definitions: routes,
+	}
+	seen := map[string]bool{}
+	errs := []error{}
+	for _, route := range routes {
+		route.Host = strings.ToLower(route.Host)
+		if route.PathPrefix == "" {
+			route.PathPrefix = "/"
+		}
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("route '%s': path prefix has to start with '/'", route))
+			continue
+		}
+		if seen[route.String()] {
+			// first definition wins, e.g. a route from the
+			// flags over the same route in the file
+			continue
+		}
+		seen[route.String()] = true
+		if err := route.Headers.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("route '%s': %w", route, err))
+			continue
+		}
+
+		poolOpts := opts
+		if route.Protocol != "" {
+			poolOpts.Protocol = route.Protocol
+		}
+		if route.TLS != nil {
+			poolOpts.TLS = *route.TLS
+		}
+		pool, err := newUpstreamPool(route.Upstreams, poolOpts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route '%s': %w", route, err))
+			continue
+		}
+		table.routes = append(table.routes, &compiledRoute{
+			proxyRoute: route,
+			pool:       pool,
+			handler:    forwardCustomTransportHandler(pool, route.Headers),
+		})
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	for _, route := range table.routes {
+		table.matcher.add(route.Host, route.PathPrefix, route)
+	}
+	table.routes = table.matcher.values()
+
+	ctx, table.cancel = context.WithCancel(ctx)
+	for _, route := range table.routes {
+		route.pool.start(ctx)
+	}
+	return table, nil
+}
+
+// close stops the health checks and closes the idle upstream connections of
+// the table. Requests which are in-flight finish with their connections.
+func (t *routingTable) close() {
+	t.cancel()
+	for _, route := range t.routes {
+		route.pool.closeIdleConnections()
+	}
+}
+
+func (t *routingTable) match(r *http.Request) *compiledRoute {
+	route, _ := t.matcher.match(r)
+	return route
+}
+
+// proxyRouter forwards requests according to its routing table. The routing
+// table can be reloaded at runtime. Requests which are in-flight during a
+// reload finish with the routes they started with.
+type proxyRouter struct {
+	load        func() ([]proxyRoute, error)
+	poolOptions upstreamPoolOptions
+	ctx         context.Context
+	table       atomic.Pointer[routingTable]
+}
+
+func newProxyRouter(ctx context.Context, load func() ([]proxyRoute, error), opts upstreamPoolOptions) (*proxyRouter, error) {
+	p := &proxyRouter{
+		load:        load,
+		poolOptions: opts,
+		ctx:         ctx,
+	}
+	return p, p.reload()
+}
+
+// reload loads and validates the routes and replaces the routing table only
+// if all routes are valid.
+func (p *proxyRouter) reload() error {
+	table, err := p.newTable(p.load)
+	if err != nil || table == nil {
+		return err
+	}
+	p.setTable(table)
+	return nil
+}
+
+// newTable loads and validates the routes. The health checks of the new
+// table are started, so it has to be passed to setTable or closed. If the
+// routes did not change it returns nil, so that the current table keeps the
+// state of its upstreams (health, circuit breakers, outlier detection).
+func (p *proxyRouter) newTable(load func() ([]proxyRoute, error)) (*routingTable, error) {
+	routes, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if current := p.table.Load(); current != nil && reflect.DeepEqual(current.definitions, routes) {
+		return nil, nil
+	}
+	return newRoutingTable(p.ctx, routes, p.poolOptions)
+}
+
+// setTable replaces the routing table and closes the old table.
+func (p *proxyRouter) setTable(table *routingTable) {
+	old := p.table.Swap(table)
+	if old != nil {
+		old.close()
+	}
+}
+
+func (p *proxyRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := p.table.Load().match(r)
+	if route == nil {
+		errorHandler(w, r, http.StatusNotFound, nil)
+		return
+	}
+	ctx := context.WithValue(withRoute(r.Context(), route.String()), proxyRouteKey, route)
+	route.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// checkUpstreams is a health check which fails if a route has no available
+// upstream which accepts TCP connections.
+func (p *proxyRouter) checkUpstreams(ctx context.Context) error {
+	errs := []error{}
+	now := time.Now()
+	dialer := net.Dialer{}
+	for _, route := range p.table.Load().routes {
+		var routeErr error = errNoUpstream
+		for _, u := range route.pool.upstreams {
+			if !u.available(now) {
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, "tcp", upstreamAddr(u.URL))
+			if err != nil {
+				routeErr = err
+				continue
+			}
+			conn.Close()
+			routeErr = nil
+			break
+		}
+		if routeErr != nil {
+			errs = append(errs, fmt.Errorf("route '%s': %w", route, routeErr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// upstreamAddr returns the host:port of the upstream URL.
+func upstreamAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+type routeStatus struct {
+	Route string `json:"route"`
+	upstreamPoolStatus
+}
+
+func (p *proxyRouter) status() []routeStatus {
+	status := []routeStatus{}
+	for _, route := range p.table.Load().routes {
+		status = append(status, routeStatus{
+			Route:              route.String(),
+			upstreamPoolStatus: route.pool.status(),
+		})
+	}
+	return status
+}
+
+// rewriteRoutePath strips or rewrites the prefix of the matched route. It
+// has to be called before ProxyRequest.SetURL which joins the path with the
+// path of the upstream.
+func rewriteRoutePath(pr *httputil.ProxyRequest) {
+	route := getProxyRoute(pr.In.Context())
+	if route == nil || (!route.StripPrefix && route.RewritePrefix == "") {
+		return
+	}
+	out := pr.Out.URL
+	rawPath := out.EscapedPath()
+	path := strings.TrimPrefix(out.Path, route.PathPrefix)
+	out.Path = singleJoiningSlash(route.RewritePrefix, path)
+	// rewrite the escaped path in parallel, so that escaped characters
+	// (e.g. %2F) reach the upstream unchanged
+	out.RawPath = ""
+	if rest, ok := strings.CutPrefix(rawPath, escapePath(route.PathPrefix)); ok {
+		out.RawPath = singleJoiningSlash(escapePath(route.RewritePrefix), rest)
+	}
+}
+
+// escapePath returns the escaped form of path.
+func escapePath(path string) string {
+	u := url.URL{Path: path}
+	return u.EscapedPath()
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+type ctxKeyProxyRoute int
+
+const proxyRouteKey ctxKeyProxyRoute = 0
+
+func getProxyRoute(ctx context.Context) *compiledRoute {
+	if ctx == nil {
+		return nil
+	}
+	route, _ := ctx.Value(proxyRouteKey).(*compiledRoute)
+	return route
+}
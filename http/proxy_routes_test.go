@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyRouter(t *testing.T) {
+	upstreams := newTestUpstreams(t, 3, func(i int, w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d %s", i, r.URL.EscapedPath())
+	})
+	routes := map[string]string{
+		"/api/":             upstreams[0],
+		"/api/v2/":          upstreams[1],
+		"example.com/api/":  upstreams[2],
+		"example.com/users": upstreams[2],
+		"/shop":             upstreams[1],
+	}
+	rewrites := map[string]string{
+		"/api/v2/":          "/v2-beta",
+		"example.com/users": "/",
+		"/shop":             "/",
+	}
+	loadRoutes := func() ([]proxyRoute, error) {
+		return loadProxyRoutes("", routes, rewrites, []string{upstreams[0]}, headerRules{})
+	}
+	router, err := newProxyRouter(context.Background(), loadRoutes, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{
+			host:     "localhost",
+			path:     "/api/users",
+			expected: "0 /api/users",
+		},
+		{
+			host:     "localhost",
+			path:     "/api/v2/users",
+			expected: "1 /v2-beta/users",
+		},
+		{
+			host:     "EXAMPLE.com:8080",
+			path:     "/api/v2/users",
+			expected: "2 /api/v2/users",
+		},
+		{
+			host:     "example.com",
+			path:     "/users/123",
+			expected: "2 /123",
+		},
+		{
+			host:     "example.com",
+			path:     "/other",
+			expected: "0 /other",
+		},
+		{
+			// escaped slashes reach the upstream unchanged
+			host:     "localhost",
+			path:     "/api/v2/files/a%2Fb",
+			expected: "1 /v2-beta/files/a%2Fb",
+		},
+		{
+			host:     "localhost",
+			path:     "/shop/cart",
+			expected: "1 /cart",
+		},
+		{
+			host:     "localhost",
+			path:     "/shop",
+			expected: "1 /",
+		},
+		{
+			// prefixes match whole path segments
+			host:     "localhost",
+			path:     "/shopping",
+			expected: "0 /shopping",
+		},
+		{
+			host:     "example.com",
+			path:     "/usersettings",
+			expected: "0 /usersettings",
+		},
+	} {
+		t.Run(test.host+test.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.path, nil)
+			req.Host = test.host
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Body.String() != test.expected {
+				t.Fatalf("expected: '%s', got: '%s'", test.expected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestProxyRouterReload(t *testing.T) {
+	upstreams := newTestUpstreams(t, 2, nil)
+	routesFile := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes := func(content string) {
+		err := os.WriteFile(routesFile, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRoutes(fmt.Sprintf(`{"routes": [{"path_prefix": "/", "upstreams": ["%s"]}]}`, upstreams[0]))
+
+	loadRoutes := func() ([]proxyRoute, error) {
+		return loadProxyRoutes(routesFile, nil, nil, nil, headerRules{})
+	}
+	router, err := newProxyRouter(context.Background(), loadRoutes, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeRoutes(fmt.Sprintf(`{"routes": [{"path_prefix": "/", "upstreams": ["%s"]}]}`, upstreams[1]))
+	err = router.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := doRequests(t, router, 1, nil)
+	if results["200:1"] != 1 {
+		t.Fatalf("expected request on new upstream, got: %v", results)
+	}
+
+	// invalid routes keep the current routing table
+	writeRoutes(`{"routes": [{"path_prefix": "api", "upstreams": ["invalid"]}]}`)
+	err = router.reload()
+	if err == nil {
+		t.Fatal("expected error for invalid routes")
+	}
+	results = doRequests(t, router, 1, nil)
+	if results["200:1"] != 1 {
+		t.Fatalf("expected request on current upstream, got: %v", results)
+	}
+}
+
+func TestProxyRouterCheckUpstreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	for _, test := range []struct {
+		name          string
+		routes        map[string]string
+		expectedError string
+	}{
+		{
+			name:   "reachable",
+			routes: map[string]string{"/": upstream.URL + "," + closed.URL},
+		},
+		{
+			name:          "unreachable",
+			routes:        map[string]string{"/": upstream.URL, "/api": closed.URL},
+			expectedError: "route '/api': dial tcp",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			loadRoutes := func() ([]proxyRoute, error) {
+				return loadProxyRoutes("", test.routes, nil, nil, headerRules{})
+			}
+			router, err := newProxyRouter(context.Background(), loadRoutes, defaultUpstreamPoolOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = router.checkUpstreams(context.Background())
+			if test.expectedError == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if test.expectedError != "" && (err == nil || !strings.HasPrefix(err.Error(), test.expectedError)) {
+				t.Errorf("expected error '%s', got %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestProxyRouterReloadCloseIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	routes := map[string]string{"/": upstream.URL}
+	loadRoutes := func() ([]proxyRoute, error) {
+		return loadProxyRoutes("", routes, nil, nil, headerRules{})
+	}
+	router, err := newProxyRouter(context.Background(), loadRoutes, defaultUpstreamPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := doRequests(t, router, 1, nil)
+	if results["200:"] != 1 {
+		t.Fatalf("expected request to the upstream, got: %v", results)
+	}
+
+	routes["/api/"] = upstream.URL
+	err = router.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected idle connection of the replaced table to be closed")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rate limit keys
+const (
+	rateLimitKeyIP       = "ip"
+	rateLimitKeyIdentity = "identity"
+	// rateLimitKeyHeader is followed by the header name, e.g.
+	// header:X-Api-Key
+	rateLimitKeyHeader = "header:"
+)
+
+type rateLimitOptions struct {
+	// Rate is the number of requests per second and Burst the size of the
+	// bucket. A rate of 0 disables the limit.
+	Rate  float64
+	Burst int
+	// Routes overrides the rate and burst for requests which match the
+	// route in the format [host]/path-prefix. The values are in the
+	// format rate[,burst].
+	Routes map[string]string
+	// Key selects the bucket of a request: ip, identity (the
+	// authenticated principal, ip for anonymous requests) or
+	// header:<name> (ip if the header is missing).
+	Key string
+	// MaxKeys limits the number of buckets. The least recently used
+	// buckets are removed first.
+	MaxKeys int
+}
+
+func defaultRateLimitOptions() rateLimitOptions {
+	return rateLimitOptions{
+		Burst:   20,
+		Routes:  map[string]string{},
+		Key:     rateLimitKeyIP,
+		MaxKeys: 10000,
+	}
+}
+
+// rateLimitRule is the limit for a route.
+type rateLimitRule struct {
+	Host       string
+	PathPrefix string
+	Rate       float64
+	Burst      int
+}
+
+func (r rateLimitRule) String() string {
+	return r.Host + r.PathPrefix
+}
+
+// parseRateLimit parses a limit in the format rate[,burst]. The burst
+// defaults to defaultBurst.
+func parseRateLimit(value string, defaultBurst int) (float64, int, error) {
+	rawRate, rawBurst, found := strings.Cut(value, ",")
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rawRate), 64)
+	if err != nil || rate < 0 {
+		return 0, 0, fmt.Errorf("invalid rate '%s'", rawRate)
+	}
+	burst := defaultBurst
+	if found {
+		burst, err = strconv.Atoi(strings.TrimSpace(rawBurst))
+		if err != nil || burst < 1 {
+			return 0, 0, fmt.Errorf("invalid burst '%s'", rawBurst)
+		}
+	}
+	return rate, burst, nil
+}
+
+// rateLimiter limits the requests per key with token buckets.
+type rateLimiter struct {
+	opts rateLimitOptions
+	// rules are in the order they are matched
+	rules   []rateLimitRule
+	matcher routeMatcher[rateLimitRule]
+
+	mu      sync.Mutex
+	buckets *lru
+}
+
+func newRateLimiter(opts rateLimitOptions) (*rateLimiter, error) {
+	switch {
+	case opts.Key == rateLimitKeyIP, opts.Key == rateLimitKeyIdentity:
+	case strings.HasPrefix(opts.Key, rateLimitKeyHeader) && len(opts.Key) > len(rateLimitKeyHeader):
+	default:
+		return nil, fmt.Errorf("unknown rate limit key '%s'", opts.Key)
+	}
+	if opts.Burst < 1 {
+		return nil, fmt.Errorf("invalid rate limit burst %d", opts.Burst)
+	}
+	if opts.MaxKeys < 1 {
+		return nil, fmt.Errorf("invalid rate limit max keys %d", opts.MaxKeys)
+	}
+
+	l := &rateLimiter{
+		opts:    opts,
+		buckets: newLRU(int64(opts.MaxKeys), nil),
+	}
+	keys := make([]string, 0, len(opts.Routes))
+	for key := range opts.Routes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		host, pathPrefix := parseRouteKey(key)
+		rate, burst, err := parseRateLimit(opts.Routes[key], opts.Burst)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit '%s': %w", key, err)
+		}
+		rule := rateLimitRule{
+			Host:       strings.ToLower(host),
+			PathPrefix: pathPrefix,
+			Rate:       rate,
+			Burst:      burst,
+		}
+		l.matcher.add(rule.Host, rule.PathPrefix, rule)
+	}
+	// the default limit matches all requests. It is added last, so that
+	// a route for / overrides it.
+	l.matcher.add("", "/", rateLimitRule{PathPrefix: "/", Rate: opts.Rate, Burst: opts.Burst})
+	l.rules = l.matcher.values()
+	return l, nil
+}
+
+// enabled reports whether any limit is configured.
+func (l *rateLimiter) enabled() bool {
+	return slices.ContainsFunc(l.rules, func(rule rateLimitRule) bool {
+		return rule.Rate > 0
+	})
+}
+
+func (l *rateLimiter) match(r *http.Request) rateLimitRule {
+	rule, _ := l.matcher.match(r)
+	return rule
+}
+
+func (l *rateLimiter) key(r *http.Request) string {
+	switch {
+	case l.opts.Key == rateLimitKeyIdentity:
+		if p := getPrincipal(r.Context()); p != nil {
+			return "identity:" + p.Name
+		}
+	case strings.HasPrefix(l.opts.Key, rateLimitKeyHeader):
+		if value := r.Header.Get(strings.TrimPrefix(l.opts.Key, rateLimitKeyHeader)); value != "" {
+			return l.opts.Key + ":" + value
+		}
+	}
+	return "ip:" + getClientIP(r)
+}
+
+// tokenBucket is refilled with rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitResult is the state of a bucket after a request.
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is the time until the bucket is full again.
+	reset time.Duration
+	// retryAfter is the time until the next request is allowed.
+	retryAfter time.Duration
+}
+
+func (l *rateLimiter) take(rule rateLimitRule, key string, now time.Time) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key = rule.String() + " " + key
+	var bucket *tokenBucket
+	if value, ok := l.buckets.get(key); ok {
+		bucket = value.(*tokenBucket)
+		elapsed := now.Sub(bucket.last).Seconds()
+		bucket.tokens = math.Min(float64(rule.Burst), bucket.tokens+elapsed*rule.Rate)
+		bucket.last = now
+	} else {
+		bucket = &tokenBucket{tokens: float64(rule.Burst), last: now}
+		l.buckets.add(key, 1, bucket)
+	}
+
+	result := rateLimitResult{
+		limit: rule.Burst,
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = secondsToDuration((1 - bucket.tokens) / rule.Rate)
+	}
+	result.remaining = int(bucket.tokens)
+	result.reset = secondsToDuration((float64(rule.Burst) - bucket.tokens) / rule.Rate)
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// ceilSeconds returns d in full seconds, rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// handler limits the requests to next. It sets the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers (IETF draft
+// RateLimit header fields for HTTP) and responds with 429 and Retry-After if
+// the limit is exceeded.
+func (l *rateLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := l.match(r)
+		if rule.Rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := l.key(r)
+		result := l.take(rule, key, time.Now())
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(result.reset))
+		if !result.allowed {
+			slog.DebugContext(r.Context(), "rate limit exceeded", "key", key, "route", rule.String())
+			addAccessLogAttrs(r.Context(), slog.String("rate_limit", rule.String()))
+			w.Header().Set("Retry-After", ceilSeconds(result.retryAfter))
+			errorHandler(w, r, http.StatusTooManyRequests, nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     rateLimitOptions
+		requests []string
+		expected []string
+	}{
+		{
+			name:     "burst",
+			opts:     rateLimitOptions{Rate: 1, Burst: 2, Key: rateLimitKeyIP},
+			requests: []string{"/", "/", "/"},
+			expected: []string{"200 2 1 1", "200 2 0 2", "429 2 0 2 1"},
+		},
+		{
+			name:     "route",
+			opts:     rateLimitOptions{Rate: 1, Burst: 1, Key: rateLimitKeyIP, Routes: map[string]string{"/api": "0.5,2", "/health": "0"}},
+			requests: []string{"/api", "/api", "/api", "/", "/", "/health"},
+			expected: []string{"200 2 1 2", "200 2 0 4", "429 2 0 4 2", "200 1 0 1", "429 1 0 1 1", "200"},
+		},
+		{
+			name:     "route_segments",
+			opts:     rateLimitOptions{Rate: 1, Burst: 1, Key: rateLimitKeyIP, Routes: map[string]string{"/api": "0"}},
+			requests: []string{"/api/users", "/apiary", "/apiary"},
+			expected: []string{"200", "200 1 0 1", "429 1 0 1 1"},
+		},
+		{
+			name:     "host_route",
+			opts:     rateLimitOptions{Rate: 1, Burst: 1, Key: rateLimitKeyIP, Routes: map[string]string{"example.com/": "0"}},
+			requests: []string{"/", "/"},
+			expected: []string{"200", "200"},
+		},
+		{
+			name:     "header",
+			opts:     rateLimitOptions{Rate: 1, Burst: 1, Key: "header:X-Api-Key"},
+			requests: []string{"/?key=a", "/?key=b", "/?key=a"},
+			expected: []string{"200 1 0 1", "200 1 0 1", "429 1 0 1 1"},
+		},
+		{
+			name:     "max_keys",
+			opts:     rateLimitOptions{Rate: 1, Burst: 1, Key: "header:X-Api-Key", MaxKeys: 1},
+			requests: []string{"/?key=a", "/?key=b", "/?key=a"},
+			expected: []string{"200 1 0 1", "200 1 0 1", "200 1 0 1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.opts.MaxKeys == 0 {
+				test.opts.MaxKeys = 100
+			}
+			limiter, err := newRateLimiter(test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := limiter.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			results := []string{}
+			for _, target := range test.requests {
+				req := httptest.NewRequest("GET", target, nil)
+				if key := req.URL.Query().Get("key"); key != "" {
+					req.Header.Set("X-Api-Key", key)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				result := []string{strconv.Itoa(rec.Code)}
+				for _, header := range []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"} {
+					if value := rec.Header().Get(header); value != "" {
+						result = append(result, value)
+					}
+				}
+				results = append(results, strings.Join(result, " "))
+			}
+			if strings.Join(results, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(results, "\n"))
+			}
+		})
+	}
+}
+
+func TestNewRateLimiterErrors(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		opts          rateLimitOptions
+		expectedError string
+	}{
+		{
+			name:          "unknown_key",
+			opts:          rateLimitOptions{Rate: 1, Burst: 1, Key: "cookie", MaxKeys: 10},
+			expectedError: "unknown rate limit key 'cookie'",
+		},
+		{
+			name:          "burst",
+			opts:          rateLimitOptions{Rate: 1, Burst: 0, Key: rateLimitKeyIP, MaxKeys: 10},
+			expectedError: "invalid rate limit burst 0",
+		},
+		{
+			name:          "max_keys",
+			opts:          rateLimitOptions{Rate: 1, Burst: 1, Key: rateLimitKeyIP, MaxKeys: 0},
+			expectedError: "invalid rate limit max keys 0",
+		},
+		{
+			name:          "route",
+			opts:          rateLimitOptions{Rate: 1, Burst: 1, Key: rateLimitKeyIP, MaxKeys: 10, Routes: map[string]string{"/api": "fast"}},
+			expectedError: "rate limit '/api'",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newRateLimiter(test.opts)
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("expected error '%s', got %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	limiter, err := newRateLimiter(rateLimitOptions{Rate: 2, Burst: 2, Key: rateLimitKeyIP, MaxKeys: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := limiter.rules[0]
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if !limiter.take(rule, "key", now).allowed {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+	if result := limiter.take(rule, "key", now); result.allowed || result.retryAfter != 500*time.Millisecond {
+		t.Fatalf("expected request to be limited for 500ms, got: %+v", result)
+	}
+	if !limiter.take(rule, "key", now.Add(500*time.Millisecond)).allowed {
+		t.Fatal("expected request to be allowed after refill")
+	}
+}
+
+func TestAuthRateLimitHandler(t *testing.T) {
+	hash := sha1.Sum([]byte("secret"))
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	writeTestFile(t, file, []byte("bob:{SHA}"+base64.StdEncoding.EncodeToString(hash[:])+"\n"))
+
+	for _, test := range []struct {
+		name          string
+		key           string
+		password      string
+		expectedCodes []int
+	}{
+		{
+			name:          "ip_failed_auth",
+			key:           rateLimitKeyIP,
+			password:      "wrong",
+			expectedCodes: []int{http.StatusUnauthorized, http.StatusTooManyRequests},
+		},
+		{
+			name:          "ip",
+			key:           rateLimitKeyIP,
+			password:      "secret",
+			expectedCodes: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:          "identity",
+			key:           rateLimitKeyIdentity,
+			password:      "secret",
+			expectedCodes: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			args := []string{"-auth-htpasswd", file, "-rate-limit", "1", "-rate-limit-burst", "1", "-rate-limit-key", test.key}
+			c, err := loadServerConfig(fs, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reloader := newConfigReloader(fs, args, newLogLevelController(c.logLevel))
+			handler, err := authRateLimitHandler(reloader, c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			codes := []int{}
+			for range len(test.expectedCodes) {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.SetBasicAuth("bob", test.password)
+				handler.ServeHTTP(w, r)
+				codes = append(codes, w.Code)
+			}
+			if !slices.Equal(codes, test.expectedCodes) {
+				t.Errorf("expected status codes %v, got %v", test.expectedCodes, codes)
+			}
+		})
+	}
+}
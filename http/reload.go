@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+)
+
+// swappableHandler forwards requests to a handler which can be replaced at
+// runtime. Requests which are in-flight during a swap finish with the old
+// handler.
+type swappableHandler struct {
+	handler atomic.Pointer[http.Handler]
+}
+
+func newSwappableHandler(h http.Handler) *swappableHandler {
+	s := &swappableHandler{}
+	s.swap(h)
+	return s
+}
+
+func (s *swappableHandler) swap(h http.Handler) {
+	s.handler.Store(&h)
+}
+
+func (s *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.handler.Load()).ServeHTTP(w, r)
+}
+
+// certificateStore holds the server certificate. It is used as
+// tls.Config.GetCertificate, so that the certificate can be replaced without
+// a restart.
+type certificateStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func newCertificateStore(certFile, keyFile string) (*certificateStore, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &certificateStore{}
+	s.cert.Store(&cert)
+	return s, nil
+}
+
+func (s *certificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// reloadableHandler is a middleware which is rebuilt from the config if one
+// of its settings changed.
+type reloadableHandler struct {
+	settings []string
+	next     http.Handler
+	build    func(c *serverConfig, next http.Handler) (http.Handler, error)
+	handler  *swappableHandler
+}
+
+// configReloader re-reads the config file and the environment on SIGHUP and
+// applies the settings which can be changed at runtime: the log level, the
+// registered handlers (see handler), the proxy routes and the TLS
+// certificate. The new config is validated as a whole before anything is
+// applied. Changes of other settings (e.g. -addr) are logged as ignored and
+// need a restart.
+type configReloader struct {
+	args []string
+	// flags of the running config to find the changed settings
+	current *flag.FlagSet
+
+	levelController *logLevelController
+	handlers        []reloadableHandler
+	router          *proxyRouter
+	certs           *certificateStore
+}
+
+// proxyRouteSettings are the settings of the proxy routes. The routes file
+// is read again on each reload, the routing table is only rebuilt if the
+// routes changed.
+var proxyRouteSettings = []string{"route", "route-rewrite", "routes-file", "upstream", "request-header", "response-header"}
+
+// newConfigReloader returns a reloader for the config which was loaded with
+// fs and args (see loadServerConfig).
+func newConfigReloader(fs *flag.FlagSet, args []string, levelController *logLevelController) *configReloader {
+	return &configReloader{
+		args:            args,
+		current:         fs,
+		levelController: levelController,
+	}
+}
+
+// handler builds the middleware for c and next. It is rebuilt on a reload if
+// one of the settings changed.
+func (r *configReloader) handler(c *serverConfig, next http.Handler, settings []string, build func(c *serverConfig, next http.Handler) (http.Handler, error)) (http.Handler, error) {
+	h, err := build(c, next)
+	if err != nil {
+		return nil, err
+	}
+	swappable := newSwappableHandler(h)
+	r.handlers = append(r.handlers, reloadableHandler{
+		settings: settings,
+		next:     next,
+		build:    build,
+		handler:  swappable,
+	})
+	return swappable, nil
+}
+
+// reloadable reports whether the setting can be changed at runtime.
+func (r *configReloader) reloadable(name string) bool {
+	switch {
+	case name == "config", name == "log-level":
+		return true
+	case (name == "tls-cert" || name == "tls-key") && r.certs != nil:
+		return true
+	case slices.Contains(proxyRouteSettings, name) && r.router != nil:
+		return true
+	}
+	for _, h := range r.handlers {
+		if slices.Contains(h.settings, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// settingChange is a setting with a new value.
+type settingChange struct {
+	name     string
+	oldValue string
+	newValue string
+}
+
+// changedSettings compares the string representations of the flags. Flag
+// values have to return the current setting in String (see funcValue).
+func changedSettings(oldFlags, newFlags *flag.FlagSet) []settingChange {
+	changes := []settingChange{}
+	newFlags.VisitAll(func(f *flag.Flag) {
+		old := oldFlags.Lookup(f.Name)
+		if old == nil || old.Value.String() == f.Value.String() {
+			return
+		}
+		changes = append(changes, settingChange{
+			name:     f.Name,
+			oldValue: old.Value.String(),
+			newValue: f.Value.String(),
+		})
+	})
+	return changes
+}
+
+func changesAttr(key string, changes []settingChange) slog.Attr {
+	attrs := []any{}
+	for _, change := range changes {
+		attrs = append(attrs, slog.Group(change.name, "old", change.oldValue, "new", change.newValue))
+	}
+	return slog.Group(key, attrs...)
+}
+
+// reload loads the config and applies it if it is valid.
+func (r *configReloader) reload() error {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	c, err := loadServerConfig(fs, r.args)
+	if err != nil {
+		return err
+	}
+
+	applied := []settingChange{}
+	ignored := []settingChange{}
+	for _, change := range changedSettings(r.current, fs) {
+		if r.reloadable(change.name) {
+			applied = append(applied, change)
+		} else {
+			ignored = append(ignored, change)
+		}
+	}
+	changed := func(settings ...string) bool {
+		return slices.ContainsFunc(applied, func(change settingChange) bool {
+			return slices.Contains(settings, change.name)
+		})
+	}
+
+	// validate everything before anything is applied
+	errs := []error{}
+	handlers := make([]http.Handler, len(r.handlers))
+	for i, h := range r.handlers {
+		if !changed(h.settings...) {
+			continue
+		}
+		handlers[i], err = h.build(c, h.next)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var table *routingTable
+	if r.router != nil {
+		table, err = r.router.newTable(c.loadProxyRoutes)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var certs *certificateStore
+	if r.certs != nil {
+		certs, err = newCertificateStore(c.tlsCert, c.tlsKey)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		if table != nil {
+			table.close()
+		}
+		return err
+	}
+
+	if changed("log-level") {
+		r.levelController.Configure(c.logLevel)
+	}
+	for i, h := range r.handlers {
+		if handlers[i] != nil {
+			h.handler.swap(handlers[i])
+		}
+	}
+	if table != nil {
+		r.router.setTable(table)
+	}
+	if certs != nil {
+		r.certs.cert.Store(certs.cert.Load())
+	}
+	r.current = fs
+
+	slog.Info("reloaded config", changesAttr("changed", applied))
+	if len(ignored) > 0 {
+		slog.Warn("ignored changed settings which need a restart", changesAttr("settings", ignored))
+	}
+	return nil
+}
+
+// handleSignals reloads the config on SIGHUP until ctx is done.
+func (r *configReloader) handleSignals(ctx context.Context) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			err := r.reload()
+			if err != nil {
+				slog.Error("failed to reload config", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestReloader loads the config from args like on startup.
+func newTestReloader(t *testing.T, args []string) (*configReloader, *serverConfig) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	c, err := loadServerConfig(fs, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newConfigReloader(fs, args, newLogLevelController(c.logLevel)), c
+}
+
+func TestConfigReloader(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		args          []string
+		config        string
+		newConfig     string
+		expectedError string
+		expectedLevel slog.Level
+		// expectedCode is the status code of the second request, the first
+		// one has to pass
+		expectedCode   int
+		expectedLogs   []string
+		unexpectedLogs []string
+	}{
+		{
+			name:          "apply",
+			config:        "log-level: INFO\n",
+			newConfig:     "log-level: WARN\nrate-limit: 1\nrate-limit-burst: 1\naddr: ':9999'\n",
+			expectedLevel: slog.LevelWarn,
+			expectedCode:  http.StatusTooManyRequests,
+			expectedLogs: []string{
+				"changed.log-level.old=INFO changed.log-level.new=WARN",
+				"changed.rate-limit.old=0 changed.rate-limit.new=1",
+				"settings.addr.old=:8080 settings.addr.new=:9999",
+			},
+		},
+		{
+			name:           "unchanged_map",
+			config:         "log-level: INFO\nrate-limit-route: [/a=1, /b=2, /c=3, /d=4]\n",
+			newConfig:      "log-level: INFO\nrate-limit-route: [/d=4, /c=3, /b=2, /a=1]\n",
+			expectedLevel:  slog.LevelInfo,
+			expectedCode:   http.StatusOK,
+			expectedLogs:   []string{`msg="reloaded config"`},
+			unexpectedLogs: []string{"rate-limit-route"},
+		},
+		{
+			name:          "func_flags",
+			config:        "log-level: INFO\nretry-status-codes: '502'\n",
+			newConfig:     "log-level: INFO\nretry-status-codes: '502,503'\ntrusted-proxies: 10.0.0.0/8\nrequest-header: [set X-A=1, delete X-B]\n",
+			expectedLevel: slog.LevelInfo,
+			expectedCode:  http.StatusOK,
+			expectedLogs: []string{
+				"settings.retry-status-codes.old=502 settings.retry-status-codes.new=502,503",
+				"settings.trusted-proxies.old=\"\" settings.trusted-proxies.new=10.0.0.0/8",
+				`settings.request-header.old="" settings.request-header.new="set X-A=1; delete X-B"`,
+			},
+		},
+		{
+			name:          "invalid",
+			config:        "log-level: INFO\n",
+			newConfig:     "log-level: WARN\nrate-limit: 1\nrate-limit-key: foo\n",
+			expectedError: "unknown rate limit key 'foo'",
+			expectedLevel: slog.LevelInfo,
+			expectedCode:  http.StatusOK,
+		},
+		{
+			name:          "parse_error",
+			config:        "log-level: INFO\n",
+			newConfig:     "log-level: LOUD\n",
+			expectedError: "invalid value 'LOUD' for log-level",
+			expectedLevel: slog.LevelInfo,
+			expectedCode:  http.StatusOK,
+		},
+		{
+			name:          "flags_take_precedence",
+			args:          []string{"-log-level", "ERROR"},
+			config:        "log-level: INFO\n",
+			newConfig:     "log-level: WARN\n",
+			expectedLevel: slog.LevelError,
+			expectedCode:  http.StatusOK,
+			expectedLogs:  []string{`msg="reloaded config"`},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			writeTestFile(t, file, []byte(test.config))
+			args := append([]string{"-config", file}, test.args...)
+			reloader, c := newTestReloader(t, args)
+
+			requests := 0
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+			})
+			handler, err := reloader.handler(c, app, []string{"rate-limit", "rate-limit-burst", "rate-limit-key"}, func(c *serverConfig, next http.Handler) (http.Handler, error) {
+				limiter, err := newRateLimiter(c.rateLimit)
+				if err != nil {
+					return nil, err
+				}
+				if !limiter.enabled() {
+					return next, nil
+				}
+				return limiter.handler(next), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			logOutput := &bytes.Buffer{}
+			defaultLogger := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, nil)))
+			defer slog.SetDefault(defaultLogger)
+
+			writeTestFile(t, file, []byte(test.newConfig))
+			err = reloader.reload()
+			if test.expectedError == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+				t.Fatalf("expected error '%s', got %v", test.expectedError, err)
+			}
+
+			if level := reloader.levelController.Level(); level != test.expectedLevel {
+				t.Errorf("expected log level %s, got %s", test.expectedLevel, level)
+			}
+			codes := []int{}
+			for range 2 {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				codes = append(codes, w.Code)
+			}
+			if codes[0] != http.StatusOK || codes[1] != test.expectedCode {
+				t.Errorf("expected status codes %d and %d, got %v", http.StatusOK, test.expectedCode, codes)
+			}
+			expectedRequests := 2
+			if test.expectedCode != http.StatusOK {
+				expectedRequests = 1
+			}
+			if requests != expectedRequests {
+				t.Errorf("expected %d requests to the app, got %d", expectedRequests, requests)
+			}
+			for _, expected := range test.expectedLogs {
+				if !strings.Contains(logOutput.String(), expected) {
+					t.Errorf("expected '%s' in logs, got: %s", expected, logOutput)
+				}
+			}
+			for _, unexpected := range test.unexpectedLogs {
+				if strings.Contains(logOutput.String(), unexpected) {
+					t.Errorf("unexpected '%s' in logs, got: %s", unexpected, logOutput)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigReloaderRoutes(t *testing.T) {
+	upstreams := newTestUpstreams(t, 2, func(i int, w http.ResponseWriter, r *http.Request) {})
+	file := filepath.Join(t.TempDir(), "config.json")
+	writeTestFile(t, file, []byte(`{"route": ["/a=`+upstreams[0]+`"]}`))
+	args := []string{"-config", file}
+	reloader, c := newTestReloader(t, args)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := newProxyRouter(ctx, c.loadProxyRoutes, c.poolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.router = router
+
+	// unchanged routes keep the table and the state of its upstreams
+	table := router.table.Load()
+	err = reloader.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if router.table.Load() != table {
+		t.Error("expected unchanged table after reload without changes")
+	}
+
+	writeTestFile(t, file, []byte(`{"route": ["/a=`+upstreams[0]+`", "/b=`+upstreams[1]+`"]}`))
+	err = reloader.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes := len(router.table.Load().routes); routes != 2 {
+		t.Fatalf("expected 2 routes after reload, got %d", routes)
+	}
+
+	// invalid routes keep the current table
+	writeTestFile(t, file, []byte(`{"route": ["/a=://invalid"]}`))
+	err = reloader.reload()
+	if err == nil {
+		t.Fatal("expected error for invalid route")
+	}
+	if routes := len(router.table.Load().routes); routes != 2 {
+		t.Errorf("expected 2 routes after failed reload, got %d", routes)
+	}
+}
+
+func TestConfigReloaderRoutesFile(t *testing.T) {
+	upstreams := newTestUpstreams(t, 2, func(i int, w http.ResponseWriter, r *http.Request) {})
+	dir := t.TempDir()
+	routesFile := filepath.Join(dir, "routes.json")
+	writeTestFile(t, routesFile, []byte(`{"routes": [{"path_prefix": "/a", "upstreams": ["`+upstreams[0]+`"]}]}`))
+	reloader, c := newTestReloader(t, []string{"-routes-file", routesFile})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := newProxyRouter(ctx, c.loadProxyRoutes, c.poolOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.router = router
+
+	// the content of the routes file changed but not the setting
+	table := router.table.Load()
+	writeTestFile(t, routesFile, []byte(`{"routes": [{"path_prefix": "/a", "upstreams": ["`+upstreams[1]+`"]}]}`))
+	err = reloader.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := router.table.Load()
+	if current == table || current.routes[0].Upstreams[0] != upstreams[1] {
+		t.Errorf("expected new table with upstream %s after reload", upstreams[1])
+	}
+}
+
+func TestConfigReloaderTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	reloader, c := newTestReloader(t, []string{"-tls-cert", certFile, "-tls-key", keyFile})
+	certs, err := newCertificateStore(c.tlsCert, c.tlsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.certs = certs
+	old, _ := certs.GetCertificate(nil)
+
+	// rotate the certificate
+	newCertFile, newKeyFile := writeTestCert(t, t.TempDir(), "server")
+	for src, dst := range map[string]string{newCertFile: certFile, newKeyFile: keyFile} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, dst, data)
+	}
+	err = reloader.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := certs.GetCertificate(nil)
+	if bytes.Equal(current.Certificate[0], old.Certificate[0]) {
+		t.Error("expected new certificate after reload")
+	}
+
+	// a broken key file keeps the current certificate
+	writeTestFile(t, keyFile, []byte("invalid"))
+	err = reloader.reload()
+	if err == nil {
+		t.Fatal("expected error for invalid key")
+	}
+	if latest, _ := certs.GetCertificate(nil); latest != current {
+		t.Error("expected unchanged certificate after failed reload")
+	}
+}
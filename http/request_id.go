@@ -7,11 +7,14 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"log/slog"
 	"net/http"
 )
 
-func requestIDMiddleware(next http.Handler) http.Handler {
+// requestIDMiddleware adds a random request ID to the request context. If
+// inFlight is set the request is tracked until it is served.
+func requestIDMiddleware(next http.Handler, inFlight *inFlightRequests) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id := requestID{}
 		_, err := rand.Read(id[:])
@@ -19,6 +22,11 @@ func requestIDMiddleware(next http.Handler) http.Handler {
 			slog.LogAttrs(r.Context(), slog.LevelError, "failed to generate request id", slog.Any("err", err))
 		}
 		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		if inFlight != nil && !id.IsZero() {
+			var done func()
+			ctx, done = inFlight.add(r.WithContext(ctx), id)
+			defer done()
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -38,6 +46,20 @@ func (r requestID) String() string {
 	return base64.RawURLEncoding.EncodeToString(r[:])
 }
 
+// parseRequestID parses the string representation of a request ID.
+func parseRequestID(s string) (requestID, error) {
+	id := requestID{}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return id, fmt.Errorf("invalid request ID: %w", err)
+	}
+	if len(data) != len(id) {
+		return id, fmt.Errorf("invalid request ID: expected %d bytes, got %d", len(id), len(data))
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
 // Key to use when setting the request ID.
 type ctxKeyRequestID int
 
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type retryOptions struct {
+	// MaxRetries is the maximum number of retries per request. 0
+	// disables retries.
+	MaxRetries int
+	// StatusCodes are the upstream response codes which are retried.
+	// Connect errors are always retried.
+	StatusCodes []int
+	// MaxBodySize is the maximum size of a request body which is
+	// buffered to be able to send it again.
+	MaxBodySize int64
+	// Backoff is the base of the exponential backoff between retries
+	// and MaxBackoff its upper limit. The effective wait time is a random
+	// value between 0 and the backoff (full jitter).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// BudgetRatio limits the retries to this ratio of requests.
+	BudgetRatio float64
+}
+
+func defaultRetryOptions() retryOptions {
+	return retryOptions{
+		MaxRetries:  2,
+		StatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		MaxBodySize: 64 * 1024,
+		Backoff:     50 * time.Millisecond,
+		MaxBackoff:  time.Second,
+		BudgetRatio: 0.2,
+	}
+}
+
+// retryBudget limits retries to a ratio of the requests, so that retries do
+// not multiply the load on upstreams which are overloaded anyway. Each request
+// deposits ratio tokens and each retry withdraws one token.
+type retryBudget struct {
+	mu        sync.Mutex
+	ratio     float64
+	tokens    float64
+	maxTokens float64
+}
+
+// minRetryTokens allows some retries if there is only little traffic.
+const minRetryTokens = 10
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{
+		ratio:     ratio,
+		tokens:    minRetryTokens,
+		maxTokens: minRetryTokens,
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, b.maxTokens)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// retryTransport retries failed upstream requests on other upstreams of the
+// pool. Requests without a body (e.g. idempotent GET requests) and requests
+// with a body up to MaxBodySize are retried on connect errors and on the
+// configured status codes. Idempotent requests are also retried on other
+// transport errors.
+type retryTransport struct {
+	next   http.RoundTripper
+	pool   *upstreamPool
+	opts   retryOptions
+	budget *retryBudget
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.opts.MaxRetries <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	t.budget.deposit()
+
+	body, retryable, err := t.bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if !retryable {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	u := getUpstream(ctx)
+	tried := []*upstream{}
+	attempt := 0
+	for {
+		out := req
+		if attempt > 0 {
+			out = req.Clone(ctx)
+			if u != nil {
+				next, release, err := t.pool.acquire(req, tried...)
+				if err != nil {
+					return nil, err
+				}
+				defer release()
+				rewriteUpstream(out.URL, u, next)
+				out = out.WithContext(context.WithValue(ctx, upstreamKey, next))
+				u = next
+			}
+		}
+		if body != nil {
+			out.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.next.RoundTrip(out)
+		if !t.shouldRetry(ctx, req, resp, err) || attempt >= t.opts.MaxRetries || !t.budget.withdraw() {
+			if attempt > 0 {
+				addAccessLogAttrs(ctx, slog.Int("retries", attempt))
+			}
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		slog.DebugContext(ctx, "retry upstream request", "attempt", attempt+1, "status", statusOf(resp), "err", err)
+
+		tried = append(tried, u)
+		attempt++
+		timer := time.NewTimer(t.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// bufferBody reads the request body if it is not larger than MaxBodySize. It
+// reports whether the request can be retried.
+func (t *retryTransport) bufferBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if isGRPCRequest(req) {
+		// gRPC request bodies are streams, waiting for them to be
+		// buffered would block the call
+		return nil, false, nil
+	}
+	if req.ContentLength > t.opts.MaxBodySize {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, t.opts.MaxBodySize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > t.opts.MaxBodySize {
+		// body is too large to be buffered, forward what we read
+		// and the rest
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+func (t *retryTransport) shouldRetry(ctx context.Context, req *http.Request, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// the request could have been processed by the upstream if
+		// the error occurred after connecting
+		return isConnectError(err) || slices.Contains(idempotentMethods, req.Method)
+	}
+	return slices.Contains(t.opts.StatusCodes, resp.StatusCode)
+}
+
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	backoff := t.opts.Backoff << (attempt - 1)
+	if backoff > t.opts.MaxBackoff || backoff <= 0 {
+		backoff = t.opts.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// isConnectError reports whether the request failed before it was sent to
+// the upstream. Only these errors are safe to retry for all requests.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return false
+}
+
+// rewriteUpstream replaces the upstream old in u with upstream new.
+func rewriteUpstream(u *url.URL, old *upstream, new *upstream) {
+	u.Scheme = new.URL.Scheme
+	u.Host = new.URL.Host
+	if old.URL.Path != new.URL.Path {
+		u.Path = singleJoiningSlash(new.URL.Path, strings.TrimPrefix(u.Path, old.URL.Path))
+		u.RawPath = ""
+	}
+}
+
+func statusOf(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	upstreams := newTestUpstreams(t, 2, func(i int, w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if i == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintf(w, "%d %s", i, body)
+	})
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	for _, test := range []struct {
+		name            string
+		upstreams       []string
+		method          string
+		body            string
+		expectedCode    int
+		expectedBody    string
+		expectedRetries bool
+	}{
+		{
+			name:            "status_code",
+			upstreams:       upstreams,
+			method:          "GET",
+			expectedCode:    200,
+			expectedBody:    "1 ",
+			expectedRetries: true,
+		},
+		{
+			name:            "connect_error",
+			upstreams:       []string{closed.URL, upstreams[1]},
+			method:          "GET",
+			expectedCode:    200,
+			expectedBody:    "1 ",
+			expectedRetries: true,
+		},
+		{
+			name:            "buffered_body",
+			upstreams:       upstreams,
+			method:          "POST",
+			body:            "small",
+			expectedCode:    200,
+			expectedBody:    "1 small",
+			expectedRetries: true,
+		},
+		{
+			name:         "body_too_large",
+			upstreams:    upstreams,
+			method:       "POST",
+			body:         strings.Repeat("x", 100),
+			expectedCode: 503,
+			expectedBody: "0 " + strings.Repeat("x", 100),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaultUpstreamPoolOptions()
+			opts.Retry.MaxBodySize = 10
+			opts.Retry.Backoff = time.Millisecond
+			pool, err := newUpstreamPool(test.upstreams, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// start with the first upstream
+			pool.counter.Store(uint64(len(test.upstreams) - 1))
+
+			buf := &bytes.Buffer{}
+			handler := logHandler(forwardHandler(pool, headerRules{}), slog.New(slog.NewTextHandler(buf, nil)), nil)
+
+			req := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != test.expectedCode || rec.Body.String() != test.expectedBody {
+				t.Fatalf("expected: %d '%s', got: %d '%s'", test.expectedCode, test.expectedBody, rec.Code, rec.Body.String())
+			}
+			if strings.Contains(buf.String(), "retries=1") != test.expectedRetries {
+				t.Fatalf("unexpected retries in access log: %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5)
+	retries := 0
+	for i := 0; i < 100; i++ {
+		b.deposit()
+		if b.withdraw() {
+			retries++
+		}
+	}
+	if retries > minRetryTokens+50 {
+		t.Fatalf("expected at most %d retries, got %d", minRetryTokens+50, retries)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	requests := 0
+	upstreams := newTestUpstreams(t, 1, func(i int, w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	opts := defaultUpstreamPoolOptions()
+	opts.MaxFailures = 0
+	opts.BreakerFailures = 3
+	opts.BreakerTimeout = 50 * time.Millisecond
+	pool, err := newUpstreamPool(upstreams, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := forwardHandler(pool, headerRules{})
+
+	results := doRequests(t, handler, 5, nil)
+	if results["500:"] != 3 || requests != 3 {
+		t.Fatalf("expected 3 requests to the upstream, got: %d %v", requests, results)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got: %d %v", rec.Code, rec.Header())
+	}
+
+	// half-open lets one probe through which opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	results = doRequests(t, handler, 2, nil)
+	if results["500:"] != 1 || requests != 4 {
+		t.Fatalf("expected one probe request, got: %d %v", requests, results)
+	}
+}
+
+type errorReader struct{}
+
+func (errorReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("read failed")
+}
+
+func TestCircuitBreakerProbeBodyError(t *testing.T) {
+	requests := 0
+	upstreams := newTestUpstreams(t, 1, func(i int, w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	opts := defaultUpstreamPoolOptions()
+	opts.MaxFailures = 0
+	opts.BreakerFailures = 1
+	opts.BreakerTimeout = 50 * time.Millisecond
+	pool, err := newUpstreamPool(upstreams, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := forwardHandler(pool, headerRules{})
+
+	results := doRequests(t, handler, 1, nil)
+	if results["500:"] != 1 {
+		t.Fatalf("expected failed request to open the breaker, got: %v", results)
+	}
+
+	// the probe fails before it reaches the upstream, which must not keep
+	// the breaker half-open
+	time.Sleep(60 * time.Millisecond)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", io.NopCloser(errorReader{})))
+	if rec.Code != http.StatusBadGateway || requests != 1 {
+		t.Fatalf("expected failed probe without upstream request, got: %d %d", rec.Code, requests)
+	}
+
+	results = doRequests(t, handler, 2, nil)
+	if results["200:"] != 2 || requests != 3 {
+		t.Fatalf("expected next request to probe and close the breaker, got: %d %v", requests, results)
+	}
+}
@@ -1,73 +1,218 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
-	"net/url"
+	"sync"
+	"time"
 )
 
-func forwardHandler(targetURL string) (http.Handler, error) {
-	target, err := url.Parse(targetURL)
-	if err != nil {
-		return nil, err
-	}
-
+func forwardHandler(pool *upstreamPool, headers headerRules) http.Handler {
 	rewriteFunc := func(pr *httputil.ProxyRequest) {
-		// Use received X-Forwarded-For header. This can be used if you
-		// have multiple proxies in a chain. Only do this if you get
-		// request from a trusted IP source.
-		pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
-		pr.SetXForwarded()
+		// Use the part of the received X-Forwarded-For header which
+		// comes from trusted proxies (see clientIPMiddleware).
+		setXForwarded(pr)
 
-		pr.SetURL(target)
+		rewriteRoutePath(pr)
+		pr.SetURL(getUpstream(pr.In.Context()).URL)
 		// Keep the Host header of the inbound request
 		pr.Out.Host = pr.In.Host
+		applyHeaderRules(headers.Request, pr.Out.Header, pr.In)
+		setInboundRequest(pr)
 	}
 
+	// the protocol is validated by newUpstreamPool
+	transport, _ := pool.newTransport(pool.opts.Protocol)
 	proxy := &httputil.ReverseProxy{
-		Rewrite: rewriteFunc,
+		Rewrite:        rewriteFunc,
+		ModifyResponse: modifyResponseHeaders(headers),
+		ErrorHandler:   proxyErrorHandler,
+		Transport:      pool.transport(transport),
 	}
 
-	return proxy, nil
+	return pool.handler(proxy)
 }
 
-// use HTTP/1.1 on upstream if Upgrade header is used on request
-func forwardCustomTransportHandler(targetURL string) (http.Handler, error) {
-	target, err := url.Parse(targetURL)
-	if err != nil {
-		return nil, err
+// upstream protocols
+const (
+	// protocolAuto uses HTTP/2 for TLS upstreams which support it and
+	// HTTP/1.1 otherwise.
+	protocolAuto = "auto"
+	// protocolHTTP1 always uses HTTP/1.1.
+	protocolHTTP1 = "http1"
+	// protocolH2C uses cleartext HTTP/2 with prior knowledge, e.g. for
+	// gRPC upstreams.
+	protocolH2C = "h2c"
+)
+
+// newUpstreamTransport returns the transport for upstreams with the
+// protocol.
+func newUpstreamTransport(protocol string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch protocol {
+	case protocolAuto, "":
+	case protocolHTTP1:
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	case protocolH2C:
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unknown upstream protocol '%s'", protocol)
 	}
+	return transport, nil
+}
 
+// use HTTP/1.1 on upstream if Upgrade header is used on request
+func forwardCustomTransportHandler(pool *upstreamPool, headers headerRules) http.Handler {
 	rewriteFunc := func(pr *httputil.ProxyRequest) {
-		pr.SetXForwarded()
-		pr.SetURL(target)
+		setXForwarded(pr)
+		rewriteRoutePath(pr)
+		pr.SetURL(getUpstream(pr.In.Context()).URL)
+		applyHeaderRules(headers.Request, pr.Out.Header, pr.In)
+		setInboundRequest(pr)
 	}
+	modifyResponse := modifyResponseHeaders(headers)
 
-	http11Transport := http.DefaultTransport.(*http.Transport).Clone()
-	http11Transport.ForceAttemptHTTP2 = false
-	http11Transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
-	// add other settings. e.g. ignore TLS validation
-	// http11Transport.TLSClientConfig = &tls.Config{
-	// 	InsecureSkipVerify: true,
-	// }
-
+	http11Transport, _ := pool.newTransport(protocolHTTP1)
 	http11Upstream := &httputil.ReverseProxy{
-		Rewrite:   rewriteFunc,
-		Transport: http11Transport,
+		Rewrite:        rewriteFunc,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   proxyErrorHandler,
+		Transport:      pool.transport(http11Transport),
 	}
 
-	defaultTransport := http.DefaultTransport.(*http.Transport).Clone()
+	// the protocol is validated by newUpstreamPool
+	defaultTransport, _ := pool.newTransport(pool.opts.Protocol)
 	defaultUpstream := &httputil.ReverseProxy{
-		Rewrite:   rewriteFunc,
-		Transport: defaultTransport,
+		Rewrite:        rewriteFunc,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   proxyErrorHandler,
+		Transport:      pool.transport(defaultTransport),
 	}
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if pool.opts.Protocol == protocolH2C {
+		// gRPC streams messages in both directions, pass every
+		// chunk of the response on without delay
+		defaultUpstream.FlushInterval = -1
+	}
+	return pool.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Upgrade is only supported by HTTP/1.1
 		if r.Proto == "HTTP/1.1" && r.Header.Get("Upgrade") != "" {
 			http11Upstream.ServeHTTP(w, r)
 		} else {
 			defaultUpstream.ServeHTTP(w, r)
 		}
-	}), nil
+	}))
+}
+
+// proxyErrorHandler responds to failed upstream requests with 499 if the
+// client canceled the request, 504 if the upstream timed out and 502
+// otherwise. The error is added to the access log and not sent to the client.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	addAccessLogAttrs(r.Context(), slog.String("proxy_err", err.Error()))
+
+	var netErr net.Error
+	switch {
+	case errors.Is(r.Context().Err(), context.Canceled):
+		errorHandler(w, r, statusClientClosedRequest, "client closed request")
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		errorHandler(w, r, http.StatusGatewayTimeout, nil)
+	default:
+		errorHandler(w, r, http.StatusBadGateway, nil)
+	}
+}
+
+// upstreamTimingTransport adds the address of the upstream, the time to
+// connect to it and the time until the response headers were received to
+// the access log. The values of the last attempt are logged if the request is
+// retried.
+func upstreamTimingTransport(rt http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		var (
+			mu           sync.Mutex
+			addr         string
+			connectStart time.Time
+			connectTime  time.Duration
+		)
+		trace := &httptrace.ClientTrace{
+			ConnectStart: func(string, string) {
+				mu.Lock()
+				defer mu.Unlock()
+				connectStart = time.Now()
+			},
+			ConnectDone: func(string, string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				connectTime = time.Since(connectStart)
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				addr = info.Conn.RemoteAddr().String()
+			},
+		}
+		ctx := r.Context()
+		start := time.Now()
+		resp, err := rt.RoundTrip(r.WithContext(httptrace.WithClientTrace(ctx, trace)))
+		responseTime := time.Since(start)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if addr == "" {
+			addr = r.URL.Host
+		}
+		setAccessLogAttrs(ctx,
+			slog.String("upstream_addr", addr),
+			// 0 if a kept-alive connection was reused
+			slog.Duration("upstream_connect_time", connectTime),
+			slog.Duration("upstream_response_time", responseTime),
+		)
+		return resp, err
+	})
+}
+
+// modifyResponseHeaders returns a ReverseProxy.ModifyResponse function which
+// applies the response header rules. The templates are expanded with the
+// inbound request (see setInboundRequest). It returns nil if there are no
+// rules.
+func modifyResponseHeaders(headers headerRules) func(*http.Response) error {
+	if len(headers.Response) == 0 {
+		return nil
+	}
+	return func(resp *http.Response) error {
+		in, ok := resp.Request.Context().Value(inboundRequestKey).(*http.Request)
+		if !ok {
+			in = resp.Request
+		}
+		applyHeaderRules(headers.Response, resp.Header, in)
+		return nil
+	}
+}
+
+type ctxKeyInboundRequest int
+
+const inboundRequestKey ctxKeyInboundRequest = 0
+
+// setInboundRequest stores the inbound request in the context of the
+// outbound request. The outbound request has the host and the path of the
+// upstream, which is not what response header rules refer to.
+func setInboundRequest(pr *httputil.ProxyRequest) {
+	pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), inboundRequestKey, pr.In))
+}
+
+// setXForwarded sets the X-Forwarded-* headers. The trusted part of the
+// inbound forwarding chain determined by clientIPMiddleware is kept and the
+// address of the direct peer is appended.
+func setXForwarded(pr *httputil.ProxyRequest) {
+	if info, ok := getClientInfo(pr.In.Context()); ok && len(info.ForwardedFor) > 0 {
+		pr.Out.Header["X-Forwarded-For"] = info.ForwardedFor
+	}
+	pr.SetXForwarded()
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyErrorHandler(t *testing.T) {
+	slowUpstreams := newTestUpstreams(t, 1, func(i int, w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	closedUpstream := httptest.NewServer(http.NotFoundHandler())
+	closedUpstream.Close()
+
+	for _, test := range []struct {
+		name         string
+		upstream     string
+		cancel       bool
+		expectedCode int
+		expectedLog  []string
+	}{
+		{
+			name:         "ok",
+			upstream:     newTestUpstreams(t, 1, nil)[0],
+			expectedCode: http.StatusOK,
+			expectedLog:  []string{"code=200", "upstream_addr=127.0.0.1:", "upstream_connect_time=", "upstream_response_time="},
+		},
+		{
+			name:         "connect_error",
+			upstream:     closedUpstream.URL,
+			expectedCode: http.StatusBadGateway,
+			expectedLog:  []string{"code=502", "proxy_err=", "connection refused"},
+		},
+		{
+			name:         "timeout",
+			upstream:     slowUpstreams[0],
+			expectedCode: http.StatusGatewayTimeout,
+			expectedLog:  []string{"code=504", "timeout awaiting response headers"},
+		},
+		{
+			name:         "client_abort",
+			upstream:     slowUpstreams[0],
+			cancel:       true,
+			expectedCode: statusClientClosedRequest,
+			expectedLog:  []string{"code=499", "context canceled"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaultUpstreamPoolOptions()
+			opts.Retry.MaxRetries = 0
+			opts.ResponseTimeout = 50 * time.Millisecond
+			pool, err := newUpstreamPool([]string{test.upstream}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			handler := logHandler(forwardHandler(pool, headerRules{}), slog.New(slog.NewTextHandler(buf, nil)), nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+			if rec.Code != test.expectedCode {
+				t.Errorf("expected code %d, got: %d", test.expectedCode, rec.Code)
+			}
+			for _, expected := range test.expectedLog {
+				if !strings.Contains(buf.String(), expected) {
+					t.Errorf("expected log to contain '%s', got: %s", expected, buf)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// routeMatcher finds the route of a request among routes in the format
+// [host]/path-prefix. Routes with a host are matched before routes without a
+// host and longer path prefixes before shorter ones. Routes with the same
+// specificity are matched in the order they were added.
+type routeMatcher[T any] struct {
+	routes []matcherRoute[T]
+}
+
+type matcherRoute[T any] struct {
+	host       string
+	pathPrefix string
+	value      T
+}
+
+// add adds a route. An empty host matches any host.
+func (m *routeMatcher[T]) add(host, pathPrefix string, value T) {
+	m.routes = append(m.routes, matcherRoute[T]{
+		host:       strings.ToLower(host),
+		pathPrefix: pathPrefix,
+		value:      value,
+	})
+	slices.SortStableFunc(m.routes, func(a, b matcherRoute[T]) int {
+		if (a.host == "") != (b.host == "") {
+			if a.host != "" {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(len(b.pathPrefix), len(a.pathPrefix))
+	})
+}
+
+// match returns the value of the first route which matches the request. It
+// reports false if no route matches.
+func (m *routeMatcher[T]) match(r *http.Request) (T, bool) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(host)
+	for _, route := range m.routes {
+		if route.host != "" && route.host != host {
+			continue
+		}
+		if matchPathPrefix(r.URL.Path, route.pathPrefix) {
+			return route.value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// values returns the values of the routes in the order they are matched.
+func (m *routeMatcher[T]) values() []T {
+	values := make([]T, 0, len(m.routes))
+	for _, route := range m.routes {
+		values = append(values, route.value)
+	}
+	return values
+}
+
+// matchPathPrefix reports whether the path starts with the prefix at a
+// segment boundary: /api matches /api and /api/users but not /apiary.
+func matchPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
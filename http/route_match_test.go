@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestMatchPathPrefix(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		prefix   string
+		expected bool
+	}{
+		{path: "/api", prefix: "/api", expected: true},
+		{path: "/api/users", prefix: "/api", expected: true},
+		{path: "/apiary", prefix: "/api", expected: false},
+		{path: "/api/users", prefix: "/api/", expected: true},
+		{path: "/api", prefix: "/api/", expected: false},
+		{path: "/anything", prefix: "/", expected: true},
+	} {
+		t.Run(test.path+"_"+test.prefix, func(t *testing.T) {
+			if matched := matchPathPrefix(test.path, test.prefix); matched != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, matched)
+			}
+		})
+	}
+}
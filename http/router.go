@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// routeRegistry registers the routes of the application on a http.ServeMux.
+// The matched pattern is stored in the request context (see getRoute) and
+// added to the access log, so that requests can be grouped by the
+// low-cardinality pattern (/users/{id}) instead of the request URI.
+type routeRegistry struct {
+	mux    *http.ServeMux
+	routes map[string]*registeredRoute
+}
+
+func newRouteRegistry() *routeRegistry {
+	return &routeRegistry{
+		mux:    http.NewServeMux(),
+		routes: map[string]*registeredRoute{},
+	}
+}
+
+// Handle registers the handler for the pattern in the syntax of
+// http.ServeMux without a method, e.g. /users/{id}. The handler only serves
+// the given methods and other methods are rejected with 405. All methods are
+// served if none are given. GET implies HEAD. A pattern can be registered
+// multiple times with different methods. Handle panics if a method is
+// already registered for the pattern.
+func (rr *routeRegistry) Handle(pattern string, handler http.Handler, methods ...string) {
+	route, ok := rr.routes[pattern]
+	if !ok {
+		route = &registeredRoute{
+			pattern:  pattern,
+			handlers: map[string]http.Handler{},
+		}
+		// panics like ServeMux.Handle for invalid or conflicting
+		// patterns
+		rr.mux.Handle(pattern, route)
+		rr.routes[pattern] = route
+	}
+	if len(methods) == 0 {
+		methods = []string{""}
+	}
+	for _, method := range methods {
+		if _, ok := route.handlers[method]; ok {
+			panic(fmt.Sprintf("route '%s %s' is already registered", method, pattern))
+		}
+		route.handlers[method] = handler
+	}
+}
+
+// HandleFunc is like Handle for a handler function.
+func (rr *routeRegistry) HandleFunc(pattern string, handler http.HandlerFunc, methods ...string) {
+	rr.Handle(pattern, handler, methods...)
+}
+
+func (rr *routeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := rr.mux.Handler(r); pattern == "" {
+		errorHandler(w, r, http.StatusNotFound, nil)
+		return
+	}
+	rr.mux.ServeHTTP(w, r)
+}
+
+// registeredRoute dispatches the requests of a pattern by method.
+type registeredRoute struct {
+	pattern string
+	// handlers by method. The empty method serves all methods.
+	handlers map[string]http.Handler
+}
+
+func (rt *registeredRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(withRoute(r.Context(), rt.pattern))
+
+	handler, ok := rt.handlers[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		handler, ok = rt.handlers[http.MethodGet]
+	}
+	if !ok {
+		handler, ok = rt.handlers[""]
+	}
+	if !ok {
+		w.Header().Set("Allow", strings.Join(rt.allowedMethods(), ", "))
+		errorHandler(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+func (rt *registeredRoute) allowedMethods() []string {
+	methods := []string{}
+	for method := range rt.handlers {
+		methods = append(methods, method)
+		if method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	slices.Sort(methods)
+	return slices.Compact(methods)
+}
+
+type ctxKeyRoute int
+
+// routeKey is the key that holds the matched route pattern in a request
+// context.
+const routeKey ctxKeyRoute = 0
+
+// withRoute stores the matched route in the context and adds it to the
+// access log and the in-flight request.
+func withRoute(ctx context.Context, route string) context.Context {
+	setAccessLogAttrs(ctx, slog.String("route", route))
+	updateInFlightRequest(ctx, func(req *inFlightRequest) {
+		req.route = route
+	})
+	return context.WithValue(ctx, routeKey, route)
+}
+
+// getRoute returns the matched route pattern or an empty string if no route
+// matched.
+func getRoute(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	route, _ := ctx.Value(routeKey).(string)
+	return route
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteRegistry(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(newRequestIDLogger(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+
+	app := newRouteRegistry()
+	app.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		logger.InfoContext(r.Context(), "get user")
+		fmt.Fprintf(w, "get %s %s", getRoute(r.Context()), r.PathValue("id"))
+	}, http.MethodGet)
+	app.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "delete %s", r.PathValue("id"))
+	}, http.MethodDelete)
+	app.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "static %s", getRoute(r.Context()))
+	})
+
+	for _, test := range []struct {
+		name           string
+		method         string
+		path           string
+		expectedCode   int
+		expectedBody   string
+		expectedHeader http.Header
+		expectedLog    []string
+		unexpectedLog  []string
+	}{
+		{
+			name:         "pattern",
+			method:       http.MethodGet,
+			path:         "/users/123",
+			expectedCode: http.StatusOK,
+			expectedBody: "get /users/{id} 123",
+			expectedLog: []string{
+				`msg="get user" route=/users/{id}`,
+				`route=/users/{id}`,
+			},
+			unexpectedLog: []string{"/users/123"},
+		},
+		{
+			name:         "head",
+			method:       http.MethodHead,
+			path:         "/users/123",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "method",
+			method:       http.MethodDelete,
+			path:         "/users/123",
+			expectedCode: http.StatusOK,
+			expectedBody: "delete 123",
+		},
+		{
+			name:           "method_not_allowed",
+			method:         http.MethodPost,
+			path:           "/users/123",
+			expectedCode:   http.StatusMethodNotAllowed,
+			expectedBody:   "Method Not Allowed",
+			expectedHeader: http.Header{"Allow": {"DELETE, GET, HEAD"}},
+			expectedLog:    []string{"code=405", "route=/users/{id}"},
+		},
+		{
+			name:         "all_methods",
+			method:       http.MethodPost,
+			path:         "/static/app.js",
+			expectedCode: http.StatusOK,
+			expectedBody: "static /static/",
+		},
+		{
+			name:          "not_found",
+			method:        http.MethodGet,
+			path:          "/unknown?token=secret",
+			expectedCode:  http.StatusNotFound,
+			expectedBody:  "Not Found",
+			expectedLog:   []string{"path=/unknown"},
+			unexpectedLog: []string{"secret"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf.Reset()
+			handler := logHandler(app, logger, nil)
+
+			r := httptest.NewRequest(test.method, test.path, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.expectedCode {
+				t.Errorf("expected status code %d, got %d", test.expectedCode, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), test.expectedBody) {
+				t.Errorf("expected body to contain '%s', got '%s'", test.expectedBody, w.Body.String())
+			}
+			for key, values := range test.expectedHeader {
+				if strings.Join(w.Header().Values(key), ",") != strings.Join(values, ",") {
+					t.Errorf("expected header %s %q, got %q", key, values, w.Header().Values(key))
+				}
+			}
+			for _, expected := range test.expectedLog {
+				if !strings.Contains(buf.String(), expected) {
+					t.Errorf("expected log to contain '%s', got '%s'", expected, buf.String())
+				}
+			}
+			for _, unexpected := range test.unexpectedLog {
+				if strings.Contains(buf.String(), unexpected) {
+					t.Errorf("expected log not to contain '%s', got '%s'", unexpected, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRouteRegistryDuplicate(t *testing.T) {
+	app := newRouteRegistry()
+	app.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {}, http.MethodGet)
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	app.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {}, http.MethodGet, http.MethodPost)
+}
@@ -16,6 +16,9 @@ func (h *requestIDLogger) Handle(ctx context.Context, r slog.Record) error {
 	if !id.IsZero() {
 		r.AddAttrs(slog.String("request_id", id.String()))
 	}
+	if route := getRoute(ctx); route != "" {
+		r.AddAttrs(slog.String("route", route))
+	}
 	return h.Handler.Handle(ctx, r)
 }
 
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+type staticOptions struct {
+	// Dir is the directory with the static files. An embed.FS can be
+	// served with newStaticHandler directly.
+	Dir string
+	// Prefix is the URL path under which the files are served. It is
+	// removed before the file is looked up.
+	Prefix string
+	// CacheControl maps path patterns (see path.Match) to Cache-Control
+	// header values. Patterns without a slash match the file name,
+	// others the whole path. The longest matching pattern wins.
+	CacheControl map[string]string
+	// SPAFallback serves /index.html for paths without a file extension
+	// which do not exist, so that a single-page app can do the routing.
+	SPAFallback bool
+	// DirListing lists the files of directories without an index.html.
+	DirListing bool
+}
+
+func defaultStaticOptions() staticOptions {
+	return staticOptions{
+		Prefix:       "/",
+		CacheControl: map[string]string{},
+	}
+}
+
+// staticHandler serves files of a fs.FS with strong ETags. If the client
+// accepts gzip and a file with the additional extension .gz exists, the
+// precompressed file is sent instead. The files are indexed once when the
+// handler is created, so that requests only open the file they serve.
+// Changed files are served after a restart.
+type staticHandler struct {
+	fsys  fs.FS
+	opts  staticOptions
+	files map[string]*staticFile
+}
+
+// staticFile is the indexed information of a file or directory.
+type staticFile struct {
+	dir         bool
+	modTime     time.Time
+	contentType string
+	etag        string
+	// gzip is the precompressed variant if it exists
+	gzip *staticFile
+}
+
+func newStaticHandler(fsys fs.FS, opts staticOptions) (*staticHandler, error) {
+	if !strings.HasPrefix(opts.Prefix, "/") {
+		opts.Prefix = "/" + opts.Prefix
+	}
+	if !strings.HasSuffix(opts.Prefix, "/") {
+		opts.Prefix += "/"
+	}
+	for pattern := range opts.CacheControl {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid cache control pattern '%s': %w", pattern, err)
+		}
+	}
+	files, err := indexStaticFiles(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &staticHandler{
+		fsys:  fsys,
+		opts:  opts,
+		files: files,
+	}, nil
+}
+
+// indexStaticFiles reads the information of all files of fsys and computes
+// their ETags.
+func indexStaticFiles(fsys fs.FS) (map[string]*staticFile, error) {
+	files := map[string]*staticFile{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		file, err := indexStaticFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		files[name] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, file := range files {
+		if gzip, ok := files[name+".gz"]; ok && !file.dir && !gzip.dir {
+			file.gzip = gzip
+		}
+	}
+	return files, nil
+}
+
+func indexStaticFile(fsys fs.FS, name string) (*staticFile, error) {
+	// follows symbolic links unlike the entries of fs.WalkDir
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &staticFile{dir: true}, nil
+	}
+	contentType, err := staticContentType(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	etag, err := staticETag(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return &staticFile{
+		modTime:     info.ModTime(),
+		contentType: contentType,
+		etag:        etag,
+	}, nil
+}
+
+func (s *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		errorHandler(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	if s.opts.Prefix != "/" {
+		if urlPath+"/" != s.opts.Prefix && !strings.HasPrefix(urlPath, s.opts.Prefix) {
+			errorHandler(w, r, http.StatusNotFound, nil)
+			return
+		}
+		urlPath = strings.TrimPrefix(urlPath, strings.TrimSuffix(s.opts.Prefix, "/"))
+	}
+	name := strings.TrimPrefix(urlPath, "/")
+	if name == "" {
+		name = "."
+	}
+
+	file, ok := s.files[name]
+	if ok && file.dir {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// relative links in index.html need the trailing slash
+			target := path.Base(r.URL.Path) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(name, "index.html")
+		if indexFile, ok := s.files[index]; ok && !indexFile.dir {
+			s.serveFile(w, r, index, indexFile)
+			return
+		}
+		if s.opts.DirListing {
+			s.serveDir(w, r, name)
+			return
+		}
+		ok = false
+	}
+	if !ok {
+		indexFile, ok := s.files["index.html"]
+		if s.opts.SPAFallback && path.Ext(name) == "" && ok && !indexFile.dir {
+			s.serveFile(w, r, "index.html", indexFile)
+			return
+		}
+		errorHandler(w, r, http.StatusNotFound, nil)
+		return
+	}
+	s.serveFile(w, r, name, file)
+}
+
+// serveFile sends the file. Conditional and range requests are handled by
+// http.ServeContent.
+func (s *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, file *staticFile) {
+	fileName := name
+	variant := file
+	if file.gzip != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+			fileName = name + ".gz"
+			variant = file.gzip
+		}
+	}
+
+	f, err := s.fsys.Open(fileName)
+	if err != nil {
+		s.fileError(w, r, err)
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		s.fileError(w, r, fmt.Errorf("file '%s' is not seekable", fileName))
+		return
+	}
+
+	// the content type of the uncompressed file, so that it is not
+	// sniffed from the content of a precompressed variant
+	w.Header().Set("Content-Type", file.contentType)
+	w.Header().Set("Etag", variant.etag)
+	if variant != file {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	if cacheControl := s.cacheControl("/" + name); cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	http.ServeContent(w, r, name, variant.modTime, content)
+}
+
+func (s *staticHandler) fileError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		errorHandler(w, r, http.StatusNotFound, nil)
+		return
+	}
+	slog.ErrorContext(r.Context(), "failed to serve static file", "err", err)
+	errorHandler(w, r, http.StatusInternalServerError, nil)
+}
+
+// staticContentType returns the content type of the file derived from its
+// extension or sniffed from its content.
+func staticContentType(fsys fs.FS, name string) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// staticETag returns the strong ETag of the file, which is derived from the
+// SHA-256 hash of the content.
+func staticETag(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, nil
+}
+
+// cacheControl returns the Cache-Control value of the longest pattern which
+// matches the path.
+func (s *staticHandler) cacheControl(urlPath string) string {
+	best := ""
+	for pattern := range s.opts.CacheControl {
+		name := urlPath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(urlPath)
+		}
+		matched, _ := path.Match(pattern, name)
+		if matched && (len(pattern) > len(best) || len(pattern) == len(best) && pattern < best) {
+			best = pattern
+		}
+	}
+	return s.opts.CacheControl[best]
+}
+
+func (s *staticHandler) serveDir(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		s.fileError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!doctype html>")
+	fmt.Fprintln(w, "<meta name=\"viewport\" content=\"width=device-width\">")
+	fmt.Fprintln(w, "<pre>")
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		link := url.URL{Path: entryName}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(entryName))
+	}
+	fmt.Fprintln(w, "</pre>")
+}
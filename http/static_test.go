@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestStaticHandler(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"index.html":       {Data: []byte("<html>index</html>"), ModTime: modTime},
+		"app.js":           {Data: []byte("console.log('app')"), ModTime: modTime},
+		"app.js.gz":        {Data: []byte("gzipped app"), ModTime: modTime},
+		"data":             {Data: []byte("plain text without extension"), ModTime: modTime},
+		"assets/logo.svg":  {Data: []byte("<svg></svg>"), ModTime: modTime},
+		"docs/index.html":  {Data: []byte("<html>docs</html>"), ModTime: modTime},
+		"empty/.gitignore": {Data: []byte(""), ModTime: modTime},
+	}
+	appJSETag := `"ec2cae73d63584a0d98a88640116a077"`
+
+	for _, test := range []struct {
+		name           string
+		opts           func(opts *staticOptions)
+		method         string
+		path           string
+		header         http.Header
+		expectedCode   int
+		expectedBody   string
+		expectedHeader http.Header
+	}{
+		{
+			name:           "file",
+			path:           "/app.js",
+			expectedCode:   http.StatusOK,
+			expectedBody:   "console.log('app')",
+			expectedHeader: http.Header{"Content-Type": {"text/javascript; charset=utf-8"}, "Vary": {"Accept-Encoding"}, "Content-Encoding": nil},
+		},
+		{
+			name:           "gzip_variant",
+			path:           "/app.js",
+			header:         http.Header{"Accept-Encoding": {"br, gzip"}},
+			expectedCode:   http.StatusOK,
+			expectedBody:   "gzipped app",
+			expectedHeader: http.Header{"Content-Type": {"text/javascript; charset=utf-8"}, "Vary": {"Accept-Encoding"}, "Content-Encoding": {"gzip"}},
+		},
+		{
+			name:           "gzip_not_accepted",
+			path:           "/app.js",
+			header:         http.Header{"Accept-Encoding": {"gzip;q=0"}},
+			expectedCode:   http.StatusOK,
+			expectedBody:   "console.log('app')",
+			expectedHeader: http.Header{"Content-Encoding": nil},
+		},
+		{
+			name:           "sniffed_content_type",
+			path:           "/data",
+			expectedCode:   http.StatusOK,
+			expectedBody:   "plain text without extension",
+			expectedHeader: http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Vary": nil},
+		},
+		{
+			name:         "if_none_match",
+			path:         "/app.js",
+			header:       http.Header{"If-None-Match": {appJSETag}},
+			expectedCode: http.StatusNotModified,
+		},
+		{
+			name:           "range",
+			path:           "/app.js",
+			header:         http.Header{"Range": {"bytes=0-6"}},
+			expectedCode:   http.StatusPartialContent,
+			expectedBody:   "console",
+			expectedHeader: http.Header{"Content-Range": {"bytes 0-6/18"}, "Etag": {appJSETag}},
+		},
+		{
+			name:           "index",
+			path:           "/",
+			expectedCode:   http.StatusOK,
+			expectedBody:   "<html>index</html>",
+			expectedHeader: http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		},
+		{
+			name:           "dir_redirect",
+			path:           "/docs?a=b",
+			expectedCode:   http.StatusMovedPermanently,
+			expectedHeader: http.Header{"Location": {"/docs/?a=b"}},
+		},
+		{
+			name:         "dir_index",
+			path:         "/docs/",
+			expectedCode: http.StatusOK,
+			expectedBody: "<html>docs</html>",
+		},
+		{
+			name:         "no_dir_listing",
+			path:         "/empty/",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:           "dir_listing",
+			opts:           func(opts *staticOptions) { opts.DirListing = true },
+			path:           "/empty/",
+			expectedCode:   http.StatusOK,
+			expectedBody:   `<a href=".gitignore">.gitignore</a>`,
+			expectedHeader: http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		},
+		{
+			name:         "not_found",
+			path:         "/unknown",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "path_traversal",
+			path:         "/../index.html",
+			expectedCode: http.StatusOK,
+			expectedBody: "<html>index</html>",
+		},
+		{
+			name:         "spa_fallback",
+			opts:         func(opts *staticOptions) { opts.SPAFallback = true },
+			path:         "/users/1",
+			expectedCode: http.StatusOK,
+			expectedBody: "<html>index</html>",
+		},
+		{
+			name:         "spa_fallback_with_extension",
+			opts:         func(opts *staticOptions) { opts.SPAFallback = true },
+			path:         "/missing.js",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name: "cache_control",
+			opts: func(opts *staticOptions) {
+				opts.CacheControl = map[string]string{
+					"*":          "no-cache",
+					"*.js":       "public,max-age=60",
+					"/assets/*":  "public,max-age=31536000,immutable",
+					"/assets/*x": "private",
+				}
+			},
+			path:           "/assets/logo.svg",
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Cache-Control": {"public,max-age=31536000,immutable"}},
+		},
+		{
+			name: "cache_control_file_name",
+			opts: func(opts *staticOptions) {
+				opts.CacheControl = map[string]string{
+					"*":    "no-cache",
+					"*.js": "public,max-age=60",
+				}
+			},
+			path:           "/app.js",
+			header:         http.Header{"Accept-Encoding": {"gzip"}},
+			expectedCode:   http.StatusOK,
+			expectedHeader: http.Header{"Cache-Control": {"public,max-age=60"}},
+		},
+		{
+			name:           "prefix",
+			opts:           func(opts *staticOptions) { opts.Prefix = "/static" },
+			path:           "/static/app.js",
+			expectedCode:   http.StatusOK,
+			expectedBody:   "console.log('app')",
+			expectedHeader: http.Header{"Etag": {appJSETag}},
+		},
+		{
+			name:         "outside_prefix",
+			opts:         func(opts *staticOptions) { opts.Prefix = "/static" },
+			path:         "/staticapp.js",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:           "method_not_allowed",
+			method:         http.MethodPost,
+			path:           "/app.js",
+			expectedCode:   http.StatusMethodNotAllowed,
+			expectedHeader: http.Header{"Allow": {"GET, HEAD"}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaultStaticOptions()
+			if test.opts != nil {
+				test.opts(&opts)
+			}
+			handler, err := newStaticHandler(fsys, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, test.path, nil)
+			for key, values := range test.header {
+				r.Header[key] = values
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.expectedCode {
+				t.Errorf("expected status code %d, got %d", test.expectedCode, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), test.expectedBody) {
+				t.Errorf("expected body to contain '%s', got '%s'", test.expectedBody, w.Body.String())
+			}
+			for key, values := range test.expectedHeader {
+				if strings.Join(w.Header().Values(key), ",") != strings.Join(values, ",") {
+					t.Errorf("expected header %s %q, got %q", key, values, w.Header().Values(key))
+				}
+			}
+		})
+	}
+}
+
+// openCountingFS counts the opened files. It hides the fs.StatFS of the
+// underlying file system, so that fs.Stat opens the file too.
+type openCountingFS struct {
+	fs.FS
+	opened int
+}
+
+func (f *openCountingFS) Open(name string) (fs.File, error) {
+	f.opened++
+	return f.FS.Open(name)
+}
+
+func TestStaticHandlerIndex(t *testing.T) {
+	fsys := &openCountingFS{FS: fstest.MapFS{
+		"app.js":          {Data: []byte("console.log('app')")},
+		"app.js.gz":       {Data: []byte("gzipped app")},
+		"docs/index.html": {Data: []byte("<html>docs</html>")},
+	}}
+	handler, err := newStaticHandler(fsys, defaultStaticOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requests only open the served file, the file information and the
+	// ETags are read when the handler is created
+	for _, path := range []string{"/app.js", "/docs/", "/missing"} {
+		fsys.opened = 0
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		expected := 1
+		if path == "/missing" {
+			expected = 0
+		}
+		if fsys.opened != expected {
+			t.Errorf("expected %d opened files for %s, got %d", expected, path, fsys.opened)
+		}
+	}
+}
+
+func TestStaticCacheControlFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	c, err := loadServerConfig(fs, []string{
+		"-static-cache-control", "*.js=public, max-age=31536000",
+		"-static-cache-control", "index.html=no-cache",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"*.js":       "public, max-age=31536000",
+		"index.html": "no-cache",
+	}
+	if !reflect.DeepEqual(c.staticOpts.CacheControl, expected) {
+		t.Errorf("expected %v, got %v", expected, c.staticOpts.CacheControl)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Tail based logging: Records which are below the configured log level are
+// not dropped but kept in a per request buffer. logHandler knows the outcome
+// of the request and flushes the buffer if the request failed or was slow.
+// Otherwise the buffer is discarded.
+
+// tailLogOptions configures tail based logging in logHandler.
+type tailLogOptions struct {
+	// BufferSize is the maximum number of records kept per request. If
+	// more records are logged the oldest records are dropped.
+	BufferSize int
+
+	// LatencyThreshold flushes the buffer if the request took longer. 0
+	// disables the threshold.
+	LatencyThreshold time.Duration
+}
+
+type bufferedRecord struct {
+	handler slog.Handler
+	record  slog.Record
+}
+
+type tailLogBuffer struct {
+	mu      sync.Mutex
+	size    int
+	records []bufferedRecord
+	dropped int
+}
+
+func (b *tailLogBuffer) add(h slog.Handler, r slog.Record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size <= 0 {
+		b.dropped++
+		return
+	}
+	if len(b.records) >= b.size {
+		copy(b.records, b.records[1:])
+		b.records = b.records[:len(b.records)-1]
+		b.dropped++
+	}
+	b.records = append(b.records, bufferedRecord{
+		handler: h,
+		record:  r.Clone(),
+	})
+}
+
+// flush writes all buffered records to their handler and empties the buffer.
+func (b *tailLogBuffer) flush(ctx context.Context) {
+	b.mu.Lock()
+	records, dropped := b.records, b.dropped
+	b.records, b.dropped = nil, 0
+	b.mu.Unlock()
+
+	if dropped > 0 {
+		slog.LogAttrs(ctx, slog.LevelWarn, "dropped buffered log records", slog.Int("count", dropped))
+	}
+	for _, r := range records {
+		err := r.handler.Handle(ctx, r.record)
+		if err != nil {
+			slog.LogAttrs(ctx, slog.LevelError, "failed to flush buffered log record", slog.Any("err", err))
+		}
+	}
+}
+
+// discard drops all buffered records.
+func (b *tailLogBuffer) discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records, b.dropped = nil, 0
+}
+
+type ctxKeyTailLogBuffer int
+
+const tailLogBufferKey ctxKeyTailLogBuffer = 0
+
+func withTailLogBuffer(ctx context.Context, size int) (context.Context, *tailLogBuffer) {
+	b := &tailLogBuffer{
+		size: size,
+	}
+	return context.WithValue(ctx, tailLogBufferKey, b), b
+}
+
+func getTailLogBuffer(ctx context.Context) *tailLogBuffer {
+	if ctx == nil {
+		return nil
+	}
+	b, _ := ctx.Value(tailLogBufferKey).(*tailLogBuffer)
+	return b
+}
+
+var _ slog.Handler = (*tailLogHandler)(nil)
+
+// tailLogHandler passes records which are enabled by the wrapped handler
+// through and buffers DEBUG records if the context contains a tailLogBuffer.
+type tailLogHandler struct {
+	slog.Handler
+}
+
+func newTailLogHandler(h slog.Handler) slog.Handler {
+	return &tailLogHandler{
+		Handler: h,
+	}
+}
+
+func (h *tailLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.Handler.Enabled(ctx, level) {
+		return true
+	}
+	return level >= slog.LevelDebug && getTailLogBuffer(ctx) != nil
+}
+
+func (h *tailLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.Handler.Enabled(ctx, r.Level) {
+		return h.Handler.Handle(ctx, r)
+	}
+	if b := getTailLogBuffer(ctx); b != nil {
+		b.add(h.Handler, r)
+	}
+	return nil
+}
+
+func (h *tailLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &tailLogHandler{
+		Handler: h.Handler.WithAttrs(attrs),
+	}
+}
+
+func (h *tailLogHandler) WithGroup(name string) slog.Handler {
+	return &tailLogHandler{
+		Handler: h.Handler.WithGroup(name),
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailLog(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		handler       http.HandlerFunc
+		expectFlushed bool
+	}{
+		{
+			name: "success",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				slog.DebugContext(r.Context(), "debug message")
+			},
+			expectFlushed: false,
+		},
+		{
+			name: "server_error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				slog.DebugContext(r.Context(), "debug message")
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			expectFlushed: true,
+		},
+		{
+			name: "slow",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				slog.DebugContext(r.Context(), "debug message")
+				time.Sleep(20 * time.Millisecond)
+			},
+			expectFlushed: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			logger := slog.New(newTailLogHandler(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+			defaultLogger := slog.Default()
+			slog.SetDefault(logger)
+			defer slog.SetDefault(defaultLogger)
+
+			handler := logHandler(test.handler, logger, &tailLogOptions{
+				BufferSize:       10,
+				LatencyThreshold: 10 * time.Millisecond,
+			})
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+			out := buf.String()
+			if !strings.Contains(out, "access_log") {
+				t.Fatalf("missing access log: %s", out)
+			}
+			flushed := strings.Contains(out, "debug message")
+			if flushed != test.expectFlushed {
+				t.Fatalf("expected flushed=%t, got output: %s", test.expectFlushed, out)
+			}
+			if flushed && strings.Index(out, "debug message") > strings.Index(out, "access_log") {
+				t.Fatalf("buffered records have to be written before the access log: %s", out)
+			}
+		})
+	}
+}
+
+func TestTailLogBufferSize(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := slog.NewTextHandler(buf, nil)
+	ctx, b := withTailLogBuffer(context.Background(), 2)
+	for _, msg := range []string{"one", "two", "three"} {
+		b.add(h, slog.NewRecord(time.Now(), slog.LevelDebug, msg, 0))
+	}
+	b.flush(ctx)
+	out := buf.String()
+	if strings.Contains(out, "one") || !strings.Contains(out, "two") || !strings.Contains(out, "three") {
+		t.Fatalf("expected the two latest records, got: %s", out)
+	}
+}
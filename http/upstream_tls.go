@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// upstreamTLSOptions configure TLS connections to upstreams. The files are
+// reloaded if they change.
+type upstreamTLSOptions struct {
+	// CAFile is a PEM bundle of the CAs which are trusted for upstream
+	// certificates. The system CAs are used if empty.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate for mTLS.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// ServerName overrides the server name used for SNI and certificate
+	// verification.
+	ServerName string `json:"server_name,omitempty"`
+	// MinVersion is the minimum TLS version (1.0, 1.1, 1.2, 1.3).
+	MinVersion string `json:"min_version,omitempty"`
+	// InsecureSkipVerify disables the verification of upstream
+	// certificates.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (o upstreamTLSOptions) isZero() bool {
+	return o == upstreamTLSOptions{}
+}
+
+// newUpstreamTLSConfig returns the TLS config for the options. It returns
+// nil if no option is set to use the defaults of the transport. If a CA file
+// is set, the CAs are returned as well. They are loaded again if the file
+// changes (see caReloadingTransport).
+func newUpstreamTLSConfig(opts upstreamTLSOptions) (*tls.Config, *reloadingFile[*x509.CertPool], error) {
+	if opts.isZero() {
+		return nil, nil, nil
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, nil, errors.New("upstream TLS: client certificate and key required")
+	}
+
+	config := &tls.Config{
+		ServerName:         opts.ServerName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if opts.MinVersion != "" {
+		version, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("upstream TLS: unknown version '%s'", opts.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if opts.InsecureSkipVerify {
+		slog.Warn("verification of upstream certificates is disabled")
+	}
+
+	if opts.CertFile != "" {
+		cert := &reloadingFile[tls.Certificate]{
+			files: []string{opts.CertFile, opts.KeyFile},
+			load: func() (tls.Certificate, error) {
+				return tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+			},
+		}
+		if _, err := cert.get(); err != nil {
+			return nil, nil, fmt.Errorf("upstream TLS: %w", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c, err := cert.get()
+			return &c, err
+		}
+	}
+
+	if opts.CAFile == "" || opts.InsecureSkipVerify {
+		return config, nil, nil
+	}
+	roots := &reloadingFile[*x509.CertPool]{
+		files: []string{opts.CAFile},
+		load: func() (*x509.CertPool, error) {
+			data, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in '%s'", opts.CAFile)
+			}
+			return pool, nil
+		},
+	}
+	pool, err := roots.get()
+	if err != nil {
+		return nil, nil, fmt.Errorf("upstream TLS: %w", err)
+	}
+	config.RootCAs = pool
+	return config, roots, nil
+}
+
+// caReloadingTransport uses a transport which verifies upstream certificates
+// with the current CAs. RootCAs can't be replaced after a TLS config is in
+// use, so the transport is rebuilt if the CAs changed. The idle connections
+// of the previous transport are closed.
+type caReloadingTransport struct {
+	roots        *reloadingFile[*x509.CertPool]
+	newTransport func(roots *x509.CertPool) *http.Transport
+
+	mu        sync.Mutex
+	transport *http.Transport
+	// currentRoots are the CAs of transport
+	currentRoots *x509.CertPool
+}
+
+func newCAReloadingTransport(roots *reloadingFile[*x509.CertPool], newTransport func(roots *x509.CertPool) *http.Transport) *caReloadingTransport {
+	return &caReloadingTransport{
+		roots:        roots,
+		newTransport: newTransport,
+	}
+}
+
+func (t *caReloadingTransport) current() (*http.Transport, error) {
+	roots, err := t.roots.get()
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if roots != t.currentRoots {
+		if t.transport != nil {
+			t.transport.CloseIdleConnections()
+		}
+		t.transport = t.newTransport(roots)
+		t.currentRoots = roots
+	}
+	return t.transport, nil
+}
+
+func (t *caReloadingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	transport, err := t.current()
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(r)
+}
+
+func (t *caReloadingTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+}
+
+// reloadingFile caches a value loaded from files and loads it again if the
+// modification time of one of the files changed. If loading fails the
+// previous value is kept.
+type reloadingFile[T any] struct {
+	files []string
+	load  func() (T, error)
+
+	mu      sync.Mutex
+	value   T
+	modTime time.Time
+	loaded  bool
+}
+
+func (r *reloadingFile[T]) get() (T, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime := time.Time{}
+	for _, file := range r.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			if r.loaded {
+				slog.Error("failed to check file for changes", "file", file, "err", err)
+				return r.value, nil
+			}
+			return r.value, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.loaded && modTime.Equal(r.modTime) {
+		return r.value, nil
+	}
+
+	value, err := r.load()
+	if err != nil {
+		if r.loaded {
+			// try again after the next change
+			r.modTime = modTime
+			slog.Error("failed to reload file", "files", r.files, "err", err)
+			return r.value, nil
+		}
+		return r.value, err
+	}
+	if r.loaded {
+		slog.Info("reloaded file", "files", r.files)
+	}
+	r.value = value
+	r.modTime = modTime
+	r.loaded = true
+	return r.value, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+var testFileWrites int
+
+func writeTestFile(t *testing.T, file string, data []byte) {
+	err := os.WriteFile(file, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time changes on file systems with a
+	// coarse resolution
+	testFileWrites++
+	modTime := time.Now().Add(time.Duration(testFileWrites) * time.Second)
+	os.Chtimes(file, modTime, modTime)
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey := writeTestCert(t, dir, "client")
+	otherCA, _ := writeTestCert(t, dir, "other")
+
+	clientCAs := x509.NewCertPool()
+	data, _ := os.ReadFile(clientCert)
+	clientCAs.AppendCertsFromPEM(data)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	serverCA := filepath.Join(dir, "server.crt")
+	writeTestFile(t, serverCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}))
+
+	for _, test := range []struct {
+		name         string
+		tls          upstreamTLSOptions
+		expectedCode int
+	}{
+		{
+			name:         "system_ca",
+			tls:          upstreamTLSOptions{CertFile: clientCert, KeyFile: clientKey},
+			expectedCode: http.StatusBadGateway,
+		},
+		{
+			name:         "ca",
+			tls:          upstreamTLSOptions{CAFile: serverCA, CertFile: clientCert, KeyFile: clientKey},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "wrong_ca",
+			tls:          upstreamTLSOptions{CAFile: otherCA, CertFile: clientCert, KeyFile: clientKey},
+			expectedCode: http.StatusBadGateway,
+		},
+		{
+			name:         "no_client_cert",
+			tls:          upstreamTLSOptions{CAFile: serverCA},
+			expectedCode: http.StatusBadGateway,
+		},
+		{
+			name:         "server_name",
+			tls:          upstreamTLSOptions{CAFile: serverCA, CertFile: clientCert, KeyFile: clientKey, ServerName: "example.com"},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "wrong_server_name",
+			tls:          upstreamTLSOptions{CAFile: serverCA, CertFile: clientCert, KeyFile: clientKey, ServerName: "example.org"},
+			expectedCode: http.StatusBadGateway,
+		},
+		{
+			name:         "skip_verify",
+			tls:          upstreamTLSOptions{CertFile: clientCert, KeyFile: clientKey, InsecureSkipVerify: true},
+			expectedCode: http.StatusOK,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaultUpstreamPoolOptions()
+			opts.Retry.MaxRetries = 0
+			opts.TLS = test.tls
+			pool, err := newUpstreamPool([]string{upstream.URL}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := doTLSRequest(t, pool)
+			if code != test.expectedCode {
+				t.Errorf("expected code %d, got: %d", test.expectedCode, code)
+			}
+		})
+	}
+}
+
+func doTLSRequest(t *testing.T, pool *upstreamPool) int {
+	rec := httptest.NewRecorder()
+	forwardCustomTransportHandler(pool, headerRules{}).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Code
+}
+
+func TestUpstreamTLSReload(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	otherCA, _ := writeTestCert(t, dir, "other")
+	caFile := filepath.Join(dir, "ca.crt")
+	data, _ := os.ReadFile(otherCA)
+	writeTestFile(t, caFile, data)
+
+	opts := defaultUpstreamPoolOptions()
+	opts.Retry.MaxRetries = 0
+	opts.TLS = upstreamTLSOptions{CAFile: caFile}
+	pool, err := newUpstreamPool([]string{upstream.URL}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := doTLSRequest(t, pool); code != http.StatusBadGateway {
+		t.Fatalf("expected code %d with wrong CA, got: %d", http.StatusBadGateway, code)
+	}
+
+	writeTestFile(t, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}))
+	if code := doTLSRequest(t, pool); code != http.StatusOK {
+		t.Fatalf("expected code %d after reload, got: %d", http.StatusOK, code)
+	}
+}
+
+func TestUpstreamTLSHostVerification(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "other.internal"},
+		DNSNames:     []string{"other.internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writeTestFile(t, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	for _, test := range []struct {
+		name         string
+		tls          upstreamTLSOptions
+		expectedCode int
+	}{
+		{
+			// the upstream URL has an IP address which is not in
+			// the certificate
+			name:         "ip_mismatch",
+			tls:          upstreamTLSOptions{CAFile: caFile},
+			expectedCode: http.StatusBadGateway,
+		},
+		{
+			name:         "server_name",
+			tls:          upstreamTLSOptions{CAFile: caFile, ServerName: "other.internal"},
+			expectedCode: http.StatusOK,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaultUpstreamPoolOptions()
+			opts.Retry.MaxRetries = 0
+			opts.TLS = test.tls
+			pool, err := newUpstreamPool([]string{upstream.URL}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := doTLSRequest(t, pool)
+			if code != test.expectedCode {
+				t.Errorf("expected code %d, got: %d", test.expectedCode, code)
+			}
+		})
+	}
+}